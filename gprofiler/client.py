@@ -3,11 +3,14 @@
 # Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
 #
 import datetime
+import email.utils
 import gzip
 import json
 import logging
+import time
 from io import BytesIO
-from typing import Dict
+from threading import Event
+from typing import Any, Dict, Mapping, Optional, Sequence
 
 import requests
 from requests import Session
@@ -20,6 +23,16 @@ GRANULATE_SERVER_HOST = "https://profiler.granulate.io"
 DEFAULT_REQUEST_TIMEOUT = 5
 DEFAULT_UPLOAD_TIMEOUT = 120
 
+# responses that ask us to back off, and are retried
+RETRY_STATUS_CODES = [429, 503]
+MAX_RETRIES = 3
+# if the server asks us to wait longer than that, we give up on the request instead.
+MAX_RETRY_AFTER = 300
+# and the same for the total waiting time of all retries of a request (by default)
+MAX_TOTAL_RETRY_AFTER = 600
+# used when the server doesn't specify Retry-After, multiplied on each retry
+DEFAULT_RETRY_AFTER = 5
+
 
 class APIError(Exception):
     def __init__(self, message: str, full_data: dict = None):
@@ -30,13 +43,76 @@ class APIError(Exception):
         return self.message
 
 
+def parse_retry_after(value: Optional[str]) -> Optional[float]:
+    """
+    Parses a Retry-After header, which is either a number of seconds or an HTTP date.
+    """
+    if value is None:
+        return None
+    value = value.strip()
+    if value.isdigit():
+        return float(value)
+    try:
+        retry_date = email.utils.parsedate_to_datetime(value)
+    except (TypeError, ValueError):
+        return None
+    if retry_date is None:
+        return None
+    return max((retry_date - datetime.datetime.now(datetime.timezone.utc)).total_seconds(), 0)
+
+
+class ThrottledReader:
+    """
+    File-like request body which is read no faster than 'bytes_per_second'. requests sends bodies with a length
+    (so Content-Length is set, and the body isn't chunked), reading them block by block.
+    """
+
+    def __init__(self, data: bytes, bytes_per_second: int):
+        self._data = data
+        self._bytes_per_second = bytes_per_second
+        self._position = 0
+        self._start_time: Optional[float] = None
+
+    def __len__(self) -> int:
+        return len(self._data) - self._position
+
+    def read(self, size: int = -1) -> bytes:
+        if self._start_time is None:
+            self._start_time = time.monotonic()
+        if size < 0:
+            size = len(self)
+        chunk = self._data[self._position : self._position + size]
+        self._position += len(chunk)
+        # sleep until the time this chunk is "due" at the given rate
+        due_time = self._start_time + self._position / self._bytes_per_second
+        delay = due_time - time.monotonic()
+        if delay > 0:
+            time.sleep(delay)
+        return chunk
+
+
 class APIClient:
     BASE_PATH = "api"
 
-    def __init__(self, host: str, key: str, service: str, upload_timeout: int, version: str = "v1"):
+    def __init__(
+        self,
+        host: str,
+        key: str,
+        service: str,
+        upload_timeout: int,
+        version: str = "v1",
+        bandwidth_limit: int = 0,
+        max_total_retry_after: float = MAX_TOTAL_RETRY_AFTER,
+    ):
+        """
+        :param bandwidth_limit: Maximum upload rate of request bodies, in bytes per second (0 for unlimited).
+        :param max_total_retry_after: Maximum total time to wait for retries of a request, in seconds.
+        """
         self._host: str = host
         self._upload_timeout = upload_timeout
         self._version: str = version
+        self._bandwidth_limit = bandwidth_limit
+        self._max_total_retry_after = max_total_retry_after
 
         self._init_session(key, service)
         logger.info("The connection to the server was successfully established")
@@ -52,8 +128,17 @@ class APIClient:
         return "{}/{}/{}".format(self._host.rstrip("/"), self.BASE_PATH, self._version)
 
     def _send_request(
-        self, method: str, path: str, data: Dict, files: Dict = None, timeout: float = DEFAULT_REQUEST_TIMEOUT
+        self,
+        method: str,
+        path: str,
+        data: Dict,
+        files: Dict = None,
+        timeout: float = DEFAULT_REQUEST_TIMEOUT,
+        stop_event: Optional[Event] = None,
     ) -> Dict:
+        """
+        :param stop_event: If given, retries are aborted once it's set.
+        """
         opts: dict = {"headers": {}, "files": files, "timeout": timeout}
 
         if method.upper() == "GET":
@@ -64,9 +149,29 @@ class APIClient:
             buffer = BytesIO()
             with gzip.open(buffer, mode="wt", encoding="utf-8") as gzip_file:
                 json.dump(data, gzip_file, ensure_ascii=False)  # type: ignore
-            opts["data"] = buffer.getvalue()
+            body = buffer.getvalue()
+
+        url = "{}/{}".format(self.get_base_url(), path)
+        total_retry_after = 0.0
+        for attempt in range(MAX_RETRIES + 1):
+            if method.upper() != "GET":
+                # a new reader per attempt, since it's consumed by the request
+                opts["data"] = ThrottledReader(body, self._bandwidth_limit) if self._bandwidth_limit > 0 else body
+            resp = self._session.request(method, url, **opts)
+            if resp.status_code not in RETRY_STATUS_CODES or attempt == MAX_RETRIES:
+                break
+            retry_after = parse_retry_after(resp.headers.get("Retry-After"))
+            if retry_after is None:
+                retry_after = DEFAULT_RETRY_AFTER * 2 ** attempt
+            if retry_after > MAX_RETRY_AFTER or total_retry_after + retry_after > self._max_total_retry_after:
+                raise APIError(f"Server asked to retry after {retry_after:.0f} seconds, giving up on the request")
+            total_retry_after += retry_after
+            logger.info(f"Server is rate limiting requests (HTTP {resp.status_code}), retrying in {retry_after:.0f}s")
+            if stop_event is None:
+                time.sleep(retry_after)
+            elif stop_event.wait(retry_after):
+                raise APIError("Stopping, giving up on the request")
 
-        resp = self._session.request(method, "{}/{}".format(self.get_base_url(), path), **opts)
         if 400 <= resp.status_code < 500:
             try:
                 data = resp.json()
@@ -96,15 +201,28 @@ class APIClient:
         return self.get("health_check")
 
     def submit_profile(
-        self, start_time: datetime.datetime, end_time: datetime.datetime, hostname: str, profile: str
+        self,
+        start_time: datetime.datetime,
+        end_time: datetime.datetime,
+        hostname: str,
+        profile: str,
+        metadata: Optional[Dict] = None,
+        profile_type: Optional[str] = None,
+        inventory: Optional[Sequence[Mapping[str, Any]]] = None,
+        stop_event: Optional[Event] = None,
     ) -> Dict:
-        return self.post(
-            "profiles",
-            {
-                "start_time": get_iso8061_format_time(start_time),
-                "end_time": get_iso8061_format_time(end_time),
-                "hostname": hostname,
-                "profile": profile,
-            },
-            timeout=self._upload_timeout,
-        )
+        data: Dict = {
+            "start_time": get_iso8061_format_time(start_time),
+            "end_time": get_iso8061_format_time(end_time),
+            "hostname": hostname,
+            "profile": profile,
+        }
+        if metadata:
+            data["metadata"] = metadata
+        if profile_type is not None:
+            # profiles other than CPU profiles, e.g "python_allocations"
+            data["profile_type"] = profile_type
+        if inventory is not None:
+            # the processes that existed during the profile, see inventory.build_inventory
+            data["inventory"] = list(inventory)
+        return self.post("profiles", data, timeout=self._upload_timeout, stop_event=stop_event)
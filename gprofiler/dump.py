@@ -0,0 +1,146 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import concurrent.futures
+import datetime
+import logging
+import os
+import re
+from pathlib import Path
+from socket import gethostname
+from typing import Iterable, List, Tuple
+
+import psutil
+from psutil import Process
+
+from .java import JAVA_PROCESS_EXE_REGEX
+from .privileges import ATTACH, PTRACE
+from .python import is_python_process
+from .utils import get_iso8061_format_time, get_process_container_id, resource_path, run_process
+
+logger = logging.getLogger(__name__)
+
+# processes dumped at once - each runs a jattach / py-spy child.
+MAX_CONCURRENT_DUMPS = 8
+
+
+def find_container_processes(container_id: str) -> List[Process]:
+    """
+    Finds all processes of a container. 'container_id' may be a prefix of the full ID (like the short IDs
+    printed by "docker ps").
+    """
+    processes = []
+    for process in psutil.process_iter():
+        try:
+            process_container_id = get_process_container_id(process.pid)
+        except FileNotFoundError:
+            continue  # process went down
+        if process_container_id is not None and process_container_id.startswith(container_id):
+            processes.append(process)
+    return processes
+
+
+def is_java_process(process: Process) -> bool:
+    return re.match(JAVA_PROCESS_EXE_REGEX, process.exe()) is not None
+
+
+def dump_java_threads(process: Process) -> str:
+    # jattach prints a short header ("Connected to remote JVM") followed by the JVM's response.
+    return run_process(
+        [resource_path("java/jattach"), str(process.pid), "threaddump"], privileges=ATTACH
+    ).stdout.decode()
+
+
+def dump_python_threads(process: Process) -> str:
+    return run_process(
+        [resource_path("python/py-spy"), "dump", "--pid", str(process.pid)], privileges=PTRACE
+    ).stdout.decode()
+
+
+def get_kernel_stacks(pid: int) -> List[Tuple[int, str, str]]:
+    """
+    Reads the kernel stacks of all threads of a process, from /proc/pid/task/*/stack.
+    This doesn't require stopping or ptrace()ing the process.
+    :returns: List of (tid, comm, stack)
+    """
+    stacks = []
+    for task in sorted(os.listdir(f"/proc/{pid}/task"), key=int):
+        task_dir = f"/proc/{pid}/task/{task}"
+        try:
+            comm = Path(task_dir, "comm").read_text().strip()
+            stack = Path(task_dir, "stack").read_text()
+        except FileNotFoundError:
+            continue  # thread exited
+        except OSError as e:
+            stack = f"(unavailable: {e})\n"
+        stacks.append((int(task), comm, stack))
+    return stacks
+
+
+def _dump_process(process: Process) -> str:
+    lines = [
+        f"=== Process {process.pid} ({process.name()}) ===",
+        f"Captured at: {get_iso8061_format_time(datetime.datetime.utcnow())}",
+        f"Command line: {' '.join(process.cmdline())}",
+        f"Container: {get_process_container_id(process.pid) or '(none)'}",
+        "",
+    ]
+
+    # take the kernel stacks first, since they are the cheapest to get, and runtime dumps might change
+    # the state of the process (e.g, py-spy stops it for a short moment)
+    kernel_stacks = get_kernel_stacks(process.pid)
+
+    runtime_dump = None
+    try:
+        if is_java_process(process):
+            runtime_dump = ("Java threads (jattach threaddump)", dump_java_threads(process))
+        elif is_python_process(process):
+            runtime_dump = ("Python threads (py-spy dump)", dump_python_threads(process))
+    except Exception as e:
+        logger.exception(f"Failed to dump runtime threads of process {process.pid}")
+        runtime_dump = ("Runtime threads", f"(failed: {e})\n")
+
+    if runtime_dump is not None:
+        title, dump = runtime_dump
+        lines += [f"--- {title} ---", dump.rstrip("\n"), ""]
+
+    lines.append("--- Kernel stacks ---")
+    for tid, comm, stack in kernel_stacks:
+        lines.append(f"Thread {tid} ({comm}):")
+        lines.append(stack.rstrip("\n") or "(empty)")
+        lines.append("")
+
+    return "\n".join(lines)
+
+
+def dump_threads(processes: Iterable[Process]) -> str:
+    """
+    Dumps the stacks of all threads of 'processes', and returns a unified report.
+    Processes are dumped concurrently (up to MAX_CONCURRENT_DUMPS at a time), so the dumps are as close as possible
+    to the same point in time.
+    """
+    processes = [process for process in processes if process.pid != os.getpid()]
+    report = [
+        "gProfiler thread dump",
+        f"Time: {get_iso8061_format_time(datetime.datetime.utcnow())}",
+        f"Hostname: {gethostname()}",
+        "",
+    ]
+    if not processes:
+        return "\n".join(report + ["No processes to dump.", ""])
+
+    with concurrent.futures.ThreadPoolExecutor(max_workers=min(len(processes), MAX_CONCURRENT_DUMPS)) as executor:
+        futures = {executor.submit(_dump_process, process): process.pid for process in processes}
+        results = {}
+        for future in concurrent.futures.as_completed(futures):
+            pid = futures[future]
+            try:
+                results[pid] = future.result()
+            except psutil.NoSuchProcess:
+                results[pid] = f"=== Process {pid} ===\n(process exited)\n"
+            except Exception as e:
+                logger.exception(f"Failed to dump process {pid}")
+                results[pid] = f"=== Process {pid} ===\n(failed: {e})\n"
+
+    return "\n".join(report + [results[pid] for pid in sorted(results)])
@@ -0,0 +1,183 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import struct
+from typing import BinaryIO, Iterable, Iterator, List, NamedTuple, Optional, Tuple
+
+ELF_MAGIC = b"\x7fELF"
+ELFCLASS32 = 1
+ELFCLASS64 = 2
+ELFDATA2MSB = 2
+
+SHT_SYMTAB = 2
+SHT_NOTE = 7
+SHT_DYNSYM = 11
+SHN_UNDEF = 0
+STT_FUNC = 2
+
+PT_LOAD = 1
+PT_NOTE = 4
+
+NT_GNU_BUILD_ID = 3
+
+
+class ElfSection(NamedTuple):
+    type: int
+    address: int
+    offset: int
+    size: int
+    link: int
+
+
+class ElfSegment(NamedTuple):
+    type: int
+    offset: int
+    address: int
+    file_size: int
+    memory_size: int
+
+
+class ElfSymbol(NamedTuple):
+    name: str
+    value: int
+    size: int
+    section_index: int
+    type: int
+
+
+class ElfFile:
+    """
+    Minimal ELF parser - only what gProfiler needs, without depending on external tools (like "readelf"),
+    which might not exist on the host or in the target's mount namespace.
+    """
+
+    def __init__(self, f: BinaryIO):
+        self._f = f
+        ident = f.read(16)
+        if len(ident) < 16 or ident[:4] != ELF_MAGIC:
+            raise ValueError("not an ELF file")
+        if ident[4] not in (ELFCLASS32, ELFCLASS64):
+            raise ValueError(f"unknown ELF class {ident[4]}")
+        self.is_64 = ident[4] == ELFCLASS64
+        self._endian = ">" if ident[5] == ELFDATA2MSB else "<"
+
+        if self.is_64:
+            self._phoff, self._shoff = self._unpack_at(0x20, "QQ")
+            self._phentsize, self._phnum, self._shentsize, self._shnum = self._unpack_at(0x36, "HHHH")
+        else:
+            self._phoff, self._shoff = self._unpack_at(0x1C, "II")
+            self._phentsize, self._phnum, self._shentsize, self._shnum = self._unpack_at(0x2A, "HHHH")
+
+    def _unpack_at(self, offset: int, fmt: str) -> tuple:
+        fmt = self._endian + fmt
+        self._f.seek(offset)
+        return struct.unpack(fmt, self._f.read(struct.calcsize(fmt)))
+
+    def read_at(self, offset: int, size: int) -> bytes:
+        self._f.seek(offset)
+        return self._f.read(size)
+
+    def sections(self) -> List[ElfSection]:
+        sections = []
+        for i in range(self._shnum):
+            offset = self._shoff + i * self._shentsize
+            if self.is_64:
+                _, sh_type, _, addr, sh_offset, size, link, _, _, _ = self._unpack_at(offset, "IIQQQQIIQQ")
+            else:
+                _, sh_type, _, addr, sh_offset, size, link, _, _, _ = self._unpack_at(offset, "IIIIIIIIII")
+            sections.append(ElfSection(sh_type, addr, sh_offset, size, link))
+        return sections
+
+    def segments(self) -> List[ElfSegment]:
+        segments = []
+        for i in range(self._phnum):
+            offset = self._phoff + i * self._phentsize
+            if self.is_64:
+                p_type, _, p_offset, vaddr, _, filesz, memsz, _ = self._unpack_at(offset, "IIQQQQQQ")
+            else:
+                p_type, p_offset, vaddr, _, filesz, memsz, _, _ = self._unpack_at(offset, "IIIIIIII")
+            segments.append(ElfSegment(p_type, p_offset, vaddr, filesz, memsz))
+        return segments
+
+    def notes(self) -> Iterator[Tuple[str, int, bytes]]:
+        """
+        Iterates over the notes of the file, as (name, type, descriptor). Notes are read from the note sections,
+        or from the note segments if the file has no section headers.
+        """
+        note_sections = [(s.offset, s.size) for s in self.sections() if s.type == SHT_NOTE]
+        if not note_sections:
+            note_sections = [(s.offset, s.file_size) for s in self.segments() if s.type == PT_NOTE]
+        for offset, size in note_sections:
+            data = self.read_at(offset, size)
+            pos = 0
+            while pos + 12 <= len(data):
+                namesz, descsz, note_type = struct.unpack_from(self._endian + "III", data, pos)
+                pos += 12
+                name = data[pos : pos + namesz].rstrip(b"\0").decode(errors="replace")
+                pos += _align4(namesz)
+                yield name, note_type, data[pos : pos + descsz]
+                pos += _align4(descsz)
+
+    def build_id(self) -> Optional[str]:
+        for name, note_type, desc in self.notes():
+            if name == "GNU" and note_type == NT_GNU_BUILD_ID:
+                return desc.hex()
+        return None
+
+    def symbols(self) -> Iterator[ElfSymbol]:
+        """
+        Iterates over the symbols of both the static (.symtab) and the dynamic (.dynsym) symbol tables.
+        """
+        sections = self.sections()
+        for section in sections:
+            if section.type not in (SHT_SYMTAB, SHT_DYNSYM) or section.link >= len(sections):
+                continue
+            strtab_section = sections[section.link]
+            strtab = self.read_at(strtab_section.offset, strtab_section.size)
+            data = self.read_at(section.offset, section.size)
+            if self.is_64:
+                fmt = self._endian + "IBBHQQ"
+                entries = (
+                    (name, value, size, shndx, info) for name, info, _, shndx, value, size in _iter_unpack(fmt, data)
+                )
+            else:
+                fmt = self._endian + "IIIBBH"
+                entries = (
+                    (name, value, size, shndx, info) for name, value, size, info, _, shndx in _iter_unpack(fmt, data)
+                )
+            for name_offset, value, size, shndx, info in entries:
+                name_end = strtab.find(b"\0", name_offset)
+                if name_end == -1:
+                    continue
+                name = strtab[name_offset:name_end].decode(errors="replace")
+                yield ElfSymbol(name, value, size, shndx, info & 0xF)
+
+
+def _align4(size: int) -> int:
+    return (size + 3) & ~3
+
+
+def _iter_unpack(fmt: str, data: bytes) -> Iterator[tuple]:
+    entry_size = struct.calcsize(fmt)
+    # ignore a trailing partial entry, if any (struct.iter_unpack would raise)
+    return struct.iter_unpack(fmt, data[: len(data) - len(data) % entry_size])
+
+
+def offset_to_address(segments: Iterable[ElfSegment], offset: int) -> Optional[int]:
+    """
+    Translates a file offset to the virtual address it is loaded at (relative to the load base).
+    """
+    for segment in segments:
+        if segment.type == PT_LOAD and segment.offset <= offset < segment.offset + segment.file_size:
+            return offset - segment.offset + segment.address
+    return None
+
+
+def elf_has_defined_symbols(path: str, names: Iterable[str]) -> bool:
+    """
+    Checks whether the ELF file at 'path' defines (not only references) any of the symbols in 'names'.
+    """
+    names = set(names)
+    with open(path, "rb") as f:
+        return any(symbol.name in names and symbol.section_index != SHN_UNDEF for symbol in ElfFile(f).symbols())
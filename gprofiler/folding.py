@@ -0,0 +1,60 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import re
+from typing import Iterable, List, Optional, Tuple
+
+# Built-in rules for "library" frames. Rules are regexes, searched in the location of each frame: for Python frames
+# that's the frame itself (which contains the file path), for Java frames it's the frame itself (which starts with
+# the package name) and for native frames collected by perf, it's the path of the DSO.
+FOLD_PRESETS = {
+    "python": [r"/(?:site|dist)-packages/", r"/lib/python[23](?:\.\d+)?/"],
+    "java": [r"^(?:java|javax|jdk|sun|com[./]sun)[./]"],
+    "java-frameworks": [
+        r"^org[./](?:springframework|apache|eclipse[./]jetty|hibernate)[./]",
+        r"^io[./](?:netty|micrometer)[./]",
+        r"^com[./](?:fasterxml|zaxxer)[./]",
+    ],
+    "libc": [r"/(?:libc|libpthread|libdl|libm|librt|ld-linux[^/]*|ld-musl[^/]*)[-.][^/]*$"],
+}
+FOLD_MODES = ["placeholder", "elide"]
+
+
+class StackFolder:
+    """
+    Folds "library" frames, so flamegraphs focus on the application's code ("just my code").
+    Consecutive library frames are replaced by a single placeholder frame, or are removed entirely.
+    """
+
+    PLACEHOLDER = "[library]"
+
+    def __init__(self, patterns: Iterable[str], elide: bool = False):
+        self._regex = re.compile("|".join(f"(?:{pattern})" for pattern in patterns))
+        self._elide = elide
+
+    def fold(self, frames: Iterable[Tuple[str, str]]) -> List[str]:
+        """
+        :param frames: (frame, location) pairs, ordered from the root.
+        """
+        folded: List[str] = []
+        for frame, location in frames:
+            if self._regex.search(location) is None:
+                folded.append(frame)
+            elif not self._elide and (not folded or folded[-1] != self.PLACEHOLDER):
+                folded.append(self.PLACEHOLDER)
+        return folded
+
+    def fold_stack(self, stack: str) -> str:
+        """
+        Folds a collapsed stack of a runtime profiler, where each frame is also its own location.
+        """
+        return ";".join(self.fold((frame, frame) for frame in stack.split(";")))
+
+
+def get_stack_folder(presets: Iterable[str], patterns: Iterable[str], mode: str) -> Optional[StackFolder]:
+    assert mode in FOLD_MODES, f"unknown fold mode {mode!r}"
+    all_patterns = [pattern for preset in presets for pattern in FOLD_PRESETS[preset]] + list(patterns)
+    if not all_patterns:
+        return None
+    return StackFolder(all_patterns, elide=mode == "elide")
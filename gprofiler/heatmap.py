@@ -0,0 +1,65 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import json
+import logging
+from pathlib import Path
+from typing import Any, Dict, Iterable, List, Mapping, Optional, Tuple
+
+from .folding import StackFolder
+from .merge import collapse_stack
+from .utils import resource_path
+
+logger = logging.getLogger(__name__)
+
+# number of sub-second buckets in each column of the heatmap (i.e, each bucket is 20ms) - like FlameScope.
+HEATMAP_ROWS = 50
+
+
+def get_heatmap_data(
+    perf_samples: Iterable[Mapping[str, str]], annotate_frames: bool = False, folder: Optional[StackFolder] = None
+) -> Dict[str, Any]:
+    """
+    Builds the data for the heatmap view out of "perf" samples (as returned by parse_perf_script).
+    Stacks are deduplicated into a table, and each sample is represented by its offset (in milliseconds)
+    from the first sample and the index of its stack.
+    """
+    stack_indices: Dict[str, int] = {}
+    timed_samples: List[Tuple[float, int]] = []
+    for parsed in perf_samples:
+        try:
+            if parsed["stack"] is None:
+                continue
+            timestamp = float(parsed["time"])
+            stack = collapse_stack(parsed["stack"], parsed["comm"], annotate_frames, folder)
+        except Exception:
+            logger.exception(f"Error processing sample: {parsed}")
+            continue
+        timed_samples.append((timestamp, stack_indices.setdefault(stack, len(stack_indices))))
+
+    timed_samples.sort()
+    first_timestamp = timed_samples[0][0] if timed_samples else 0.0
+    return {
+        "rows": HEATMAP_ROWS,
+        "stacks": sorted(stack_indices, key=stack_indices.__getitem__),
+        "samples": [[round((timestamp - first_timestamp) * 1000), index] for timestamp, index in timed_samples],
+    }
+
+
+def render_heatmap(
+    perf_samples: Iterable[Mapping[str, str]],
+    start_time: str,
+    end_time: str,
+    annotate_frames: bool = False,
+    folder: Optional[StackFolder] = None,
+) -> str:
+    # escape "</" so stack names can't terminate the <script> block the data is embedded in.
+    heatmap_data = json.dumps(get_heatmap_data(perf_samples, annotate_frames, folder)).replace("</", "<\\/")
+    return (
+        Path(resource_path("flamegraph/heatmap_template.html"))
+        .read_text()
+        .replace("{{{HEATMAP_DATA}}}", heatmap_data)
+        .replace("{{{START_TIME}}}", start_time)
+        .replace("{{{END_TIME}}}", end_time)
+    )
@@ -0,0 +1,307 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+"""
+Import of profiles collected by other tools ("gprofiler import") into gProfiler's collapsed stacks format:
+perf.data captures (via the bundled perf), pprof profiles (e.g of Go services) and collapsed stacks files.
+"""
+import datetime
+import gzip
+import logging
+import os
+import zlib
+from collections import Counter
+from typing import Dict, Iterator, List, MutableMapping, NamedTuple, Optional, Tuple, Union
+
+from . import merge
+from .privileges import POST_PROCESSING
+from .utils import resource_path, run_process
+
+logger = logging.getLogger(__name__)
+
+PERF_FORMAT = "perf"
+PPROF_FORMAT = "pprof"
+COLLAPSED_FORMAT = "collapsed"
+IMPORT_FORMATS = [PERF_FORMAT, PPROF_FORMAT, COLLAPSED_FORMAT]
+
+PERF_DATA_MAGIC = b"PERFILE2"
+GZIP_MAGIC = b"\x1f\x8b"
+
+# protobuf wire types
+VARINT = 0
+FIXED64 = 1
+LENGTH_DELIMITED = 2
+FIXED32 = 5
+
+
+class ImportedProfile(NamedTuple):
+    stacks: MutableMapping[str, int]
+    metadata: Dict
+    # the time range of the profile, if the input has it
+    start_time: Optional[datetime.datetime] = None
+    end_time: Optional[datetime.datetime] = None
+
+
+def detect_format(path: str) -> str:
+    """
+    :raises ValueError: If the format can't be detected - the input should be passed with its format then.
+    """
+    with open(path, "rb") as f:
+        head = f.read(len(PERF_DATA_MAGIC))
+        if head.startswith(PERF_DATA_MAGIC):
+            return PERF_FORMAT
+        if head.startswith(GZIP_MAGIC):
+            return PPROF_FORMAT
+        data = head + f.read()
+    # uncompressed pprof profiles may start with printable bytes as well, so they are detected by parsing them.
+    if _is_pprof(data):
+        return PPROF_FORMAT
+    try:
+        data.decode()
+    except UnicodeDecodeError:
+        raise ValueError(f"Can't detect the format of {path}, pass it with --format") from None
+    return COLLAPSED_FORMAT
+
+
+def import_perf_data(path: str) -> ImportedProfile:
+    """
+    Collapses a perf.data capture (recorded with -g) - symbolized on this host, as perf does.
+    """
+    # perf script refuses to read files that aren't owned by its user (or root) - and it runs as nobody, while
+    # perf.data captures are owned by whoever recorded them. -f skips that check; the file is read with
+    # CAP_DAC_READ_SEARCH anyway.
+    script = run_process(
+        [resource_path("perf"), "script", "-f", "-F", "+pid", "-i", path],
+        privileges=POST_PROCESSING,
+        suppress_log=True,
+    ).stdout.decode(errors="replace")
+    collapsed = merge.merge_perfs(merge.parse_perf_script(script), {})
+    return ImportedProfile(Counter(merge.parse_one_collapsed(collapsed)), {})
+
+
+def import_collapsed(path: str, process_name: Optional[str] = None) -> ImportedProfile:
+    """
+    Reads a collapsed stacks file, keeping the metadata of gProfiler's files.
+    """
+    with open(path) as f:
+        text = f.read()
+    metadata = {}
+    first_line = text.split("\n", 1)[0]
+    if first_line.startswith("#"):
+        metadata = merge.parse_metadata_line(first_line) or {}
+    stacks: MutableMapping[str, int] = Counter()
+    for stack, count in merge.parse_one_collapsed(text).items():
+        stacks[f"{process_name};{stack}" if process_name is not None else stack] += count
+    return ImportedProfile(stacks, metadata)
+
+
+def _read_varint(data: bytes, pos: int) -> Tuple[int, int]:
+    value = shift = 0
+    while True:
+        if pos >= len(data):
+            raise ValueError("Truncated protobuf varint")
+        byte = data[pos]
+        pos += 1
+        value |= (byte & 0x7F) << shift
+        shift += 7
+        if not byte & 0x80:
+            return value, pos
+
+
+def _iter_fields(data: bytes) -> Iterator[Tuple[int, Union[int, bytes]]]:
+    """
+    Iterates the fields of a protobuf message: (field number, value) - integers for varint & fixed fields, bytes
+    for length-delimited ones.
+    """
+    pos = 0
+    while pos < len(data):
+        key, pos = _read_varint(data, pos)
+        number, wire_type = key >> 3, key & 7
+        value: Union[int, bytes]
+        if wire_type == VARINT:
+            value, pos = _read_varint(data, pos)
+        elif wire_type == LENGTH_DELIMITED:
+            length, pos = _read_varint(data, pos)
+            value, pos = data[pos : pos + length], pos + length
+        elif wire_type == FIXED64:
+            value, pos = int.from_bytes(data[pos : pos + 8], "little"), pos + 8
+        elif wire_type == FIXED32:
+            value, pos = int.from_bytes(data[pos : pos + 4], "little"), pos + 4
+        else:
+            raise ValueError(f"Unsupported protobuf wire type {wire_type}")
+        if pos > len(data):
+            raise ValueError("Truncated protobuf message")
+        yield number, value
+
+
+def _repeated_ints(value: Union[int, bytes]) -> List[int]:
+    """
+    Repeated integer fields may be packed (length-delimited) or not.
+    """
+    if isinstance(value, int):
+        return [value]
+    values = []
+    pos = 0
+    while pos < len(value):
+        v, pos = _read_varint(value, pos)
+        values.append(v)
+    return values
+
+
+def _to_int64(value: int) -> int:
+    return value - (1 << 64) if value >= 1 << 63 else value
+
+
+def _message_fields(data: bytes) -> Dict[int, List[Union[int, bytes]]]:
+    fields: Dict[int, List[Union[int, bytes]]] = {}
+    for number, value in _iter_fields(data):
+        fields.setdefault(number, []).append(value)
+    return fields
+
+
+def _is_pprof(data: bytes) -> bool:
+    """
+    Checks that data is an uncompressed profile.proto: a valid protobuf message, with sample types and a string table
+    whose first string is empty, as the format requires.
+    """
+    try:
+        fields = _message_fields(data)
+    except ValueError:
+        return False
+    strings = fields.get(6, [])
+    return bool(fields.get(1)) and bool(strings) and strings[0] == b""
+
+
+def _int_field(fields: Dict[int, List[Union[int, bytes]]], number: int) -> int:
+    # the last value of non-repeated fields prevails
+    value = fields[number][-1] if number in fields else 0
+    return value if isinstance(value, int) else 0
+
+
+def _message_values(fields: Dict[int, List[Union[int, bytes]]], number: int) -> List[bytes]:
+    messages = []
+    for value in fields.get(number, []):
+        if not isinstance(value, bytes):
+            raise ValueError(f"Malformed pprof profile: field {number} is not a message")
+        messages.append(value)
+    return messages
+
+
+def _string(strings: List[str], index: int) -> str:
+    if index >= len(strings):
+        raise ValueError(f"Malformed pprof profile: string index {index} is out of the string table")
+    return strings[index]
+
+
+def parse_pprof(data: bytes, process_name: str, sample_type: Optional[str] = None) -> ImportedProfile:
+    """
+    Collapses a pprof profile (profile.proto, possibly gzipped).
+    :param sample_type: The sample value to use as the count, e.g "samples" or "cpu" (default: "samples" if the profile
+                        has it, otherwise the first).
+    """
+    if data.startswith(GZIP_MAGIC):
+        try:
+            data = gzip.decompress(data)
+        except (OSError, EOFError, zlib.error) as e:
+            raise ValueError(f"Malformed gzipped pprof profile: {e}") from e
+    profile = _message_fields(data)
+
+    strings = [s.decode(errors="replace") if isinstance(s, bytes) else "" for s in profile.get(6, [])]
+    sample_types = []
+    for value_type in _message_values(profile, 1):
+        sample_types.append(_string(strings, _int_field(_message_fields(value_type), 1)))
+    if sample_type is not None:
+        if sample_type not in sample_types:
+            raise ValueError(f"Sample type {sample_type!r} is not in the profile (it has: {', '.join(sample_types)})")
+        value_index = sample_types.index(sample_type)
+    else:
+        value_index = sample_types.index("samples") if "samples" in sample_types else 0
+
+    functions = {}
+    for function in _message_values(profile, 5):
+        fields = _message_fields(function)
+        functions[_int_field(fields, 1)] = _string(strings, _int_field(fields, 2))
+    mappings = {}
+    for mapping in _message_values(profile, 3):
+        fields = _message_fields(mapping)
+        mappings[_int_field(fields, 1)] = os.path.basename(_string(strings, _int_field(fields, 5)))
+    # location ID -> its frames, from the outermost (inlined functions have a location with multiple lines)
+    locations: Dict[int, List[str]] = {}
+    for location in _message_values(profile, 4):
+        fields = _message_fields(location)
+        frames = []
+        for line in _message_values(fields, 4):
+            frames.append(functions.get(_int_field(_message_fields(line), 1), "[unknown]"))
+        if not frames:
+            # unsymbolized - like perf does for unknown symbols
+            mapping = mappings.get(_int_field(fields, 2))
+            frames = [f"[{mapping}]" if mapping else "[unknown]"]
+        # lines are ordered from the innermost function
+        locations[_int_field(fields, 1)] = [frame.replace(";", ":") for frame in reversed(frames)]
+
+    stacks: MutableMapping[str, int] = Counter()
+    for sample in _message_values(profile, 2):
+        fields = _message_fields(sample)
+        location_ids = [i for value in fields.get(1, []) for i in _repeated_ints(value)]
+        values = [_to_int64(v) for value in fields.get(2, []) for v in _repeated_ints(value)]
+        if value_index >= len(values) or values[value_index] <= 0:
+            continue
+        # locations are ordered from the leaf
+        frames = [process_name] + [frame for i in reversed(location_ids) for frame in locations.get(i, ["[unknown]"])]
+        stacks[";".join(frames)] += values[value_index]
+
+    start_time = end_time = None
+    time_nanos = _int_field(profile, 9)
+    if time_nanos:
+        try:
+            start_time = datetime.datetime.utcfromtimestamp(time_nanos / 1e9)
+            end_time = start_time + datetime.timedelta(microseconds=_int_field(profile, 10) / 1e3)
+        except (OverflowError, OSError) as e:
+            raise ValueError(f"Malformed pprof profile: invalid time range ({e})") from e
+    return ImportedProfile(stacks, {}, start_time, end_time)
+
+
+def import_profile(
+    path: str,
+    input_format: Optional[str] = None,
+    process_name: Optional[str] = None,
+    pprof_sample_type: Optional[str] = None,
+) -> ImportedProfile:
+    """
+    :param process_name: Root frame for the stacks of the profile. Defaults to the name of the input file for pprof
+                         profiles, which have no process names; perf.data captures have their own.
+    """
+    input_format = input_format or detect_format(path)
+    logger.info(f"Importing {path} ({input_format})")
+    if input_format == PERF_FORMAT:
+        profile = import_perf_data(path)
+    elif input_format == PPROF_FORMAT:
+        with open(path, "rb") as f:
+            data = f.read()
+        name = process_name or os.path.basename(path).split(".")[0]
+        profile = parse_pprof(data, name, pprof_sample_type)
+    else:
+        profile = import_collapsed(path, process_name)
+    profile.metadata["imported"] = {"format": input_format, "source": os.path.basename(path)}
+    return profile
+
+
+def merge_profiles(profiles: List[ImportedProfile]) -> ImportedProfile:
+    """
+    Sums the stacks of profiles. Their metadata is combined (the first profile's prevails), and the time range is
+    taken from the first profile which has it.
+    """
+    stacks: MutableMapping[str, int] = Counter()
+    metadata: Dict = {}
+    for profile in reversed(profiles):
+        stacks.update(profile.stacks)
+        metadata.update(profile.metadata)
+    start_time = next((profile.start_time for profile in profiles if profile.start_time is not None), None)
+    end_time = next((profile.end_time for profile in profiles if profile.end_time is not None), None)
+    return ImportedProfile(stacks, metadata, start_time, end_time)
+
+
+def format_collapsed(profile: ImportedProfile) -> str:
+    stacks = "\n".join(f"{stack} {count}" for stack, count in profile.stacks.items())
+    return merge.format_metadata_line(profile.metadata) + "\n" + stacks
@@ -0,0 +1,92 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+"""
+Inventory of the processes that existed during a profiling interval - who they are, how much CPU they used, and
+which profiler covered them (or why a runtime profiler skipped them).
+"""
+import datetime
+from typing import Any, Callable, Dict, List, Mapping, NamedTuple, Optional, Tuple
+
+import psutil
+
+from .utils import get_iso8061_format_time, get_process_name
+from .versions import get_container_info
+
+# profiler of processes that no runtime profiler covered
+PERF_ONLY = "perf-only"
+
+
+class ProcessInfo(NamedTuple):
+    pid: int
+    create_time: float
+    comm: str
+    cmdline: List[str]
+    user: str
+    cpu_seconds: float
+
+
+def take_process_census() -> Dict[Tuple[int, float], ProcessInfo]:
+    """
+    :returns: Information of all running processes, by (pid, process creation time).
+    """
+    census = {}
+    for process in psutil.process_iter():
+        try:
+            with process.oneshot():
+                cpu_times = process.cpu_times()
+                info = ProcessInfo(
+                    process.pid,
+                    process.create_time(),
+                    get_process_name(process.pid),
+                    process.cmdline(),
+                    process.username(),
+                    cpu_times.user + cpu_times.system,
+                )
+        except psutil.NoSuchProcess:
+            continue
+        census[(info.pid, info.create_time)] = info
+    return census
+
+
+def build_inventory(
+    start_census: Mapping[Tuple[int, float], ProcessInfo],
+    end_census: Mapping[Tuple[int, float], ProcessInfo],
+    coverage: Mapping[int, str],
+    skipped: Mapping[int, Mapping[str, str]],
+    perf_available: bool,
+    get_container_id: Callable[[int], Optional[str]],
+) -> List[Dict[str, Any]]:
+    """
+    :param start_census: Census of processes taken at the start of the interval.
+    :param end_census: Census of processes taken at its end.
+    :param coverage: The runtime profiler that covered each process, by pid.
+    :param skipped: Reasons for runtime profilers to skip processes, by pid and then by profiler.
+    """
+    inventory = []
+    for key in sorted(start_census.keys() | end_census.keys()):
+        start, end = start_census.get(key), end_census.get(key)
+        info = end or start
+        assert info is not None
+        # processes that exited during the interval were last seen at its start; their container & CPU time are
+        # gone with them.
+        container_id = get_container_id(info.pid) if end is not None else None
+        entry: Dict[str, Any] = {
+            "pid": info.pid,
+            "start_time": get_iso8061_format_time(datetime.datetime.utcfromtimestamp(info.create_time)),
+            "comm": info.comm,
+            "cmdline": info.cmdline,
+            "user": info.user,
+            "container": container_id,
+            "pod": get_container_info(container_id).pod if container_id is not None else None,
+            "cpu_seconds": None
+            if end is None
+            else round(end.cpu_seconds - (start.cpu_seconds if start is not None else 0), 3),
+            "exited": end is None,
+            "profiler": coverage.get(info.pid, PERF_ONLY if perf_available else None),
+        }
+        if info.pid in skipped:
+            entry["skipped"] = dict(skipped[info.pid])
+        inventory.append(entry)
+    return inventory
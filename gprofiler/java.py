@@ -9,13 +9,25 @@ import shutil
 from pathlib import Path
 from subprocess import CalledProcessError
 from threading import Event
-from typing import Mapping, Optional
+from typing import Dict, List, Mapping, Optional, Tuple
 
 import psutil
 from psutil import Process
 
 from .exceptions import StopEventSetException
-from .merge import parse_one_collapsed
+from .java_advisor import (
+    advise_jvm_flags,
+    advise_unknown_java,
+    get_command_line_jvm_flags,
+    get_jvm_flags,
+    is_attach_disabled,
+    log_advice,
+)
+from .java_breakdown import breakdown_java_stacks, format_breakdown
+from .merge import annotate_stacks, parse_one_collapsed
+from .privileges import ATTACH, process_user_privileges
+from .safety import filter_runtime_attachable
+from .user_namespaces import get_files_owner
 from .utils import (
     TEMPORARY_STORAGE_PATH,
     is_same_ns,
@@ -30,22 +42,53 @@ from .utils import (
 
 logger = logging.getLogger(__name__)
 
+JAVA_PROCESS_EXE_REGEX = r"^.+/(java|jsvc)$"
+UNSUPPORTED_JAVA_VERSION = "unsupported Java version"
+
 
 class JavaProfiler:
+    NAME = "async-profiler"
     FORMAT_PARAMS = "ann,sig"
     OUTPUT_FORMAT = "collapsed"
     JDK_EXCLUSIONS = ["OpenJ9", "Zing"]
     SKIP_VERSION_CHECK_BINARIES = ["jsvc"]
 
-    def __init__(self, frequency: int, duration: int, use_itimer: bool, stop_event: Event, storage_dir: str):
+    def __init__(
+        self,
+        frequency: int,
+        duration: int,
+        use_itimer: bool,
+        stop_event: Event,
+        storage_dir: str,
+        annotate_frames: bool = False,
+        line_numbers: bool = False,
+        breakdown: bool = False,
+        breakdown_frames: bool = False,
+    ):
         logger.info(f"Initializing Java profiler (frequency: {frequency}hz, duration: {duration}s)")
 
-        # async-profiler accepts interval between samples (nanoseconds)
-        self._interval = int((1 / frequency) * 1000_000_000)
+        self.set_frequency(frequency)
         self._duration = duration
         self._use_itimer = use_itimer
         self._stop_event = stop_event
         self._storage_dir = storage_dir
+        self._annotate_frames = annotate_frames
+        self._format_params = self.FORMAT_PARAMS + (",lines" if line_numbers else "")
+        self._breakdown = breakdown
+        self._breakdown_frames = breakdown_frames
+        if breakdown:
+            # thread names, for the breakdown
+            self._format_params += ",threads"
+        # processes skipped in the last snapshot and the reasons, by pid
+        self.skipped_processes: Dict[int, str] = {}
+        # advice on the profile quality of the JVMs of the last snapshot, by pid (see java_advisor)
+        self.advice: Dict[int, Dict[str, str]] = {}
+        # samples of the JVMs of the last snapshot by category, by pid (see java_breakdown)
+        self.breakdowns: Dict[int, Dict[str, int]] = {}
+
+    def set_frequency(self, frequency: int) -> None:
+        # async-profiler accepts interval between samples (nanoseconds)
+        self._interval = int((1 / frequency) * 1000_000_000)
 
     def start(self):
         pass
@@ -80,7 +123,7 @@ class JavaProfiler:
             async_profiler_lib_path,
             "true",
             f"start,event={event_type},file={output_path},{self.OUTPUT_FORMAT},"
-            f"{self.FORMAT_PARAMS},interval={interval},framebuf=2000000,log={log_path}",
+            f"{self._format_params},interval={interval},framebuf=2000000,log={log_path}",
         ]
 
     def get_async_profiler_stop_cmd(
@@ -92,12 +135,12 @@ class JavaProfiler:
             "load",
             async_profiler_lib_path,
             "true",
-            f"stop,file={output_path},{self.OUTPUT_FORMAT},{self.FORMAT_PARAMS},log={log_path}",
+            f"stop,file={output_path},{self.OUTPUT_FORMAT},{self._format_params},log={log_path}",
         ]
 
     def run_async_profiler(self, cmd: str, log_path_host: str):
         try:
-            run_process(cmd)
+            run_process(cmd, privileges=ATTACH)
         except CalledProcessError:
             if os.path.exists(log_path_host):
                 logger.warning(f"async-profiler log: {Path(log_path_host).read_text()}")
@@ -109,6 +152,8 @@ class JavaProfiler:
         # but it requires to get the innermost PID (because the /proc in the target mount NS
         # is probably mounted with the innermost PID NS...)
         java_path = os.readlink(f"/proc/{process.pid}/exe")
+        # run it as the user of the process, which can surely execute it.
+        uids, gids = process.uids(), process.gids()
 
         java_version_cmd_output = None
 
@@ -119,7 +164,8 @@ class JavaProfiler:
                 [
                     java_path,
                     "-version",
-                ]
+                ],
+                privileges=process_user_privileges(uids.effective, gids.effective),
             )
 
         # doesn't work without changing PID NS as well (I'm getting ENOENT for libjli.so)
@@ -131,16 +177,15 @@ class JavaProfiler:
         # Version is printed to stderr
         return java_version_cmd_output.stderr.decode()
 
-    def profile_process(self, process: Process) -> Optional[Mapping[str, int]]:
-        logger.info(f"Profiling java process {process.pid}...")
-
-        # Get Java version
-        if os.path.basename(process.exe()) not in self.SKIP_VERSION_CHECK_BINARIES:
-            if not self.is_jdk_version_supported(self._get_java_version(process)):
-                logger.warning(f"Process {process.pid} running unsupported Java version, skipping...")
-                return None
+    def is_process_supported(self, process: Process) -> bool:
+        if os.path.basename(process.exe()) in self.SKIP_VERSION_CHECK_BINARIES:
+            return True
+        return self.is_jdk_version_supported(self._get_java_version(process))
 
-        process_root = f"/proc/{process.pid}/root"
+    def _get_storage_dir(self, process: Process) -> str:
+        """
+        :returns: The storage directory of the process, in its mount namespace.
+        """
         if is_same_ns(process.pid, "mnt"):
             # processes running in my namespace can use my (temporary) storage dir
             tmp_dir = self._storage_dir
@@ -150,34 +195,101 @@ class JavaProfiler:
 
         # we'll use separated storage directories per process: since multiple processes may run in the
         # same namespace, one may accidentally delete the storage directory of another.
-        storage_dir_host = resolve_proc_root_links(process_root, os.path.join(tmp_dir, str(process.pid)))
+        return os.path.join(tmp_dir, str(process.pid))
+
+    @staticmethod
+    def _get_storage_files(pid: int) -> Tuple[str, str, str]:
+        """
+        :returns: Names of the async-profiler library, output & log files in the storage directory.
+        """
+        return "libasyncProfiler.so", f"async-profiler-{pid}.output", f"async-profiler-{pid}.log"
+
+    def get_target_paths(self, process: Process) -> List[str]:
+        """
+        :returns: The paths written when profiling the process, in its mount namespace.
+        """
+        storage_dir = self._get_storage_dir(process)
+        return [storage_dir] + [os.path.join(storage_dir, name) for name in self._get_storage_files(process.pid)]
+
+    def find_processes_to_profile(self) -> List[Process]:
+        processes = []
+        for process in filter_runtime_attachable(pgrep_exe(JAVA_PROCESS_EXE_REGEX), self.NAME, self.skipped_processes):
+            try:
+                attach_disabled = is_attach_disabled(get_command_line_jvm_flags(process))
+            except (psutil.NoSuchProcess, FileNotFoundError, ProcessLookupError):
+                continue  # process has exited
+            if attach_disabled:
+                self.skipped_processes[process.pid] = "attach disabled (-XX:+DisableAttachMechanism)"
+            else:
+                processes.append(process)
+        return processes
+
+    def _get_advice(self, results: Mapping[int, Mapping[str, int]]) -> Dict[int, Dict[str, str]]:
+        advice = {}
+        for pid in results.keys() | self.skipped_processes.keys():
+            # the flags are of HotSpot, and other JVMs aren't profiled anyway
+            if self.skipped_processes.get(pid) == UNSUPPORTED_JAVA_VERSION:
+                continue
+            try:
+                process = Process(pid)
+                flags = get_jvm_flags(process, attach=pid in results)
+                process_advice = advise_jvm_flags(flags, profiled_by_async_profiler=pid in results)
+                if pid in results:
+                    process_advice.update(advise_unknown_java(results[pid]))
+                log_advice(process, process_advice)
+            except (psutil.NoSuchProcess, FileNotFoundError, ProcessLookupError):
+                continue  # process has exited
+            if process_advice:
+                advice[pid] = process_advice
+        return advice
+
+    def profile_process(self, process: Process) -> Optional[Mapping[str, int]]:
+        logger.info(f"Profiling java process {process.pid}...")
+
+        if not self.is_process_supported(process):
+            logger.warning(f"Process {process.pid} running unsupported Java version, skipping...")
+            self.skipped_processes[process.pid] = UNSUPPORTED_JAVA_VERSION
+            return None
+
+        process_root = f"/proc/{process.pid}/root"
+        storage_dir_host = resolve_proc_root_links(process_root, self._get_storage_dir(process))
+
+        # files owned by our root might be owned by an unmapped user in the user namespace of the process.
+        owner = get_files_owner(process.pid)
+        if owner is not None:
+            logger.debug(f"Process {process.pid} is in a remapped user namespace, giving its files to {owner}")
 
         try:
             # make it readable & exectuable by all.
             # see comment on TemporaryDirectoryWithMode in GProfiler.__init__.
             os.makedirs(storage_dir_host, 0o755)
-            return self._profile_process_with_dir(process, storage_dir_host, process_root)
+            if owner is not None:
+                os.chown(storage_dir_host, *owner)
+            return self._profile_process_with_dir(process, storage_dir_host, process_root, owner)
         finally:
             # ignore_errors because we are deleting paths via /proc/pid/root - and those processes
             # might have went down already.
             shutil.rmtree(storage_dir_host, ignore_errors=True)
 
     def _profile_process_with_dir(
-        self, process: Process, storage_dir_host: str, process_root: str
+        self, process: Process, storage_dir_host: str, process_root: str, owner: Optional[Tuple[int, int]]
     ) -> Optional[Mapping[str, int]]:
-        output_path_host = os.path.join(storage_dir_host, f"async-profiler-{process.pid}.output")
-        touch_path(output_path_host, 0o666)  # make it writable for all, so target process can write
+        libasyncprofiler_name, output_name, log_name = self._get_storage_files(process.pid)
+        output_path_host = os.path.join(storage_dir_host, output_name)
+        touch_path(output_path_host, 0o666, owner)  # make it writable for all, so target process can write
         output_path_process = remove_prefix(output_path_host, process_root)
 
-        libasyncprofiler_path_host = os.path.join(storage_dir_host, "libasyncProfiler.so")
+        libasyncprofiler_path_host = os.path.join(storage_dir_host, libasyncprofiler_name)
         libasyncprofiler_path_process = remove_prefix(libasyncprofiler_path_host, process_root)
         if not os.path.exists(libasyncprofiler_path_host):
             shutil.copy(resource_path("java/libasyncProfiler.so"), libasyncprofiler_path_host)
             # explicitly chmod to allow access for non-root users
             os.chmod(libasyncprofiler_path_host, 0o755)
+            if owner is not None:
+                os.chown(libasyncprofiler_path_host, *owner)
 
-        log_path_host = os.path.join(storage_dir_host, f"async-profiler-{process.pid}.log")
-        touch_path(log_path_host, 0o666)  # make it writable for all, so target process can write
+        log_path_host = os.path.join(storage_dir_host, log_name)
+        touch_path(log_path_host, 0o666, owner)  # make it writable for all, so target process can write
         log_path_process = remove_prefix(log_path_host, process_root)
 
         free_disk = psutil.disk_usage(output_path_host).free
@@ -232,11 +344,20 @@ class JavaProfiler:
             if not process.is_running() or not os.path.exists(process_root):
                 return None
             raise
-        return parse_one_collapsed(output)
+
+        stacks = parse_one_collapsed(output)
+        if self._annotate_frames:
+            # async-profiler already annotates Java & kernel frames ("ann"), so the rest are native frames.
+            stacks = annotate_stacks(stacks, "native")
+        return stacks
 
     def snapshot(self) -> Mapping[int, Mapping[str, int]]:
-        processes = list(pgrep_exe(r"^.+/(java|jsvc)$"))
+        self.skipped_processes = {}
+        self.advice = {}
+        self.breakdowns = {}
+        processes = self.find_processes_to_profile()
         if not processes:
+            self.advice = self._get_advice({})
             return {}
 
         with concurrent.futures.ThreadPoolExecutor(max_workers=len(processes)) as executor:
@@ -254,5 +375,11 @@ class JavaProfiler:
                     raise
                 except Exception:
                     logger.exception(f"Failed to profile Java process {futures[future]}")
+                    self.skipped_processes[futures[future]] = "profiling failed"
 
+        self.advice = self._get_advice(results)
+        if self._breakdown:
+            for pid, stacks in results.items():
+                results[pid], self.breakdowns[pid] = breakdown_java_stacks(stacks, self._breakdown_frames)
+                logger.info(f"Java process {pid}: {format_breakdown(self.breakdowns[pid])}")
         return results
@@ -0,0 +1,189 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+"""
+Advice on the quality of Java profiles: the JVM flags that affect it, and the share of the samples in which
+async-profiler couldn't walk the Java stack ([unknown_Java] frames).
+"""
+import logging
+import re
+from typing import Dict, List, Mapping, Set, Tuple
+
+from psutil import Process
+
+from .privileges import ATTACH
+from .utils import resource_path, run_process
+from .versions import get_process_environment
+
+logger = logging.getLogger(__name__)
+
+# -XX:+Flag, -XX:-Flag and -XX:Flag=value
+JVM_FLAG_REGEX = re.compile(r"(?:^|\s)-XX:(?:([+-])(\w+)|(\w+)=(\S*))")
+# the launcher prepends JAVA_TOOL_OPTIONS & JDK_JAVA_OPTIONS to the command line, and appends _JAVA_OPTIONS.
+PREPENDED_OPTIONS_ENV_VARS = ["JAVA_TOOL_OPTIONS", "JDK_JAVA_OPTIONS"]
+APPENDED_OPTIONS_ENV_VAR = "_JAVA_OPTIONS"
+# launcher options whose value is the following argument
+LAUNCHER_OPTIONS_WITH_VALUES = {
+    "-cp",
+    "-classpath",
+    "--class-path",
+    "-p",
+    "--module-path",
+    "--upgrade-module-path",
+    "--add-modules",
+    "--add-reads",
+    "--add-exports",
+    "--add-opens",
+    "--limit-modules",
+    "--patch-module",
+}
+# everything after these (or after the main class) is the application's arguments
+LAUNCHER_MAIN_OPTIONS = {"-jar", "-m", "--module"}
+
+UNKNOWN_JAVA_FRAME = "[unknown_Java]"
+# warn if more samples than this have no Java stack
+UNKNOWN_JAVA_RATIO_THRESHOLD = 0.05
+
+# (pid, process creation time) -> JVM flags
+_JVM_FLAGS_CACHE: Dict[Tuple[int, float], Mapping[str, str]] = {}
+# (pid, process creation time, topic) of advice that was logged already - so it's logged once per JVM.
+_LOGGED_ADVICE: Set[Tuple[int, float, str]] = set()
+
+
+def parse_jvm_flags(text: str) -> Dict[str, str]:
+    """
+    Parses the -XX flags in a text (a command line, or the output of VM.flags). Boolean flags are "true" / "false".
+    Later flags override earlier ones, as they do in the JVM.
+    """
+    flags = {}
+    for m in JVM_FLAG_REGEX.finditer(text):
+        sign, bool_name, name, value = m.groups()
+        if bool_name is not None:
+            flags[bool_name] = "true" if sign == "+" else "false"
+        else:
+            flags[name] = value
+    return flags
+
+
+def get_jvm_arguments(cmdline: List[str]) -> List[str]:
+    """
+    :returns: The arguments of the JVM in a java command line, without the application's arguments.
+    """
+    arguments = []
+    args = iter(cmdline[1:])
+    for arg in args:
+        if arg in LAUNCHER_MAIN_OPTIONS or not arg.startswith("-"):
+            break
+        arguments.append(arg)
+        if arg in LAUNCHER_OPTIONS_WITH_VALUES:
+            next(args, None)
+    return arguments
+
+
+def get_command_line_jvm_flags(process: Process) -> Dict[str, str]:
+    """
+    Gets the -XX flags of a JVM from its command line and the launcher's environment variables, without attaching
+    to it.
+    """
+    env = get_process_environment(process.pid)
+    options = [env.get(name, "") for name in PREPENDED_OPTIONS_ENV_VARS]
+    options += get_jvm_arguments(process.cmdline())
+    options.append(env.get(APPENDED_OPTIONS_ENV_VAR, ""))
+    return parse_jvm_flags(" ".join(options))
+
+
+def get_jvm_flags(process: Process, attach: bool) -> Mapping[str, str]:
+    """
+    :param attach: Whether to attach to the JVM (with jattach VM.flags) for its actual flags, which include those set
+                   by JVM ergonomics & in options files.
+    """
+    key = (process.pid, process.create_time())
+    if key in _JVM_FLAGS_CACHE:
+        return _JVM_FLAGS_CACHE[key]
+    flags = get_command_line_jvm_flags(process)
+    if attach:
+        try:
+            vm_flags = run_process(
+                [resource_path("java/jattach"), str(process.pid), "jcmd", "VM.flags"], privileges=ATTACH
+            ).stdout.decode()
+        except Exception as e:
+            logger.debug(f"Failed to get the VM.flags of Java process {process.pid}: {e}")
+        else:
+            flags.update(parse_jvm_flags(vm_flags))
+            # only the actual flags are cached: the command line flags of a JVM that was skipped are partial, and it
+            # may be attached to in a later snapshot.
+            _JVM_FLAGS_CACHE[key] = flags
+    return flags
+
+
+def evict_advisor_caches(live_pids: Set[int]) -> None:
+    """
+    Forgets processes that are gone.
+    """
+    for key in [key for key in _JVM_FLAGS_CACHE if key[0] not in live_pids]:
+        del _JVM_FLAGS_CACHE[key]
+    for advice_key in [advice_key for advice_key in _LOGGED_ADVICE if advice_key[0] not in live_pids]:
+        _LOGGED_ADVICE.remove(advice_key)
+
+
+def is_attach_disabled(flags: Mapping[str, str]) -> bool:
+    return flags.get("DisableAttachMechanism") == "true"
+
+
+def advise_jvm_flags(flags: Mapping[str, str], profiled_by_async_profiler: bool) -> Dict[str, str]:
+    """
+    :returns: Advice on the flags of a JVM, by topic (the flag).
+    """
+    advice = {}
+    if is_attach_disabled(flags):
+        advice["DisableAttachMechanism"] = (
+            "-XX:+DisableAttachMechanism prevents async-profiler from attaching, so the JVM is profiled by perf only"
+        )
+    if profiled_by_async_profiler:
+        if flags.get("DebugNonSafepoints") != "true":
+            advice["DebugNonSafepoints"] = (
+                "without -XX:+DebugNonSafepoints, samples of inlined methods may be attributed to the wrong methods"
+                " and lines - add -XX:+UnlockDiagnosticVMOptions -XX:+DebugNonSafepoints"
+            )
+    elif flags.get("PreserveFramePointer") != "true":
+        advice["PreserveFramePointer"] = (
+            "the JVM is profiled by perf only, which can't walk the stacks of JIT-compiled code without frame"
+            " pointers - add -XX:+PreserveFramePointer"
+        )
+    if flags.get("UsePerfData") == "false":
+        advice["UsePerfData"] = (
+            "-XX:-UsePerfData disables the JVM's performance counters (hsperfdata), so JVM tools that discover JVMs"
+            " by them (jps, jstat) can't see it"
+        )
+    return advice
+
+
+def get_unknown_java_ratio(stacks: Mapping[str, int]) -> float:
+    total = sum(stacks.values())
+    if total == 0:
+        return 0.0
+    return sum(count for stack, count in stacks.items() if UNKNOWN_JAVA_FRAME in stack) / total
+
+
+def advise_unknown_java(stacks: Mapping[str, int]) -> Dict[str, str]:
+    ratio = get_unknown_java_ratio(stacks)
+    if ratio <= UNKNOWN_JAVA_RATIO_THRESHOLD:
+        return {}
+    return {
+        "unknown_Java": f"{ratio:.0%} of the samples have no Java stack ({UNKNOWN_JAVA_FRAME}): async-profiler couldn't"
+        " walk the stack where the JVM was sampled - usually in JVM stubs, in transitions between interpreted and"
+        " compiled code, or during deoptimization. Bugs of AsyncGetCallTrace in older JDK updates cause this as"
+        " well; if the ratio is high, updating the JDK may help"
+    }
+
+
+def log_advice(process: Process, advice: Mapping[str, str]) -> None:
+    """
+    Logs the advice on a JVM - each topic once per JVM.
+    """
+    create_time = process.create_time()
+    for topic, text in advice.items():
+        if (process.pid, create_time, topic) not in _LOGGED_ADVICE:
+            _LOGGED_ADVICE.add((process.pid, create_time, topic))
+            logger.warning(f"Java process {process.pid}: {text}")
@@ -0,0 +1,109 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+"""
+Breakdown of the samples of JVMs into application code and the internal activity of the JVM - GC, JIT compilation,
+VM operations & safepoints and other internal threads - by thread names (async-profiler's "threads" option places
+them as the root frame of each stack) and frame patterns.
+"""
+import re
+from collections import Counter
+from typing import Dict, Mapping, MutableMapping, Optional, Tuple
+
+APPLICATION = "application"
+GC = "gc"
+JIT = "jit"
+VM = "vm"
+OTHER = "other"
+CATEGORIES = [APPLICATION, GC, JIT, VM, OTHER]
+
+# the root frame added by async-profiler's "threads" option
+THREAD_FRAME_REGEX = re.compile(r"^\[(?P<name>.*) tid=\d+\]$")
+# Java frames, as annotated by async-profiler: JIT-compiled, inlined, interpreted & C1-compiled
+JAVA_FRAME_REGEX = re.compile(r"_\[[ji01]\]$")
+
+# names of HotSpot's internal threads
+GC_THREAD_REGEX = re.compile(
+    r"^(?:GC Thread|G1 |Gang worker|ParGC Thread|Concurrent Mark-Sweep|CMS |Shenandoah"
+    r"|Z(?:Worker|Driver|Director|Stat|Uncommitter|RuntimeWorker|Unmapper))"
+)
+JIT_THREAD_REGEX = re.compile(r"CompilerThread|^Sweeper thread")
+VM_THREAD_REGEX = re.compile(r"^(?:VM Thread|VM Periodic Task Thread)")
+OTHER_THREAD_REGEX = re.compile(
+    r"^(?:Signal Dispatcher|Service Thread|Attach Listener|Reference Handler|Finalizer|Common-Cleaner"
+    r"|Notification Thread|Monitor Deflation Thread|JFR )"
+)
+
+# native frames of HotSpot's internal activity, for stacks without thread names
+GC_FRAME_REGEX = re.compile(
+    r"^(?:G1\w*|PS\w*|ParallelScavengeHeap|GenCollectedHeap|DefNewGeneration|TenuredGeneration|CMS\w*"
+    r"|Shenandoah\w*|Z[A-Z]\w*|GangWorker|GCTaskThread|ConcurrentGCThread|WorkGang|WorkerThread)::"
+)
+JIT_FRAME_REGEX = re.compile(
+    r"^(?:CompileBroker|C2Compiler|Compiler|Compilation|Compile|Phase\w*|JVMCI\w*|NMethodSweeper)::"
+)
+VM_FRAME_REGEX = re.compile(r"^(?:VMThread|VM_\w+|WatcherThread)::")
+# application threads that are stopped for a safepoint
+SAFEPOINT_FRAME_REGEX = re.compile(r"^(?:SafepointSynchronize|SafepointMechanism|ThreadSafepointState)::")
+
+
+def classify_thread_name(name: str) -> Optional[str]:
+    """
+    :returns: The category of the JVM internal thread, or None if it's not one (presumably an application thread).
+    """
+    for category, regex in ((GC, GC_THREAD_REGEX), (JIT, JIT_THREAD_REGEX), (VM, VM_THREAD_REGEX)):
+        if regex.search(name) is not None:
+            return category
+    if OTHER_THREAD_REGEX.search(name) is not None:
+        return OTHER
+    return None
+
+
+def classify_stack(frames: Tuple[str, ...], thread_name: Optional[str]) -> str:
+    category = classify_thread_name(thread_name) if thread_name is not None else None
+    if category is not None:
+        return category
+
+    if thread_name is None and not any(JAVA_FRAME_REGEX.search(frame) for frame in frames):
+        # a native-only stack of an unknown thread - the JVM's internal threads run no Java code
+        for category, regex in ((GC, GC_FRAME_REGEX), (JIT, JIT_FRAME_REGEX), (VM, VM_FRAME_REGEX)):
+            if any(regex.match(frame) for frame in frames):
+                return category
+        return OTHER
+
+    if any(SAFEPOINT_FRAME_REGEX.match(frame) for frame in frames):
+        return VM
+    return APPLICATION
+
+
+def breakdown_java_stacks(
+    stacks: Mapping[str, int], grouping_frames: bool = False
+) -> Tuple[Mapping[str, int], Dict[str, int]]:
+    """
+    Classifies the stacks of a JVM, removing the thread frames added by async-profiler's "threads" option.
+    :param grouping_frames: Whether to prepend the category of each stack to it as a frame, e.g "[jvm: gc]".
+    :returns: The stacks, and the number of samples in each category.
+    """
+    new_stacks: MutableMapping[str, int] = Counter()
+    breakdown: Dict[str, int] = dict.fromkeys(CATEGORIES, 0)
+    for stack, count in stacks.items():
+        frames = tuple(stack.split(";"))
+        thread_name = None
+        m = THREAD_FRAME_REGEX.match(frames[0])
+        if m is not None:
+            thread_name = m.group("name")
+            frames = frames[1:]
+        category = classify_stack(frames, thread_name)
+        breakdown[category] += count
+        if grouping_frames:
+            frames = (f"[jvm: {category}]",) + frames
+        new_stacks[";".join(frames)] += count
+    return dict(new_stacks), breakdown
+
+
+def format_breakdown(breakdown: Mapping[str, int]) -> str:
+    total = sum(breakdown.values())
+    if total == 0:
+        return "no samples"
+    return ", ".join(f"{category} {count / total:.0%}" for category, count in breakdown.items() if count > 0)
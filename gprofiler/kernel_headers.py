@@ -0,0 +1,82 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import logging
+import os
+import platform
+import re
+from pathlib import Path
+from typing import Optional
+
+from .utils import run_process
+
+logger = logging.getLogger(__name__)
+
+# exposed by the kheaders module (CONFIG_IKHEADERS, Linux 5.2+). BCC extracts the headers from it when the
+# installed headers are missing.
+KHEADERS_PATH = "/sys/kernel/kheaders.tar.xz"
+# the kernel's BTF. PyPerf is built on BCC, which compiles its programs against the headers - it can't use BTF (CO-RE)
+# in their place. That requires a CO-RE (libbpf) build of PyPerf, which is a follow-up.
+BTF_VMLINUX_PATH = "/sys/kernel/btf/vmlinux"
+
+# the root of the host's filesystem - where the kheaders module resides (as our container doesn't necessarily have
+# the host's /lib/modules mounted)
+HOST_ROOT = "/proc/1/root"
+
+# sources of kernel headers, as reported
+INSTALLED_HEADERS = "installed kernel headers"
+KHEADERS = "kheaders"
+
+
+def _installed_headers_path() -> str:
+    return f"/lib/modules/{platform.release()}/build"
+
+
+def is_kheaders_module_available() -> bool:
+    """
+    Checks whether the kheaders module is in the host's module tree - without loading it.
+    """
+    try:
+        modules_dep = Path(f"{HOST_ROOT}/lib/modules/{platform.release()}/modules.dep").read_text()
+    except OSError:
+        return False
+    return re.search(r"^\S*/kheaders\.ko(?:\.\w+)?:", modules_dep, re.MULTILINE) is not None
+
+
+def _load_kheaders() -> bool:
+    # our own modprobe (kmod), so the host doesn't need one - it looks for the module in the host's module tree.
+    try:
+        run_process(["modprobe", "--dirname", HOST_ROOT, "kheaders"])
+    except Exception as e:
+        logger.debug(f"Failed to load the kheaders module: {e}")
+        return False
+    return os.path.exists(KHEADERS_PATH)
+
+
+def get_kernel_headers_source(load_kheaders: bool = True) -> Optional[str]:
+    """
+    Finds kernel headers for compiling the eBPF programs of PyPerf, loading the kheaders module if needed.
+    :param load_kheaders: If False, the kheaders module isn't loaded - KHEADERS is returned if it would be.
+    :returns: The source of the headers (INSTALLED_HEADERS or KHEADERS), or None if there are no headers.
+    """
+    if os.path.isdir(_installed_headers_path()):
+        return INSTALLED_HEADERS
+    if os.path.exists(KHEADERS_PATH):
+        return KHEADERS
+    if load_kheaders:
+        return KHEADERS if _load_kheaders() else None
+    return KHEADERS if is_kheaders_module_available() else None
+
+
+
+def describe_missing_kernel_headers() -> str:
+    """
+    :returns: Why PyPerf has no kernel headers - for when get_kernel_headers_source() found none.
+    """
+    if os.path.exists(BTF_VMLINUX_PATH):
+        return (
+            f"no kernel headers found, and PyPerf can't use the kernel BTF ({BTF_VMLINUX_PATH}) in their place -"
+            " install the kernel headers, or enable the kheaders module"
+        )
+    return "no kernel headers found - install the kernel headers, or enable the kheaders module"
@@ -0,0 +1,78 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import re
+from typing import Dict, Iterable, List, Mapping, NamedTuple, Pattern, Set, Tuple
+
+import psutil
+
+LABEL_KEY_REGEX = re.compile(r"^[A-Za-z_][\w.-]*$")
+
+# (pid, process creation time) -> command line
+_CMDLINES_CACHE: Dict[Tuple[int, float], str] = {}
+
+
+class ProcessLabelRule(NamedTuple):
+    key: str
+    value: str
+    cmdline_regex: Pattern
+
+
+def parse_label(label: str) -> Tuple[str, str]:
+    """
+    Parses "key=value".
+    """
+    key, sep, value = label.partition("=")
+    if not sep or LABEL_KEY_REGEX.match(key) is None:
+        raise ValueError(f"expected key=value, where the key consists of letters, digits, '_', '.' or '-': {label!r}")
+    return key, value
+
+
+def parse_process_label_rule(rule: str) -> ProcessLabelRule:
+    """
+    Parses "key=value:regex" - the label is given to processes whose command line matches the regex.
+    The value may not contain ":" (the regex may).
+    """
+    label, sep, regex = rule.partition(":")
+    if not sep:
+        raise ValueError(f"expected key=value:regex: {rule!r}")
+    key, value = parse_label(label)
+    try:
+        return ProcessLabelRule(key, value, re.compile(regex))
+    except re.error as e:
+        raise ValueError(f"bad regex {regex!r}: {e}")
+
+
+def _get_cmdline(pid: int) -> str:
+    process = psutil.Process(pid)
+    key = (pid, process.create_time())
+    if key not in _CMDLINES_CACHE:
+        _CMDLINES_CACHE[key] = " ".join(process.cmdline())
+    return _CMDLINES_CACHE[key]
+
+
+def get_processes_labels(pids: Iterable[int], rules: List[ProcessLabelRule]) -> Dict[int, Mapping[str, str]]:
+    """
+    Evaluates the process label rules on the given processes, omitting processes without labels. If several
+    rules give the same key to a process, the last one wins.
+    """
+    labels: Dict[int, Mapping[str, str]] = {}
+    if rules:
+        for pid in set(pids):
+            try:
+                cmdline = _get_cmdline(pid)
+            except psutil.Error:
+                continue  # process has exited
+            process_labels = {rule.key: rule.value for rule in rules if rule.cmdline_regex.search(cmdline)}
+            if process_labels:
+                labels[pid] = process_labels
+    return labels
+
+
+def evict_cmdlines_cache(live_pids: Set[int]) -> None:
+    """
+    Forgets processes that are gone.
+    """
+    for key in [key for key in _CMDLINES_CACHE if key[0] not in live_pids]:
+        del _CMDLINES_CACHE[key]
@@ -4,32 +4,66 @@
 #
 import concurrent.futures
 import datetime
+import json
 import logging
 import logging.config
 import logging.handlers
 import os
+import random
+import re
 import signal
 import sys
 import time
+from collections import Counter, defaultdict
 from logging import Logger
 from pathlib import Path
 from socket import gethostname
 from threading import Event
-from typing import Dict, Optional
+from typing import Any, Dict, Iterable, List, Mapping, Optional, Sequence, Tuple
 
 import configargparse
+from psutil import NoSuchProcess, Process
 from requests import RequestException, Timeout
 
 from . import __version__, merge
 from .client import DEFAULT_UPLOAD_TIMEOUT, GRANULATE_SERVER_HOST, APIClient, APIError
+from .dump import dump_threads, find_container_processes
+from .exceptions import CalledProcessError
+from .folding import FOLD_MODES, FOLD_PRESETS, StackFolder, get_stack_folder
+from .heatmap import render_heatmap
+from .importer import COLLAPSED_FORMAT, IMPORT_FORMATS, format_collapsed, import_profile, merge_profiles
+from .inventory import build_inventory, take_process_census
 from .java import JavaProfiler
+from .java_advisor import evict_advisor_caches
+from .labels import ProcessLabelRule, evict_cmdlines_cache, get_processes_labels, parse_label, parse_process_label_rule
 from .perf import SystemProfiler
+from .plan import format_plan, make_plan
+from .privileges import UNPRIVILEGED, disable_privilege_dropping
 from .python import get_python_profiler
+from .python_allocations import DEFAULT_SAMPLE_PERIOD as DEFAULT_ALLOCATIONS_SAMPLE_PERIOD
+from .python_allocations import PythonAllocationsProfiler
+from .safety import configure_safety_policy
+from .sessions import (
+    DEFAULT_SESSION_NAME,
+    SESSION_NAME_REGEX,
+    RecordedSnapshot,
+    SessionSpec,
+    collect_submitted_sessions,
+    demultiplex_snapshot,
+    submit_session,
+)
+from .source_annotation import render_source_annotations, strip_line_numbers
+from .symbolization import Symbolizer
+from .systemd import SYSTEMD_UNIT_LABEL, get_process_systemd_unit
+from .svg_flamegraph import SVG_COLOR_SCHEMES, SvgOptions, render_svg_flamegraph
+from .task_metadata import evict_task_labels_cache, get_processes_task_labels, task_frame
 from .utils import (
     TEMPORARY_STORAGE_PATH,
     TemporaryDirectoryWithMode,
     atomically_symlink,
     get_iso8061_format_time,
+    get_process_container_id,
+    get_process_name,
     grab_gprofiler_mutex,
     is_root,
     log_system_info,
@@ -37,6 +71,7 @@ from .utils import (
     resource_path,
     run_process,
 )
+from .versions import DEFAULT_VERSION_ENV_VARS, evict_versions_cache, get_processes_versions, label_frame
 
 logger: Logger
 
@@ -46,10 +81,14 @@ DEFAULT_LOG_BACKUP_COUNT = 1
 
 DEFAULT_PROFILING_DURATION = datetime.timedelta(seconds=60).seconds
 DEFAULT_SAMPLING_FREQUENCY = 10
+# profile type of uploaded allocation profiles (CPU profiles are uploaded without a type)
+ALLOCATIONS_PROFILE_TYPE = "python_allocations"
 # by default - these match
 DEFAULT_CONTINUOUS_MODE_INTERVAL = DEFAULT_PROFILING_DURATION
 # 1 KeyboardInterrupt raised per this many seconds, no matter how many SIGINTs we get.
 SIGINT_RATELIMIT = 0.5
+# formats of local flamegraphs: the interactive HTML, a static SVG (flamegraph.pl style) or both
+FLAMEGRAPH_FORMATS = ["html", "svg", "both"]
 
 
 last_signal_ts: Optional[float] = None
@@ -67,16 +106,75 @@ def sigint_handler(sig, frame):
 
 class GProfiler:
     def __init__(
-        self, frequency: int, duration: int, output_dir: str, flamegraph: bool, rotating_output: bool, client: APIClient
+        self,
+        frequency: int,
+        duration: int,
+        output_dir: str,
+        flamegraph: bool,
+        rotating_output: bool,
+        client: APIClient,
+        heatmap: bool = False,
+        annotate_frames: bool = False,
+        folder: Optional[StackFolder] = None,
+        source_annotations: bool = False,
+        java_source_paths: Iterable[str] = (),
+        deferred_symbolization: bool = False,
+        upload_jitter: int = 0,
+        process_versions: bool = False,
+        version_env_vars: Iterable[str] = DEFAULT_VERSION_ENV_VARS,
+        version_root_frames: bool = False,
+        labels: Optional[Mapping[str, str]] = None,
+        process_label_rules: Iterable[ProcessLabelRule] = (),
+        systemd_units: bool = False,
+        systemd_unit_root_frames: bool = False,
+        task_metadata: bool = False,
+        task_root_frames: bool = False,
+        python_allocations: bool = False,
+        python_allocations_period: int = DEFAULT_ALLOCATIONS_SAMPLE_PERIOD,
+        java_breakdown: bool = False,
+        java_breakdown_frames: bool = False,
+        flamegraph_format: str = "html",
+        svg_options: SvgOptions = SvgOptions(),
     ):
         self._frequency = frequency
         self._duration = duration
         self._output_dir = output_dir
         self._flamegraph = flamegraph
+        self._heatmap = heatmap
+        self._flamegraph_format = flamegraph_format
+        self._svg_options = svg_options
+        self._annotate_frames = annotate_frames
+        self._folder = folder
+        self._source_annotations = source_annotations
+        self._java_source_paths = list(java_source_paths)
+        self._deferred_symbolization = deferred_symbolization
+        self._upload_jitter = upload_jitter
+        self._process_versions = process_versions
+        self._version_env_vars = list(version_env_vars)
+        self._version_root_frames = version_root_frames
+        self._labels = dict(labels or {})
+        self._process_label_rules = list(process_label_rules)
+        self._systemd_units = systemd_units
+        self._systemd_unit_root_frames = systemd_unit_root_frames
+        self._task_metadata = task_metadata
+        self._task_root_frames = task_root_frames
         self._rotating_output = rotating_output
         self._client = client
+        self._sessions: Dict[str, SessionSpec] = {
+            DEFAULT_SESSION_NAME: SessionSpec(
+                DEFAULT_SESSION_NAME,
+                frequency,
+                output_dir=output_dir,
+                flamegraph=flamegraph,
+                heatmap=heatmap,
+                upload=client is not None,
+            )
+        }
         self._stop_event = Event()
         self._executor = concurrent.futures.ThreadPoolExecutor(max_workers=10)
+        # delayed uploads run in the background, one at a time - so profiling sessions are not delayed, and
+        # uploads don't pile up.
+        self._upload_executor = concurrent.futures.ThreadPoolExecutor(max_workers=1)
         # TODO: we actually need 2 types of temporary directories.
         # 1. accessible by everyone - for profilers that run code in target processes, like async-profiler
         # 2. accessible only by us.
@@ -84,12 +182,35 @@ class GProfiler:
         # files unnecessarily.
         self._temp_storage_dir = TemporaryDirectoryWithMode(dir=TEMPORARY_STORAGE_PATH, mode=0o755)
         self.java_profiler = JavaProfiler(
-            self._frequency, self._duration, True, self._stop_event, self._temp_storage_dir.name
+            self._frequency,
+            self._duration,
+            True,
+            self._stop_event,
+            self._temp_storage_dir.name,
+            annotate_frames=self._annotate_frames,
+            line_numbers=self._source_annotations,
+            breakdown=java_breakdown,
+            breakdown_frames=java_breakdown_frames,
         )
         self.system_profiler = SystemProfiler(
-            self._frequency, self._duration, self._stop_event, self._temp_storage_dir.name
+            self._frequency,
+            self._duration,
+            self._stop_event,
+            self._temp_storage_dir.name,
+            deferred_symbolization=self._deferred_symbolization,
         )
         self.initialize_python_profiler()
+        self.python_allocations_profiler = (
+            PythonAllocationsProfiler(
+                self._duration,
+                self._stop_event,
+                self._temp_storage_dir.name,
+                python_allocations_period,
+                annotate_frames=self._annotate_frames,
+            )
+            if python_allocations
+            else None
+        )
 
     def __enter__(self):
         self.start()
@@ -105,10 +226,12 @@ class GProfiler:
             self._stop_event,
             self._temp_storage_dir.name,
             self.initialize_python_profiler,
+            annotate_frames=self._annotate_frames,
+            line_numbers=self._source_annotations,
         )
 
-    def _update_last_output(self, last_output_name: str, output_path: str) -> None:
-        last_output = os.path.join(self._output_dir, last_output_name)
+    def _update_last_output(self, output_dir: str, last_output_name: str, output_path: str) -> None:
+        last_output = os.path.join(output_dir, last_output_name)
         prev_output = Path(last_output).resolve()
         atomically_symlink(os.path.basename(output_path), last_output)
         # delete if rotating & there was a link target before.
@@ -121,42 +244,101 @@ class GProfiler:
 
     def _generate_output_files(
         self,
+        spec: SessionSpec,
         collapsed_data: str,
+        perf_samples: Optional[Iterable[Mapping[str, str]]],
         local_start_time: datetime.datetime,
         local_end_time: datetime.datetime,
+        source_annotations: str = "",
+        metadata: Optional[Dict] = None,
+        inventory: Optional[Sequence[Mapping[str, Any]]] = None,
     ) -> None:
         start_ts = get_iso8061_format_time(local_start_time)
         end_ts = get_iso8061_format_time(local_end_time)
-        base_filename = os.path.join(self._output_dir, "profile_{}".format(end_ts))
+        assert spec.output_dir is not None
+        base_filename = os.path.join(spec.output_dir, "{}_{}".format(spec.output_name("profile"), end_ts))
 
         collapsed_path = base_filename + ".col"
-        Path(collapsed_path).write_text(collapsed_data)
+        if metadata:
+            Path(collapsed_path).write_text(merge.format_metadata_line(metadata) + "\n" + collapsed_data)
+        else:
+            Path(collapsed_path).write_text(collapsed_data)
 
         # point last_profile.col at the new file; and possibly, delete the previous one.
-        self._update_last_output("last_profile.col", collapsed_path)
+        self._update_last_output(spec.output_dir, spec.output_name("last_profile") + ".col", collapsed_path)
         logger.info(f"Saved collapsed stacks to {collapsed_path}")
 
-        if self._flamegraph:
+        if inventory is not None:
+            inventory_path = base_filename + ".inventory.json"
+            Path(inventory_path).write_text(json.dumps(inventory, indent=2))
+            self._update_last_output(spec.output_dir, spec.output_name("last_inventory") + ".json", inventory_path)
+            logger.info(f"Saved process inventory to {inventory_path}")
+
+        if spec.flamegraph and self._flamegraph_format != "svg":
             flamegraph_path = base_filename + ".html"
+            # burn doesn't know about the metadata line, so it gets the stacks only.
+            burn_input_path = os.path.join(self._temp_storage_dir.name, "burn_input.col")
+            Path(burn_input_path).write_text(collapsed_data)
             flamegraph_data = (
                 Path(resource_path("flamegraph/flamegraph_template.html"))
                 .read_text()
                 .replace(
                     "{{{JSON_DATA}}}",
                     run_process(
-                        [resource_path("burn"), "convert", "--type=folded", collapsed_path], suppress_log=True
+                        [resource_path("burn"), "convert", "--type=folded", burn_input_path],
+                        suppress_log=True,
+                        privileges=UNPRIVILEGED,
                     ).stdout.decode(),
                 )
                 .replace("{{{START_TIME}}}", start_ts)
                 .replace("{{{END_TIME}}}", end_ts)
+                .replace("{{{SOURCE_ANNOTATIONS}}}", source_annotations)
             )
             Path(flamegraph_path).write_text(flamegraph_data)
 
             # point last_flamegraph.html at the new file; and possibly, delete the previous one.
-            self._update_last_output("last_flamegraph.html", flamegraph_path)
+            self._update_last_output(spec.output_dir, spec.output_name("last_flamegraph") + ".html", flamegraph_path)
 
             logger.info(f"Saved flamegraph to {flamegraph_path}")
 
+        if spec.flamegraph and self._flamegraph_format != "html":
+            svg_path = base_filename + ".svg"
+            Path(svg_path).write_text(
+                render_svg_flamegraph(collapsed_data, self._svg_options, f"{start_ts} - {end_ts}")
+            )
+
+            # point last_flamegraph.svg at the new file; and possibly, delete the previous one.
+            self._update_last_output(spec.output_dir, spec.output_name("last_flamegraph") + ".svg", svg_path)
+
+            logger.info(f"Saved SVG flamegraph to {svg_path}")
+
+        if spec.heatmap and perf_samples is None:
+            logger.warning("Not generating a heatmap, it requires perf samples")
+        elif spec.heatmap:
+            heatmap_path = base_filename + ".heatmap.html"
+            Path(heatmap_path).write_text(
+                render_heatmap(perf_samples, start_ts, end_ts, self._annotate_frames, self._folder)
+            )
+
+            # point last_heatmap.html at the new file; and possibly, delete the previous one.
+            self._update_last_output(spec.output_dir, spec.output_name("last_heatmap") + ".html", heatmap_path)
+
+            logger.info(f"Saved heatmap to {heatmap_path}")
+
+    def _generate_allocations_output_file(
+        self, allocations_data: str, local_end_time: datetime.datetime, metadata: Optional[Dict] = None
+    ) -> None:
+        end_ts = get_iso8061_format_time(local_end_time)
+        allocations_path = os.path.join(self._output_dir, "profile_{}.alloc.col".format(end_ts))
+        if metadata:
+            Path(allocations_path).write_text(merge.format_metadata_line(metadata) + "\n" + allocations_data)
+        else:
+            Path(allocations_path).write_text(allocations_data)
+
+        # point last_alloc_profile.col at the new file; and possibly, delete the previous one.
+        self._update_last_output(self._output_dir, "last_alloc_profile.col", allocations_path)
+        logger.info(f"Saved Python allocations profile to {allocations_path}")
+
     def start(self):
         self._stop_event.clear()
 
@@ -166,6 +348,8 @@ class GProfiler:
             self.system_profiler,
         ):
             prof.start()
+        if self.python_allocations_profiler is not None:
+            self.python_allocations_profiler.start()
 
     def stop(self):
         logger.info("Stopping gprofiler...")
@@ -177,49 +361,335 @@ class GProfiler:
             self.system_profiler,
         ):
             prof.stop()
+        if self.python_allocations_profiler is not None:
+            self.python_allocations_profiler.stop()
+
+    def add_session(self, spec: SessionSpec) -> None:
+        """
+        Adds a session, starting at the next profiling interval. A session with the same name is replaced.
+        """
+        if spec.upload and self._client is None:
+            logger.warning(f"Session {spec.name} won't be uploaded - gProfiler isn't uploading (--upload-results)")
+        scope = ", ".join([*(f"pid {pid}" for pid in spec.pids), *(f"container {c}" for c in spec.containers)])
+        length = "until stopped" if spec.snapshots is None else f"for {spec.snapshots} profiling interval(s)"
+        logger.info(f"Starting session {spec.name} ({spec.frequency}hz, {scope or 'all processes'}, {length})")
+        self._sessions[spec.name] = spec
+
+    def _update_sessions(self) -> None:
+        for spec in collect_submitted_sessions():
+            if spec.name == DEFAULT_SESSION_NAME:
+                logger.warning(f"Ignoring submitted session, the name {spec.name!r} is reserved")
+                continue
+            self.add_session(spec)
+
+    def _count_sessions_snapshot(self) -> None:
+        for spec in list(self._sessions.values()):
+            if spec.snapshots is None:
+                continue
+            if spec.snapshots > 1:
+                self._sessions[spec.name] = spec._replace(snapshots=spec.snapshots - 1)
+            else:
+                logger.info(f"Session {spec.name} is done")
+                del self._sessions[spec.name]
 
     def _snapshot(self):
+        self._update_sessions()
+        # the recorders are shared by all sessions, so they record at the highest frequency of them.
+        frequency = max(spec.frequency for spec in self._sessions.values())
+        for prof in (self.java_profiler, self.python_profiler, self.system_profiler):
+            prof.set_frequency(frequency)
+
+        start_census = take_process_census()
         local_start_time = datetime.datetime.utcnow()
         monotonic_start_time = time.monotonic()
 
         java_future = self._executor.submit(self.java_profiler.snapshot)
         java_future.name = "java"
+        java_future.frequency = frequency
+        java_future.profiler = self.java_profiler
         python_future = self._executor.submit(self.python_profiler.snapshot)
         python_future.name = "python"
+        python_future.frequency = self.python_profiler.frequency
+        python_future.profiler = self.python_profiler
         system_future = self._executor.submit(self.system_profiler.snapshot)
         system_future.name = "system"
-
-        process_perfs: Dict[int, Dict[str, int]] = {}
+        allocations_future = None
+        if self.python_allocations_profiler is not None:
+            allocations_future = self._executor.submit(self.python_allocations_profiler.snapshot)
+
+        process_perfs: Dict[int, Mapping[str, int]] = {}
+        # sampling frequencies of the runtime profilers, by pid - for scaling their counts when perf is unavailable.
+        process_frequencies: Dict[int, int] = {}
+        # for the inventory - the runtime profiler of each process, and the reasons runtime profilers skipped others.
+        coverage: Dict[int, str] = {}
+        skipped: Dict[int, Dict[str, str]] = defaultdict(dict)
         for future in concurrent.futures.as_completed([java_future, python_future]):
+            for pid, reason in future.profiler.skipped_processes.items():
+                skipped[pid][future.profiler.NAME] = reason
             # if either of these fail - log it, and continue.
             try:
-                process_perfs.update(future.result())
+                results = future.result()
             except Exception:
                 logger.exception(f"{future.name} profiling failed")
+                continue
+            process_perfs.update(results)
+            process_frequencies.update(dict.fromkeys(results, future.frequency))
+            coverage.update(dict.fromkeys(results, future.profiler.NAME))
 
         local_end_time = local_start_time + datetime.timedelta(seconds=(time.monotonic() - monotonic_start_time))
-        merged_result = merge.merge_perfs(system_future.result(), process_perfs)
+        end_census = take_process_census()
+
+        source_annotations = ""
+        if self._source_annotations:
+            # (rendered into the flamegraph of the default session)
+            if self._output_dir and self._flamegraph:
+                # render now, while the profiled processes (and their mount namespaces) are most likely still alive.
+                source_annotations = render_source_annotations(process_perfs, self._java_source_paths)
+            # line numbers are only used for the annotations; the profile itself remains aggregated by function.
+            process_perfs = {pid: strip_line_numbers(stacks) for pid, stacks in process_perfs.items()}
+
+        # keep the parsed samples around - the heatmap needs them after merging.
+        perf_samples: Optional[List[Mapping[str, str]]]
+        try:
+            perf_samples = list(system_future.result())
+        except Exception:
+            if self._stop_event.is_set():
+                raise
+            # perf may be blocked (perf_event_paranoid, seccomp, gVisor...) - the runtime profiles are still good.
+            # perf is attempted again in the next profiling interval.
+            logger.exception("System profiling failed, using the runtime profilers only (no native & kernel stacks)")
+            perf_samples = None
+
+        allocations: Mapping[int, Mapping[str, int]] = {}
+        if allocations_future is not None:
+            try:
+                allocations = allocations_future.result()
+            except Exception:
+                logger.exception("Python allocations profiling failed")
 
-        if self._output_dir:
-            self._generate_output_files(merged_result, local_start_time, local_end_time)
+        container_ids: Dict[int, Optional[str]] = {}
+
+        def _get_container_id(pid: int) -> Optional[str]:
+            if pid not in container_ids:
+                try:
+                    container_ids[pid] = get_process_container_id(pid)
+                except FileNotFoundError:
+                    container_ids[pid] = None  # process has exited
+            return container_ids[pid]
+
+        inventory = build_inventory(
+            start_census, end_census, coverage, skipped, perf_samples is not None, _get_container_id
+        )
+        snapshot = RecordedSnapshot(
+            frequency,
+            perf_samples,
+            process_perfs,
+            process_frequencies,
+            allocations,
+            inventory,
+            self.java_profiler.advice,
+            self.java_profiler.breakdowns,
+        )
 
-        if self._client:
+        for spec in list(self._sessions.values()):
             try:
-                self._client.submit_profile(local_start_time, local_end_time, gethostname(), merged_result)
-            except Timeout:
-                logger.error("Upload of profile to server timed out.")
-            except APIError as e:
-                logger.error(f"Error occurred sending profile to server: {e}")
-            except RequestException:
-                logger.exception("Error occurred sending profile to server")
+                self._output_session(
+                    spec,
+                    demultiplex_snapshot(snapshot, spec, _get_container_id),
+                    local_start_time,
+                    local_end_time,
+                    source_annotations if spec.name == DEFAULT_SESSION_NAME else "",
+                )
+            except Exception:
+                logger.exception(f"Failed to output session {spec.name}")
+        self._count_sessions_snapshot()
+
+        # forget processes that are gone - once per snapshot, not per session: sessions see different processes.
+        live_pids = {pid for pid, _ in end_census}
+        evict_task_labels_cache(live_pids)
+        evict_versions_cache(live_pids)
+        evict_cmdlines_cache(live_pids)
+        evict_advisor_caches(live_pids)
+
+    def _output_session(
+        self,
+        spec: SessionSpec,
+        snapshot: RecordedSnapshot,
+        local_start_time: datetime.datetime,
+        local_end_time: datetime.datetime,
+        source_annotations: str,
+    ) -> None:
+        pid_samples = Counter(int(sample["pid"]) for sample in snapshot.perf_samples or [])
+        metadata, root_frames = self._get_metadata(
+            set(pid_samples) | set(snapshot.process_perfs) | set(snapshot.allocations), pid_samples
+        )
+        if spec.name != DEFAULT_SESSION_NAME:
+            metadata["session"] = spec.name
+        if snapshot.java_advice:
+            metadata["java_advice"] = {str(pid): advice for pid, advice in snapshot.java_advice.items()}
+        if snapshot.java_breakdowns:
+            metadata["java_breakdown"] = {str(pid): counts for pid, counts in snapshot.java_breakdowns.items()}
+        if snapshot.perf_samples is not None:
+            merged_result = merge.merge_perfs(
+                snapshot.perf_samples, snapshot.process_perfs, self._annotate_frames, self._folder, root_frames
+            )
+        else:
+            metadata["runtime_only"] = True
+            merged_result = merge.merge_runtime_perfs(
+                snapshot.process_perfs,
+                snapshot.process_frequencies,
+                snapshot.frequency,
+                {pid: get_process_name(pid) for pid in snapshot.process_perfs},
+                self._folder,
+                root_frames,
+            )
+        # allocations are profiled for the default session only.
+        with_allocations = self.python_allocations_profiler is not None and spec.name == DEFAULT_SESSION_NAME
+        # stacks of the allocations profile already start with the process name
+        allocations_result = "\n".join(
+            f"{';'.join([*root_frames.get(pid, []), stack])} {count}"
+            for pid, stacks in snapshot.allocations.items()
+            for stack, count in stacks.items()
+        )
+
+        if spec.output_dir:
+            self._generate_output_files(
+                spec,
+                merged_result,
+                snapshot.perf_samples,
+                local_start_time,
+                local_end_time,
+                source_annotations,
+                metadata,
+                snapshot.inventory,
+            )
+            if with_allocations:
+                self._generate_allocations_output_file(allocations_result, local_end_time, metadata)
+
+        if self._client and spec.upload:
+            if self._upload_jitter > 0:
+                # spread the uploads of many gProfilers started at the same time
+                delay = random.uniform(0, self._upload_jitter)
+                logger.debug(f"Uploading profile in {delay:.1f} seconds")
+                self._upload_executor.submit(
+                    self._upload,
+                    local_start_time,
+                    local_end_time,
+                    merged_result,
+                    metadata,
+                    delay,
+                    inventory=snapshot.inventory,
+                )
+                if with_allocations:
+                    # the upload executor has a single thread - this runs after the delayed upload above, right away.
+                    self._upload_executor.submit(
+                        self._upload,
+                        local_start_time,
+                        local_end_time,
+                        allocations_result,
+                        metadata,
+                        0,
+                        ALLOCATIONS_PROFILE_TYPE,
+                    )
             else:
-                logger.info("Successfully uploaded profiling data to the server")
+                self._upload(local_start_time, local_end_time, merged_result, metadata, inventory=snapshot.inventory)
+                if with_allocations:
+                    self._upload(
+                        local_start_time,
+                        local_end_time,
+                        allocations_result,
+                        metadata,
+                        profile_type=ALLOCATIONS_PROFILE_TYPE,
+                    )
+
+    def _get_metadata(
+        self, pids: Iterable[int], pid_samples: Mapping[int, int]
+    ) -> Tuple[Dict, Mapping[int, List[str]]]:
+        """
+        :param pid_samples: Number of samples collected by perf, by pid.
+        :returns: The metadata of the profile, and root frames for the stacks of processes.
+        """
+        pids = list(pids)
+        metadata: Dict = {}
+        root_frames: Dict[int, List[str]] = defaultdict(list)
+        if self._labels:
+            metadata["labels"] = self._labels
+
+        process_labels: Dict[int, Dict[str, str]] = defaultdict(dict)
+        if self._systemd_units:
+            unit_samples: Dict[str, int] = Counter()
+            for pid in pids:
+                unit = get_process_systemd_unit(pid)
+                if unit is None:
+                    continue
+                process_labels[pid][SYSTEMD_UNIT_LABEL] = unit
+                unit_samples[unit] += pid_samples.get(pid, 0)
+                if self._systemd_unit_root_frames:
+                    root_frames[pid].append(f"[{unit}]")
+            # per-unit breakdown of the CPU samples
+            metadata["systemd_unit_samples"] = dict(unit_samples)
+        if self._task_metadata:
+            for pid, labels in get_processes_task_labels(pids).items():
+                process_labels[pid].update(labels)
+                frame = task_frame(labels)
+                if self._task_root_frames and frame is not None:
+                    root_frames[pid].append(frame)
+        if self._process_versions:
+            versions = get_processes_versions(pids, self._version_env_vars)
+            for pid, labels in versions.items():
+                process_labels[pid].update(labels)
+                if self._version_root_frames:
+                    root_frames[pid].append(label_frame(labels))
+        for pid, labels in get_processes_labels(pids, self._process_label_rules).items():
+            process_labels[pid].update(labels)
+        if process_labels:
+            metadata["process_labels"] = {str(pid): labels for pid, labels in process_labels.items()}
+
+        return metadata, root_frames
+
+    def _upload(
+        self,
+        local_start_time: datetime.datetime,
+        local_end_time: datetime.datetime,
+        profile: str,
+        metadata: Dict,
+        delay: float = 0,
+        profile_type: Optional[str] = None,
+        inventory: Optional[Sequence[Mapping[str, Any]]] = None,
+    ) -> None:
+        # upload right away if we're stopping
+        self._stop_event.wait(delay)
+        try:
+            self._client.submit_profile(
+                local_start_time,
+                local_end_time,
+                gethostname(),
+                profile,
+                metadata,
+                profile_type=profile_type,
+                inventory=inventory,
+                stop_event=self._stop_event,
+            )
+        except Timeout:
+            logger.error("Upload of profile to server timed out.")
+        except APIError as e:
+            logger.error(f"Error occurred sending profile to server: {e}")
+        except RequestException:
+            logger.exception("Error occurred sending profile to server")
+        else:
+            logger.info("Successfully uploaded profiling data to the server")
 
     def run_single(self):
         with self:
             self._snapshot()
 
-    def run_continuous(self, interval):
+    def run_continuous(self, interval: int, start_jitter: int = 0):
+        if start_jitter > 0:
+            # randomize the start offset, so gProfilers started at the same time don't profile & upload in lockstep
+            delay = random.uniform(0, start_jitter)
+            logger.info(f"Starting to profile in {delay:.1f} seconds")
+            self._stop_event.wait(delay)
+
         with self:
             while not self._stop_event.is_set():
                 start_time = time.monotonic()
@@ -231,7 +701,9 @@ class GProfiler:
                 self._stop_event.wait(max(interval - time_spent, 0))
 
 
-def setup_logger(stream_level: int, log_file_path: str, rotate_max_bytes: int, rotate_backup_count: int):
+def setup_logger(
+    stream_level: int, log_file_path: Optional[str], rotate_max_bytes: int = 0, rotate_backup_count: int = 0
+):
     global logger
     logger = logging.getLogger("gprofiler")
     logger.setLevel(logging.DEBUG)
@@ -244,6 +716,9 @@ def setup_logger(stream_level: int, log_file_path: str, rotate_max_bytes: int, r
         stream_handler.setFormatter(logging.Formatter("[%(asctime)s] %(message)s", "%H:%M:%S"))
     logger.addHandler(stream_handler)
 
+    if log_file_path is None:
+        return
+
     os.makedirs(os.path.dirname(log_file_path), exist_ok=True)
     file_handler = logging.handlers.RotatingFileHandler(
         log_file_path,
@@ -262,6 +737,9 @@ def parse_cmd_args():
         add_config_file_help=True,
         add_env_var_help=False,
         default_config_files=["/etc/gprofiler/config.ini"],
+        epilog="Additional commands: 'gprofiler dump' - dump the stacks of all threads of processes"
+        " (see 'gprofiler dump --help'); 'gprofiler symbolize' - symbolize profiles collected with"
+        " --deferred-symbolization (see 'gprofiler symbolize --help')",
     )
     parser.add_argument("--config", is_config_file=True, help="Config file path")
     parser.add_argument(
@@ -291,10 +769,208 @@ def parse_cmd_args():
         help="Do not generate local flamegraphs when -o is given (only collapsed stacks files)",
     )
     parser.set_defaults(flamegraph=True)
+    parser.add_argument(
+        "--flamegraph-format",
+        choices=FLAMEGRAPH_FORMATS,
+        default="html",
+        help="Format of local flamegraphs: the interactive HTML, a static SVG (self-contained, flamegraph.pl style) or"
+        " both (default: %(default)s)",
+    )
+    parser.add_argument(
+        "--heatmap",
+        action="store_true",
+        default=False,
+        help="Generate a local sub-second heatmap (FlameScope-style) when -o is given. Selecting a time range in it"
+        " shows the flamegraph of that range only",
+    )
+    parser.add_argument(
+        "--source-annotations",
+        action="store_true",
+        default=False,
+        help="Add the hot source lines of Python & Java processes, with per-line sample percentages, to the local"
+        " flamegraphs. Java line numbers are collected by async-profiler, and Java sources are looked up in the"
+        " --java-source-path directories",
+    )
+    parser.add_argument(
+        "--java-source-path",
+        action="append",
+        dest="java_source_paths",
+        default=[],
+        help="Directory containing Java sources by package (like src/main/java), in the mount namespace of the Java"
+        " process (repeatable)",
+    )
 
     parser.add_argument(
         "--rotating-output", action="store_true", default=False, help="Keep only the last profile result"
     )
+    parser.add_argument(
+        "--annotate-frames",
+        action="store_true",
+        default=False,
+        help="Annotate all frames by their origin: _[j] for Java, _[p] for Python, _[n] for native, _[jit] for"
+        " JIT-compiled code sampled by perf and _[k] for kernel. Without this, only kernel and Java frames are"
+        " annotated",
+    )
+
+    parser.add_argument(
+        "--deferred-symbolization",
+        action="store_true",
+        default=False,
+        help="Don't symbolize native frames on this host: emit them as build ID & file offset pairs, to be resolved"
+        " later against a symbol store with 'gprofiler symbolize'. Kernel & JIT frames are still symbolized",
+    )
+
+    allocations_options = parser.add_argument_group("python allocations")
+    allocations_options.add_argument(
+        "--python-allocations",
+        action="store_true",
+        default=False,
+        help="Also sample the memory allocations of Python processes (x86_64, CPython 2.7 & 3.5-3.9), into a separate"
+        " profile weighted by allocated bytes. Note that this slows down allocation-heavy Python code while profiling",
+    )
+    allocations_options.add_argument(
+        "--python-allocations-period",
+        type=int,
+        default=DEFAULT_ALLOCATIONS_SAMPLE_PERIOD,
+        help="Sample every this many allocations (default: %(default)s)",
+    )
+
+    java_options = parser.add_argument_group("java")
+    java_options.add_argument(
+        "--java-breakdown",
+        action="store_true",
+        default=False,
+        help="Break down the samples of each JVM into application, GC, JIT compilation, VM operations & safepoints"
+        " and other internal threads - by thread names & frame patterns. The breakdown is logged and added to the"
+        " profile metadata",
+    )
+    java_options.add_argument(
+        "--java-breakdown-frames",
+        action="store_true",
+        default=False,
+        help="Also group the stacks of JVMs by their category, under a frame like [jvm: gc]. Requires --java-breakdown",
+    )
+
+    svg_options = parser.add_argument_group("svg flamegraphs")
+    svg_options.add_argument(
+        "--svg-width", type=int, default=SvgOptions().width, help="Width of SVG flamegraphs (default: %(default)s)"
+    )
+    svg_options.add_argument(
+        "--svg-min-width",
+        type=float,
+        default=SvgOptions().min_width,
+        help="Omit frames narrower than this many pixels from SVG flamegraphs (default: %(default)s)",
+    )
+    svg_options.add_argument(
+        "--svg-colors",
+        choices=SVG_COLOR_SCHEMES,
+        default=SvgOptions().colors,
+        help="Color scheme of SVG flamegraphs: hot (flamegraph.pl's) or by frame annotations - Java, inlined, kernel,"
+        " Python and native frames; requires --annotate-frames (default: %(default)s)",
+    )
+    svg_options.add_argument(
+        "--svg-title", default=SvgOptions().title, help="Title of SVG flamegraphs (default: %(default)s)"
+    )
+    svg_options.add_argument(
+        "--svg-no-search",
+        dest="svg_search",
+        action="store_false",
+        default=True,
+        help="Leave the search (which requires JavaScript) out of SVG flamegraphs, for viewers that block scripts",
+    )
+
+    labels_options = parser.add_argument_group("labels")
+    labels_options.add_argument(
+        "--label",
+        action="append",
+        dest="labels",
+        default=[],
+        help="key=value label to attach to all profiles (repeatable), e.g --label env=prod --label region=us-east-1",
+    )
+    labels_options.add_argument(
+        "--process-label",
+        action="append",
+        dest="process_label_rules",
+        default=[],
+        help="key=value:regex - attach the key=value label to processes whose command line matches the regex"
+        " (repeatable). The value may not contain ':'",
+    )
+
+    labels_options.add_argument(
+        "--systemd-units",
+        action="store_true",
+        default=False,
+        help="Attribute host (non-container) processes to their systemd units: label processes with their unit, and"
+        " add a per-unit breakdown of the samples to the profile metadata",
+    )
+    labels_options.add_argument(
+        "--systemd-unit-root-frames",
+        action="store_true",
+        default=False,
+        help="Also add the systemd unit of processes as a root frame to their stacks, with --systemd-units",
+    )
+
+    labels_options.add_argument(
+        "--task-metadata",
+        action="store_true",
+        default=False,
+        help="Label processes running as ECS tasks or Nomad allocations with the metadata of their task (ECS:"
+        " cluster, task family & revision; Nomad: namespace, job, group, task & allocation ID)",
+    )
+    labels_options.add_argument(
+        "--task-root-frames",
+        action="store_true",
+        default=False,
+        help="Also add the task of processes as a root frame to their stacks, with --task-metadata",
+    )
+
+    versions_options = parser.add_argument_group("versions")
+    versions_options.add_argument(
+        "--process-versions",
+        action="store_true",
+        default=False,
+        help="Extract the version identifiers of profiled processes (from environment variables, the image of their"
+        " container and the manifest of their JAR), and attach them as labels to the outputs",
+    )
+    versions_options.add_argument(
+        "--version-env-var",
+        action="append",
+        dest="version_env_vars",
+        default=[],
+        help="Environment variable holding the version of a process (repeatable). Default: "
+        + ", ".join(DEFAULT_VERSION_ENV_VARS),
+    )
+    versions_options.add_argument(
+        "--version-root-frames",
+        action="store_true",
+        default=False,
+        help="Also add the versions of processes as a root frame to their stacks, with --process-versions",
+    )
+
+    folding_options = parser.add_argument_group("folding")
+    folding_options.add_argument(
+        "--fold-preset",
+        action="append",
+        dest="fold_presets",
+        default=[],
+        choices=sorted(FOLD_PRESETS.keys()),
+        help="Fold library frames matching a built-in set of rules (repeatable)",
+    )
+    folding_options.add_argument(
+        "--fold-pattern",
+        action="append",
+        dest="fold_patterns",
+        default=[],
+        help="Fold library frames whose location matches this regex (repeatable). The location is the file path for"
+        " Python frames, the class name for Java frames and the DSO path for native frames",
+    )
+    folding_options.add_argument(
+        "--fold-mode",
+        choices=FOLD_MODES,
+        default="placeholder",
+        help="Replace consecutive library frames with a single [library] frame, or elide them entirely"
+        " (default: %(default)s)",
+    )
 
     parser.add_argument(
         "-u",
@@ -310,10 +986,49 @@ def parse_cmd_args():
         default=DEFAULT_UPLOAD_TIMEOUT,
         help="Timeout for upload requests to the server in seconds (default: %(default)s)",
     )
+    parser.add_argument(
+        "--upload-jitter",
+        type=int,
+        default=0,
+        help="Delay each upload by a random time of up to this many seconds, so uploads of many gProfilers are spread"
+        " over time. Uploads are done in the background (default: %(default)s)",
+    )
+    parser.add_argument(
+        "--upload-bandwidth-limit",
+        type=int,
+        default=0,
+        help="Maximum upload rate to the server, in KB/s. 0 means unlimited (default: %(default)s)",
+    )
     parser.add_argument("--token", dest="server_token", help="Server token")
     parser.add_argument("--service-name", help="Service name")
 
     parser.add_argument("-v", "--verbose", action="store_true", default=False, dest="verbose")
+    parser.add_argument(
+        "--no-privilege-dropping",
+        action="store_false",
+        dest="privilege_dropping",
+        default=True,
+        help="Run all child processes (profilers & post-processing tools) as root with all capabilities, instead of"
+        " with the least privileges each of them needs",
+    )
+
+    safety_options = parser.add_argument_group("latency-critical processes")
+    safety_options.add_argument(
+        "--critical-cgroup",
+        action="append",
+        dest="critical_cgroups",
+        default=[],
+        help="A cgroup path (e.g /system.slice/trader.service) whose processes are latency-critical, and are profiled"
+        " by perf only - runtime profilers don't attach to them. Processes with real-time threads, or threads pinned"
+        " to isolated CPUs, are always considered latency-critical. Can be given multiple times",
+    )
+    safety_options.add_argument(
+        "--no-safety-policy",
+        action="store_false",
+        dest="safety_policy",
+        default=True,
+        help="Attach runtime profilers to latency-critical processes as well",
+    )
 
     logging_options = parser.add_argument_group("logging")
     logging_options.add_argument("--log-file", action="store", type=str, dest="log_file", default=DEFAULT_LOG_FILE)
@@ -341,6 +1056,14 @@ def parse_cmd_args():
         help="Time between each profiling sessions in seconds (default: %(default)s). Note: this is the time between"
         " session starts, not between the end of one session to the beginning of the next one.",
     )
+    continuous_command_parser.add_argument(
+        "--start-jitter",
+        type=int,
+        default=0,
+        help="Delay the first profiling session by a random time of up to this many seconds, so that gProfilers"
+        " started at the same time (e.g on all nodes of a cluster) don't profile & upload in lockstep"
+        " (default: %(default)s)",
+    )
 
     args = parser.parse_args()
 
@@ -355,17 +1078,295 @@ def parse_cmd_args():
             "--profiling-duration must be lower or equal to --profiling-interval when profiling in continuous mode"
         )
 
+    if args.upload_jitter < 0 or args.upload_bandwidth_limit < 0 or args.start_jitter < 0:
+        parser.error("--upload-jitter, --upload-bandwidth-limit and --start-jitter must not be negative")
+
+    if args.continuous and args.upload_jitter >= args.continuous_profiling_interval:
+        # otherwise, uploads can't keep up with the profiling sessions
+        parser.error("--upload-jitter must be lower than --profiling-interval when profiling in continuous mode")
+
     if not args.upload_results and not args.output_dir:
         parser.error("Must pass at least one output method (--upload-results / --output-dir)")
 
+    if args.python_allocations_period <= 0:
+        parser.error("--python-allocations-period must be positive")
+
+    if args.source_annotations and not (args.output_dir and args.flamegraph):
+        parser.error("--source-annotations requires local flamegraphs (--output-dir, without --no-flamegraph)")
+
+    if args.source_annotations and args.flamegraph_format == "svg":
+        parser.error("--source-annotations requires HTML flamegraphs (--flamegraph-format html or both)")
+
+    if args.java_breakdown_frames and not args.java_breakdown:
+        parser.error("--java-breakdown-frames requires --java-breakdown")
+
+    if args.svg_width <= 0:
+        parser.error("--svg-width must be positive")
+
+    if args.svg_colors == "annotations" and not args.annotate_frames:
+        parser.error("--svg-colors annotations requires --annotate-frames")
+
+    for pattern in args.fold_patterns:
+        try:
+            re.compile(pattern)
+        except re.error as e:
+            parser.error(f"Invalid --fold-pattern {pattern!r}: {e}")
+
+    try:
+        args.labels = dict(parse_label(label) for label in args.labels)
+    except ValueError as e:
+        parser.error(f"Invalid --label: {e}")
+    try:
+        args.process_label_rules = [parse_process_label_rule(rule) for rule in args.process_label_rules]
+    except ValueError as e:
+        parser.error(f"Invalid --process-label: {e}")
+
     return args
 
 
-def verify_preconditions():
+def parse_dump_args(argv: List[str]):
+    parser = configargparse.ArgumentParser(
+        prog="gprofiler dump",
+        description="Dump the stacks of all threads of processes, at a single point in time",
+        auto_env_var_prefix="gprofiler_",
+        add_env_var_help=False,
+    )
+    parser.add_argument("--pid", type=int, action="append", dest="pids", default=[], help="PID to dump (repeatable)")
+    parser.add_argument(
+        "--container",
+        action="append",
+        dest="containers",
+        default=[],
+        help="Container ID (or a prefix of it) whose processes will be dumped (repeatable)",
+    )
+    parser.add_argument(
+        "-o", "--output-dir", type=str, help="Path to output directory (if not given, the report is printed)"
+    )
+    parser.add_argument("-v", "--verbose", action="store_true", default=False, dest="verbose")
+
+    args = parser.parse_args(argv)
+
+    if not args.pids and not args.containers:
+        parser.error("Must pass at least one process to dump (--pid / --container)")
+
+    return args
+
+
+def parse_symbolize_args(argv: List[str]):
+    parser = configargparse.ArgumentParser(
+        prog="gprofiler symbolize",
+        description="Symbolize the native frames of collapsed stacks files collected with --deferred-symbolization",
+        auto_env_var_prefix="gprofiler_",
+        add_env_var_help=False,
+    )
+    parser.add_argument("input", help="Collapsed stacks file (.col) to symbolize")
+    parser.add_argument(
+        "--symbols-dir",
+        action="append",
+        dest="symbols_dirs",
+        default=[],
+        help="Directory of ELF files (binaries, libraries or separate debug files), searched recursively and matched"
+        " by build ID (repeatable)",
+    )
+    parser.add_argument(
+        "-o", "--output", type=str, help="Path of the symbolized output file (if not given, the result is printed)"
+    )
+    parser.add_argument("-v", "--verbose", action="store_true", default=False, dest="verbose")
+
+    args = parser.parse_args(argv)
+
+    if not args.symbols_dirs:
+        parser.error("Must pass at least one --symbols-dir")
+
+    return args
+
+
+def parse_session_args(argv: List[str]):
+    parser = configargparse.ArgumentParser(
+        prog="gprofiler session",
+        description="Start a profiling session in the running gProfiler, alongside its other sessions - e.g a burst of"
+        " high frequency profiling of a single container",
+        auto_env_var_prefix="gprofiler_",
+        add_env_var_help=False,
+    )
+    parser.add_argument("--name", type=str, help="Name of the session (default: session_<timestamp>)")
+    parser.add_argument(
+        "-f",
+        "--profiling-frequency",
+        type=int,
+        dest="frequency",
+        default=DEFAULT_SAMPLING_FREQUENCY,
+        help="Profiler frequency in Hz (default: %(default)s)",
+    )
+    parser.add_argument(
+        "--intervals",
+        type=int,
+        default=1,
+        help="Number of profiling intervals of the running gProfiler to run the session for (default: %(default)s)",
+    )
+    parser.add_argument("--pid", type=int, action="append", dest="pids", default=[], help="PID to profile (repeatable)")
+    parser.add_argument(
+        "--container",
+        action="append",
+        dest="containers",
+        default=[],
+        help="Container ID (or a prefix of it) whose processes will be profiled (repeatable). If neither --pid nor"
+        " --container are given, all processes are profiled",
+    )
+    parser.add_argument("-o", "--output-dir", type=str, help="Path to output directory")
+    parser.add_argument("--flamegraph", action="store_true", default=False, help="Generate flamegraphs as well")
+    parser.add_argument("--heatmap", action="store_true", default=False, help="Generate heatmaps as well")
+    parser.add_argument(
+        "--upload-results",
+        action="store_true",
+        default=False,
+        help="Upload the profiles of the session as well (requires gProfiler to be uploading)",
+    )
+
+    args = parser.parse_args(argv)
+
+    if args.name is None:
+        args.name = f"session_{int(time.time())}"
+    elif SESSION_NAME_REGEX.match(args.name) is None or args.name == DEFAULT_SESSION_NAME:
+        parser.error(f"Invalid session name {args.name!r}")
+    if args.frequency <= 0:
+        parser.error("--profiling-frequency must be positive")
+    if args.intervals <= 0:
+        parser.error("--intervals must be positive")
+    if not args.output_dir and not args.upload_results:
+        parser.error("Must pass an output for the session (--output-dir / --upload-results)")
+    if args.output_dir:
+        if not Path(args.output_dir).is_dir():
+            parser.error("Output directory does not exist")
+        # gProfiler runs in a different working directory
+        args.output_dir = os.path.abspath(args.output_dir)
+
+    return args
+
+
+def parse_plan_args(argv: List[str]):
+    parser = configargparse.ArgumentParser(
+        prog="gprofiler plan",
+        description="Dry run: list the processes gProfiler would profile and how, the paths it would write in them and"
+        " why it would skip others - without attaching to any process or starting perf",
+        auto_env_var_prefix="gprofiler_",
+        add_env_var_help=False,
+    )
+    parser.add_argument(
+        "--critical-cgroup",
+        action="append",
+        dest="critical_cgroups",
+        default=[],
+        help="Same as gProfiler's --critical-cgroup (repeatable)",
+    )
+    parser.add_argument(
+        "--no-safety-policy",
+        action="store_false",
+        dest="safety_policy",
+        default=True,
+        help="Same as gProfiler's --no-safety-policy",
+    )
+    parser.add_argument("-v", "--verbose", action="store_true", default=False, dest="verbose")
+
+    return parser.parse_args(argv)
+
+
+def _parse_time(value: str) -> datetime.datetime:
+    return datetime.datetime.strptime(value, "%Y-%m-%dT%H:%M:%S")
+
+
+def parse_import_args(argv: List[str]):
+    parser = configargparse.ArgumentParser(
+        prog="gprofiler import",
+        description="Convert profiles collected by other tools - perf.data captures, pprof profiles (e.g of Go"
+        " services) and collapsed stacks files - into gProfiler's collapsed stacks format, optionally merging them"
+        " with profiles of gProfiler and uploading them",
+        auto_env_var_prefix="gprofiler_",
+        add_env_var_help=False,
+    )
+    parser.add_argument("input", help="Profile to import")
+    parser.add_argument(
+        "--format",
+        dest="input_format",
+        choices=IMPORT_FORMATS,
+        help="Format of the input (default: detected from its contents)",
+    )
+    parser.add_argument(
+        "--process-name",
+        help="Root frame for the imported stacks (default: the name of the input file for pprof profiles; perf.data"
+        " captures have their own process names)",
+    )
+    parser.add_argument(
+        "--pprof-sample-type",
+        help="The sample value of pprof profiles to use, e.g samples or cpu (default: samples, if the profile has it)",
+    )
+    parser.add_argument(
+        "--merge",
+        action="append",
+        dest="merge_paths",
+        default=[],
+        help="Collapsed stacks file of gProfiler to merge the imported stacks with, e.g the last_profile_<name>.col of"
+        " a session (repeatable). Its metadata is kept",
+    )
+    parser.add_argument(
+        "-o", "--output", type=str, help="Path of the output collapsed stacks file (if not given, it's printed)"
+    )
+
+    upload_options = parser.add_argument_group("upload")
+    upload_options.add_argument(
+        "-u", "--upload-results", action="store_true", default=False, help="Upload the imported profile to the server"
+    )
+    upload_options.add_argument(
+        "--server-host", default=GRANULATE_SERVER_HOST, help="Server host (default: %(default)s)"
+    )
+    upload_options.add_argument("--token", dest="server_token", help="Server token")
+    upload_options.add_argument("--service-name", help="Service name")
+    upload_options.add_argument(
+        "--hostname", default=gethostname(), help="Host the profile was collected on (default: this host)"
+    )
+    upload_options.add_argument(
+        "--label",
+        action="append",
+        dest="labels",
+        default=[],
+        help="key=value label to attach to the profile (repeatable)",
+    )
+    upload_options.add_argument(
+        "--start-time",
+        type=_parse_time,
+        help="Start of the profile, in UTC - YYYY-MM-DDTHH:MM:SS (default: taken from pprof profiles)",
+    )
+    upload_options.add_argument(
+        "--end-time",
+        type=_parse_time,
+        help="End of the profile, in UTC - YYYY-MM-DDTHH:MM:SS (default: taken from pprof profiles)",
+    )
+    parser.add_argument("-v", "--verbose", action="store_true", default=False, dest="verbose")
+
+    args = parser.parse_args(argv)
+
+    if args.upload_results:
+        if not args.server_token:
+            parser.error("Must provide --token when --upload-results is passed")
+        if not args.service_name:
+            parser.error("Must provide --service-name when --upload-results is passed")
+    try:
+        args.labels = dict(parse_label(label) for label in args.labels)
+    except ValueError as e:
+        parser.error(f"Invalid --label: {e}")
+
+    return args
+
+
+def verify_root():
     if not is_root():
         print("Must run gprofiler as root, please re-run.", file=sys.stderr)
         sys.exit(1)
 
+
+def verify_preconditions():
+    verify_root()
+
     if not grab_gprofiler_mutex():
         print("Could not acquire gProfiler's lock. Is it already running?", file=sys.stderr)
         sys.exit(1)
@@ -382,7 +1383,159 @@ def setup_signals() -> None:
     signal.signal(signal.SIGTERM, sigint_handler)
 
 
+def dump_main(argv: List[str]) -> None:
+    args = parse_dump_args(argv)
+    # no need to grab the mutex - dumps can be taken while gProfiler is running.
+    verify_root()
+    setup_logger(
+        logging.DEBUG if args.verbose else logging.INFO,
+        DEFAULT_LOG_FILE,
+        DEFAULT_LOG_MAX_SIZE,
+        DEFAULT_LOG_BACKUP_COUNT,
+    )
+
+    if args.output_dir and not Path(args.output_dir).is_dir():
+        logger.error("Output directory does not exist")
+        sys.exit(1)
+
+    try:
+        processes = [Process(pid) for pid in args.pids]
+    except NoSuchProcess as e:
+        logger.error(f"Process {e.pid} does not exist")
+        sys.exit(1)
+    for container in args.containers:
+        container_processes = find_container_processes(container)
+        if not container_processes:
+            logger.warning(f"No processes found for container {container!r}")
+        processes += container_processes
+
+    report = dump_threads(processes)
+    if args.output_dir:
+        dump_path = os.path.join(
+            args.output_dir, "dump_{}.txt".format(get_iso8061_format_time(datetime.datetime.utcnow()))
+        )
+        Path(dump_path).write_text(report)
+        logger.info(f"Saved thread dump to {dump_path}")
+    else:
+        print(report)
+
+
+def symbolize_main(argv: List[str]) -> None:
+    args = parse_symbolize_args(argv)
+    # symbolization is meant to run off the profiled hosts - it requires no special privileges, and doesn't log
+    # to gProfiler's log file.
+    setup_logger(logging.DEBUG if args.verbose else logging.INFO, None)
+
+    try:
+        collapsed = Path(args.input).read_text()
+    except OSError as e:
+        logger.error(f"Failed to read {args.input}: {e}")
+        sys.exit(1)
+
+    symbolized = Symbolizer(args.symbols_dirs).symbolize_collapsed(collapsed)
+    if args.output:
+        Path(args.output).write_text(symbolized)
+        logger.info(f"Saved symbolized stacks to {args.output}")
+    else:
+        print(symbolized)
+
+
+def session_main(argv: List[str]) -> None:
+    args = parse_session_args(argv)
+    verify_root()
+    setup_logger(logging.INFO, None)
+
+    spec = SessionSpec(
+        args.name,
+        args.frequency,
+        pids=tuple(args.pids),
+        containers=tuple(args.containers),
+        output_dir=args.output_dir,
+        flamegraph=args.flamegraph,
+        heatmap=args.heatmap,
+        upload=args.upload_results,
+        snapshots=args.intervals,
+    )
+    path = submit_session(spec)
+    logger.info(f"Submitted session {spec.name} ({path}), it starts at the next profiling interval of gProfiler")
+
+
+def plan_main(argv: List[str]) -> None:
+    args = parse_plan_args(argv)
+    # no need to grab the mutex - the plan can be made while gProfiler is running.
+    verify_root()
+    setup_logger(logging.DEBUG if args.verbose else logging.INFO, None)
+    reset_umask()
+    configure_safety_policy(args.safety_policy, args.critical_cgroups)
+
+    if not os.path.exists(TEMPORARY_STORAGE_PATH):
+        os.mkdir(TEMPORARY_STORAGE_PATH)
+    # the eBPF capability test writes its output here; Java processes in our mount namespace are shown paths in it,
+    # though gProfiler itself would use another temporary directory.
+    with TemporaryDirectoryWithMode(dir=TEMPORARY_STORAGE_PATH, mode=0o755) as storage_dir:
+        plan = make_plan(storage_dir, Event())
+    print(format_plan(plan))
+
+
+def import_main(argv: List[str]) -> None:
+    args = parse_import_args(argv)
+    # like symbolization, imports may run off the profiled hosts - they don't log to gProfiler's log file.
+    setup_logger(logging.DEBUG if args.verbose else logging.INFO, None)
+
+    try:
+        profiles = [import_profile(args.input, args.input_format, args.process_name, args.pprof_sample_type)]
+        profiles += [import_profile(path, COLLAPSED_FORMAT) for path in args.merge_paths]
+    except (OSError, ValueError, CalledProcessError) as e:
+        logger.error(f"Failed to import: {e}")
+        sys.exit(1)
+    profile = merge_profiles(profiles)
+    if args.labels:
+        profile.metadata["labels"] = {**profile.metadata.get("labels", {}), **args.labels}
+
+    if args.output:
+        Path(args.output).write_text(format_collapsed(profile))
+        logger.info(f"Saved imported stacks to {args.output}")
+    elif not args.upload_results:
+        print(format_collapsed(profile))
+
+    if args.upload_results:
+        start_time = args.start_time or profile.start_time
+        end_time = args.end_time or profile.end_time
+        if start_time is None or end_time is None:
+            logger.error("The time range of the profile is unknown, pass --start-time and --end-time")
+            sys.exit(1)
+        try:
+            client = APIClient(args.server_host, args.server_token, args.service_name, DEFAULT_UPLOAD_TIMEOUT)
+            client.submit_profile(
+                start_time,
+                end_time,
+                args.hostname,
+                "\n".join(f"{stack} {count}" for stack, count in profile.stacks.items()),
+                profile.metadata,
+            )
+        except (APIError, RequestException) as e:
+            logger.error(f"Failed to upload the imported profile: {e}")
+            sys.exit(1)
+        logger.info("Successfully uploaded the imported profile to the server")
+
+
 def main():
+    if len(sys.argv) > 1 and sys.argv[1] == "dump":
+        dump_main(sys.argv[2:])
+        return
+    if len(sys.argv) > 1 and sys.argv[1] == "symbolize":
+        symbolize_main(sys.argv[2:])
+        return
+    if len(sys.argv) > 1 and sys.argv[1] == "session":
+        session_main(sys.argv[2:])
+        return
+    if len(sys.argv) > 1 and sys.argv[1] == "plan":
+        plan_main(sys.argv[2:])
+        return
+    if len(sys.argv) > 1 and sys.argv[1] == "import":
+        import_main(sys.argv[2:])
+        return
+
     args = parse_cmd_args()
     verify_preconditions()
     setup_logger(
@@ -395,6 +1548,9 @@ def main():
 
     setup_signals()
     reset_umask()
+    if not args.privilege_dropping:
+        disable_privilege_dropping()
+    configure_safety_policy(args.safety_policy, args.critical_cgroups)
 
     try:
         logger.info(f"Running gprofiler (version {__version__})...")
@@ -415,6 +1571,10 @@ def main():
             client_kwargs = {}
             if "server_upload_timeout" in args:
                 client_kwargs["upload_timeout"] = args.server_upload_timeout
+            client_kwargs["bandwidth_limit"] = args.upload_bandwidth_limit * 1024
+            if args.continuous:
+                # retries of an upload must not delay the following profiling sessions
+                client_kwargs["max_total_retry_after"] = args.continuous_profiling_interval / 2
             client = (
                 APIClient(args.server_host, args.server_token, args.service_name, **client_kwargs)
                 if args.upload_results
@@ -428,12 +1588,41 @@ def main():
             return
 
         gprofiler = GProfiler(
-            args.frequency, args.duration, args.output_dir, args.flamegraph, args.rotating_output, client
+            args.frequency,
+            args.duration,
+            args.output_dir,
+            args.flamegraph,
+            args.rotating_output,
+            client,
+            heatmap=args.heatmap,
+            annotate_frames=args.annotate_frames,
+            folder=get_stack_folder(args.fold_presets, args.fold_patterns, args.fold_mode),
+            source_annotations=args.source_annotations,
+            java_source_paths=args.java_source_paths,
+            deferred_symbolization=args.deferred_symbolization,
+            upload_jitter=args.upload_jitter,
+            process_versions=args.process_versions,
+            version_env_vars=args.version_env_vars or DEFAULT_VERSION_ENV_VARS,
+            version_root_frames=args.version_root_frames,
+            labels=args.labels,
+            process_label_rules=args.process_label_rules,
+            systemd_units=args.systemd_units,
+            systemd_unit_root_frames=args.systemd_unit_root_frames,
+            task_metadata=args.task_metadata,
+            task_root_frames=args.task_root_frames,
+            python_allocations=args.python_allocations,
+            python_allocations_period=args.python_allocations_period,
+            java_breakdown=args.java_breakdown,
+            java_breakdown_frames=args.java_breakdown_frames,
+            flamegraph_format=args.flamegraph_format,
+            svg_options=SvgOptions(
+                args.svg_width, args.svg_min_width, args.svg_colors, args.svg_title, args.svg_search
+            ),
         )
         logger.info("gProfiler initialized and ready to start profiling")
 
         if args.continuous:
-            gprofiler.run_continuous(args.continuous_profiling_interval)
+            gprofiler.run_continuous(args.continuous_profiling_interval, args.start_jitter)
         else:
             gprofiler.run_single()
 
@@ -2,10 +2,13 @@
 # Copyright (c) Granulate. All rights reserved.
 # Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
 #
+import json
 import logging
 import re
 from collections import Counter, defaultdict
-from typing import Iterable, Mapping, MutableMapping
+from typing import Dict, Iterable, List, Mapping, MutableMapping, Optional, Sequence, Tuple
+
+from .folding import StackFolder
 
 logger = logging.getLogger(__name__)
 
@@ -20,6 +23,22 @@ SAMPLE_REGEX = re.compile(
 # 7fe48f00faff __poll+0x4f (/lib/x86_64-linux-gnu/libc-2.31.so)
 FRAME_REGEX = re.compile(r"^\s*[0-9a-f]+ (.*?) \((.*)\)$")
 
+# suffixes appended to frames, by the origin of the frame. kernel frames are always annotated, the rest only
+# if frame annotations are enabled.
+FRAME_ANNOTATIONS = {
+    "kernel": "_[k]",
+    "native": "_[n]",
+    "jit": "_[jit]",
+    "java": "_[j]",
+    "python": "_[p]",
+}
+# frames that already carry an annotation, e.g Java frames annotated by async-profiler ("_[j]", "_[i]", ...)
+ANNOTATED_FRAME_REGEX = re.compile(r"_\[\w+\]$")
+# placed below the process name in profiles collected without perf, where native & kernel stacks are missing.
+RUNTIME_ONLY_FRAME = "[runtime only: no native & kernel stacks]"
+# perf names anonymous executable mappings (where JIT-compiled code usually resides) after the perf map file.
+PERF_JIT_DSO_REGEX = re.compile(r"^/tmp/perf-\d+\.map$")
+
 
 def parse_one_collapsed(collapsed: str) -> Mapping[str, int]:
     """
@@ -39,6 +58,25 @@ def parse_one_collapsed(collapsed: str) -> Mapping[str, int]:
     return dict(stacks)
 
 
+def format_metadata_line(metadata: Mapping) -> str:
+    """
+    Formats the metadata of a profile as a comment line, to be put at the top of collapsed stacks files.
+    Parsers of collapsed stacks (including parse_one_collapsed) skip it.
+    """
+    return "# " + json.dumps(metadata, sort_keys=True)
+
+
+def parse_metadata_line(line: str) -> Optional[Dict]:
+    """
+    Parses a metadata line written by format_metadata_line. Other comment lines are ignored (None is returned).
+    """
+    try:
+        metadata = json.loads(line[1:])
+    except ValueError:
+        return None
+    return metadata if isinstance(metadata, dict) else None
+
+
 def parse_many_collapsed(text: str) -> Mapping[int, Mapping[str, int]]:
     """
     Parse a stack-collapsed listing where stacks are prefixed with the command and pid/tid of their
@@ -63,11 +101,33 @@ def parse_many_collapsed(text: str) -> Mapping[int, Mapping[str, int]]:
     return results
 
 
-def collapse_stack(stack: str, comm: str) -> str:
+def annotate_frame(frame: str, origin: str) -> str:
+    """
+    Appends the annotation of 'origin' to a frame. Frames which are already annotated and pseudo-frames
+    (like "[unknown]") are left as is.
+    """
+    if ANNOTATED_FRAME_REGEX.search(frame) is not None or (frame.startswith("[") and frame.endswith("]")):
+        return frame
+    return frame + FRAME_ANNOTATIONS[origin]
+
+
+def annotate_stacks(stacks: Mapping[str, int], origin: str) -> Mapping[str, int]:
+    """
+    Annotates all frames of stacks collected by a runtime profiler, see annotate_frame.
+    """
+    annotated: MutableMapping[str, int] = Counter()
+    for stack, count in stacks.items():
+        annotated[";".join(annotate_frame(frame, origin) for frame in stack.split(";"))] += count
+    return dict(annotated)
+
+
+def collapse_stack(
+    stack: str, comm: str, annotate_frames: bool = False, folder: Optional[StackFolder] = None
+) -> str:
     """
     Collapse a single stack from "perf".
     """
-    funcs = [comm]
+    frames: List[Tuple[str, str]] = []
     for line in reversed(stack.splitlines()):
         m = FRAME_REGEX.match(line)
         assert m is not None, f"bad line: {line}"
@@ -77,8 +137,17 @@ def collapse_stack(stack: str, comm: str) -> str:
             sym = f"[{dso}]"
         # append kernel annotation
         elif "kernel" in dso or "vmlinux" in dso:
-            sym += "_[k]"
-        funcs.append(sym)
+            sym += FRAME_ANNOTATIONS["kernel"]
+        elif annotate_frames:
+            sym = annotate_frame(sym, "jit" if PERF_JIT_DSO_REGEX.match(dso) else "native")
+        frames.append((sym, dso))
+
+    funcs = [comm]
+    if folder is not None:
+        # native frames are folded by their DSO
+        funcs += folder.fold(frames)
+    else:
+        funcs += [sym for sym, _ in frames]
     return ";".join(funcs)
 
 
@@ -97,7 +166,17 @@ def parse_perf_script(script: str):
             logger.exception(f"Error processing sample: {sample}")
 
 
-def merge_perfs(perf_all: Iterable[Mapping[str, str]], process_perfs: Mapping[int, Mapping[str, int]]) -> str:
+def merge_perfs(
+    perf_all: Iterable[Mapping[str, str]],
+    process_perfs: Mapping[int, Mapping[str, int]],
+    annotate_frames: bool = False,
+    folder: Optional[StackFolder] = None,
+    root_frames: Optional[Mapping[int, Sequence[str]]] = None,
+) -> str:
+    """
+    :param root_frames: Frames to prepend to the stacks of processes (before the process name), by pid.
+    """
+    root_frames = root_frames or {}
     per_process_samples: MutableMapping[int, int] = Counter()
     new_samples: MutableMapping[str, int] = Counter()
     process_names = {}
@@ -108,7 +187,8 @@ def merge_perfs(perf_all: Iterable[Mapping[str, str]], process_perfs: Mapping[in
                 per_process_samples[pid] += 1
                 process_names[pid] = parsed["comm"]
             elif parsed["stack"] is not None:
-                new_samples[collapse_stack(parsed["stack"], parsed["comm"])] += 1
+                collapsed = collapse_stack(parsed["stack"], parsed["comm"], annotate_frames, folder)
+                new_samples[";".join([*root_frames.get(pid, []), collapsed])] += 1
         except Exception:
             logger.exception(f"Error processing sample: {parsed}")
 
@@ -118,7 +198,37 @@ def merge_perfs(perf_all: Iterable[Mapping[str, str]], process_perfs: Mapping[in
         if process_perf_count > 0:
             ratio = perf_all_count / process_perf_count
             for stack, count in process_stacks.items():
-                full_stack = ";".join([process_names[pid], stack])
+                if folder is not None:
+                    stack = folder.fold_stack(stack)
+                full_stack = ";".join([*root_frames.get(pid, []), process_names[pid], stack])
                 new_samples[full_stack] += round(count * ratio)
 
     return "\n".join((f"{stack} {count}" for stack, count in new_samples.items()))
+
+
+def merge_runtime_perfs(
+    process_perfs: Mapping[int, Mapping[str, int]],
+    process_frequencies: Mapping[int, int],
+    frequency: int,
+    process_names: Mapping[int, str],
+    folder: Optional[StackFolder] = None,
+    root_frames: Optional[Mapping[int, Sequence[str]]] = None,
+) -> str:
+    """
+    The degraded counterpart of merge_perfs, for when perf is unavailable: only the stacks of the runtime profilers
+    are available. Without perf samples to scale them by, each process' counts are scaled from the frequency of its
+    profiler to 'frequency' (that of perf), so they remain comparable to profiles with perf.
+    A RUNTIME_ONLY_FRAME is placed below the process name, marking the native & kernel stacks as missing.
+    :param process_frequencies: Sampling frequency of the runtime profiler of each process, by pid.
+    """
+    root_frames = root_frames or {}
+    new_samples: MutableMapping[str, int] = Counter()
+    for pid, process_stacks in process_perfs.items():
+        ratio = frequency / process_frequencies[pid]
+        for stack, count in process_stacks.items():
+            if folder is not None:
+                stack = folder.fold_stack(stack)
+            full_stack = ";".join([*root_frames.get(pid, []), process_names[pid], RUNTIME_ONLY_FRAME, stack])
+            new_samples[full_stack] += round(count * ratio)
+
+    return "\n".join((f"{stack} {count}" for stack, count in new_samples.items()))
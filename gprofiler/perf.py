@@ -12,6 +12,8 @@ from typing import Iterable, Mapping
 import psutil
 
 from .merge import parse_perf_script
+from .privileges import POST_PROCESSING
+from .symbolization import DeferredFramesResolver
 from .utils import TEMPORARY_STORAGE_PATH, resource_path, run_process
 
 logger = logging.getLogger(__name__)
@@ -21,12 +23,23 @@ PERF_BUILDID_DIR = os.path.join(TEMPORARY_STORAGE_PATH, "perf-buildids")
 
 
 class SystemProfiler:
-    def __init__(self, frequency: int, duration: int, stop_event: Event, storage_dir: str):
+    def __init__(
+        self,
+        frequency: int,
+        duration: int,
+        stop_event: Event,
+        storage_dir: str,
+        deferred_symbolization: bool = False,
+    ):
         logger.info(f"Initializing system profiler (frequency: {frequency}hz, duration: {duration}s)")
         self._frequency = frequency
         self._duration = duration
         self._stop_event = stop_event
         self._storage_dir = storage_dir
+        self._deferred_symbolization = deferred_symbolization
+
+    def set_frequency(self, frequency: int) -> None:
+        self._frequency = frequency
 
     def start(self):
         pass
@@ -54,9 +67,13 @@ class SystemProfiler:
                 [resource_path("perf")] + buildid_args + ["record"] + args + ["--", "sleep", str(self._duration)],
                 stop_event=self._stop_event,
             )
+            # with deferred symbolization, perf only prints the addresses & DSOs of frames.
+            fields = "+pid,-sym" if self._deferred_symbolization else "+pid"
             with open(parsed_path, "w") as f:
                 run_process(
-                    [resource_path("perf")] + buildid_args + ["script", "-F", "+pid", "-i", record_file.name], stdout=f
+                    [resource_path("perf")] + buildid_args + ["script", "-F", fields, "-i", record_file.name],
+                    privileges=POST_PROCESSING,
+                    stdout=f,
                 )
             return parsed_path
 
@@ -68,7 +85,10 @@ class SystemProfiler:
         logger.info("Running global perf...")
         record_path = self.run_perf("global")
         logger.info("Finished running global perf")
-        return parse_perf_script(Path(record_path).read_text())
+        samples = parse_perf_script(Path(record_path).read_text())
+        if self._deferred_symbolization:
+            return DeferredFramesResolver().resolve_samples(samples)
+        return samples
 
         # TODO: run dwarf in parallel, after supporting it in merge.py
         # Alternatively: fix golang dwarf problems and the run just dwarf
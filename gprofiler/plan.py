@@ -0,0 +1,132 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+"""
+Dry run of gProfiler ("gprofiler plan"): runs the discovery of the profilers and reports which process each of them
+would profile, the paths that would be written in the profiled processes and why processes were skipped - without
+attaching to any process, starting perf or PyPerf, or loading kernel modules.
+"""
+import os
+import shlex
+from threading import Event
+from typing import Dict, List, NamedTuple, Optional
+
+from psutil import NoSuchProcess, Process
+
+from .inventory import PERF_ONLY
+from .java import UNSUPPORTED_JAVA_VERSION, JavaProfiler
+from .kernel_headers import get_kernel_headers_source
+from .python import PySpyProfiler, PythonEbpfProfiler, PythonProfilerBase, find_python_processes
+from .utils import get_process_name
+
+
+class ProcessPlan(NamedTuple):
+    pid: int
+    comm: str
+    cmdline: str
+    profiler: str
+    # paths that would be written in the mount namespace of the process
+    paths: List[str]
+    # reasons of runtime profilers to skip the process, by profiler
+    skipped: Dict[str, str]
+
+
+class Plan(NamedTuple):
+    python_profiler: str
+    processes: List[ProcessPlan]
+    # the kernel headers PyPerf would use (see kernel_headers.get_kernel_headers_source)
+    kernel_headers: Optional[str] = None
+
+
+def _plan_java(java_profiler: JavaProfiler) -> Dict[int, List[str]]:
+    """
+    :returns: The paths that would be written in each Java process that would be profiled, by pid.
+    """
+    targets = {}
+    for process in java_profiler.find_processes_to_profile():
+        try:
+            if java_profiler.is_process_supported(process):
+                targets[process.pid] = java_profiler.get_target_paths(process)
+            else:
+                java_profiler.skipped_processes[process.pid] = UNSUPPORTED_JAVA_VERSION
+        except NoSuchProcess:
+            continue
+        except Exception as e:
+            java_profiler.skipped_processes[process.pid] = f"Java version check failed ({e})"
+    return targets
+
+
+def _plan_python(python_profiler: PythonProfilerBase) -> List[int]:
+    """
+    :returns: The pids of the Python processes that would be profiled.
+    """
+    if isinstance(python_profiler, PySpyProfiler):
+        return [process.pid for process in python_profiler.find_python_processes_to_profile()]
+    # PyPerf profiles all Python processes, without attaching to them.
+    return [process.pid for process in find_python_processes() if process.pid != os.getpid()]
+
+
+def _describe_process(pid: int, profiler: str, paths: List[str], skipped: Dict[str, str]) -> Optional[ProcessPlan]:
+    try:
+        cmdline = " ".join(shlex.quote(arg) for arg in Process(pid).cmdline())
+    except NoSuchProcess:
+        return None
+    return ProcessPlan(pid, get_process_name(pid), cmdline, profiler, paths, skipped)
+
+
+def make_plan(storage_dir: str, stop_event: Event) -> Plan:
+    """
+    :param storage_dir: The temporary storage directory, as gProfiler would use.
+    """
+    # the frequencies & durations don't matter - the profilers don't run.
+    java_profiler = JavaProfiler(1, 1, True, stop_event, storage_dir)
+    java_targets = _plan_java(java_profiler)
+    # PyPerf is chosen if there are kernel headers for it; its capability test isn't run, and the kheaders module
+    # isn't loaded.
+    kernel_headers = get_kernel_headers_source(load_kheaders=False)
+    python_profiler_class = PythonEbpfProfiler if kernel_headers is not None else PySpyProfiler
+    python_profiler = python_profiler_class(1, 1, stop_event, storage_dir)
+    python_targets = _plan_python(python_profiler)
+
+    skipped: Dict[int, Dict[str, str]] = {}
+    for profiler in (java_profiler, python_profiler):
+        for pid, reason in profiler.skipped_processes.items():
+            skipped.setdefault(pid, {})[profiler.NAME] = reason
+
+    processes = []
+    for pid in sorted(java_targets.keys() | set(python_targets) | skipped.keys()):
+        if pid in java_targets:
+            profiler, paths = java_profiler.NAME, java_targets[pid]
+        elif pid in python_targets:
+            profiler, paths = python_profiler.NAME, []
+        else:
+            profiler, paths = PERF_ONLY, []
+        process_plan = _describe_process(pid, profiler, paths, skipped.get(pid, {}))
+        if process_plan is not None:
+            processes.append(process_plan)
+    return Plan(python_profiler.NAME, processes, kernel_headers)
+
+
+def format_plan(plan: Plan) -> str:
+    if plan.python_profiler == PySpyProfiler.NAME:
+        python = f"Python: {plan.python_profiler} (no kernel headers for eBPF), attaches to the Python processes below"
+    else:
+        python = (
+            f"Python: {plan.python_profiler} (eBPF, using {plan.kernel_headers}), profiles the Python processes below"
+            f" without attaching to them - or {PySpyProfiler.NAME}, if PyPerf fails to start"
+        )
+    lines = [
+        "perf: profiles all processes (system-wide)",
+        f"Java: {JavaProfiler.NAME}, attaches to the Java processes below",
+        python,
+        "",
+        f"{'PID':>7}  {'PROFILER':<15} COMMAND",
+    ]
+    for process in plan.processes:
+        lines.append(f"{process.pid:>7}  {process.profiler:<15} {process.cmdline or f'[{process.comm}]'}")
+        lines.extend(f"{'':>9}writes {path}" for path in process.paths)
+        lines.extend(f"{'':>9}skipped by {profiler}: {reason}" for profiler, reason in process.skipped.items())
+    lines.append("")
+    lines.append("All other processes are profiled by perf only.")
+    return "\n".join(lines)
@@ -0,0 +1,221 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+"""
+Privileges of the child processes we run. gProfiler itself runs as root, but most of its children need only a
+small part of that: py-spy needs to ptrace, "perf script" needs to read files (and no more), burn needs nothing.
+Each child is run with the least privileges that work for it - as an unprivileged user where possible, and
+otherwise as root with a restricted set of capabilities.
+"""
+import ctypes
+import os
+import pwd
+import stat
+from typing import Callable, FrozenSet, NamedTuple, Optional, Tuple, Union
+
+# from linux/capability.h
+CAP_DAC_READ_SEARCH = 2
+CAP_KILL = 5
+CAP_SETGID = 6
+CAP_SETUID = 7
+CAP_SYS_CHROOT = 18
+CAP_SYS_PTRACE = 19
+CAP_SYS_ADMIN = 21
+CAP_SYSLOG = 34
+
+CAPABILITY_NAMES = {
+    CAP_DAC_READ_SEARCH: "CAP_DAC_READ_SEARCH",
+    CAP_KILL: "CAP_KILL",
+    CAP_SETGID: "CAP_SETGID",
+    CAP_SETUID: "CAP_SETUID",
+    CAP_SYS_CHROOT: "CAP_SYS_CHROOT",
+    CAP_SYS_PTRACE: "CAP_SYS_PTRACE",
+    CAP_SYS_ADMIN: "CAP_SYS_ADMIN",
+    CAP_SYSLOG: "CAP_SYSLOG",
+}
+
+# from linux/prctl.h
+PR_SET_KEEPCAPS = 8
+PR_CAPBSET_DROP = 24
+PR_SET_NO_NEW_PRIVS = 38
+PR_CAP_AMBIENT = 47
+PR_CAP_AMBIENT_IS_SET = 1
+PR_CAP_AMBIENT_RAISE = 2
+
+_LINUX_CAPABILITY_VERSION_3 = 0x20080522
+
+UNPRIVILEGED_USER = "nobody"
+
+_libc = ctypes.CDLL(None, use_errno=True)
+_privilege_dropping_enabled = True
+
+
+class Privileges(NamedTuple):
+    # capabilities to keep; None keeps all of them (and the root user).
+    capabilities: Optional[FrozenSet[int]]
+    # user to switch to - a user name or (uid, gid); None keeps the root user.
+    user: Union[str, Tuple[int, int], None] = None
+
+
+# perf record, PyPerf - these need it all.
+ROOT = Privileges(None)
+# py-spy: reads the memory of processes, and their binaries (via /proc/pid/root).
+PTRACE = Privileges(frozenset({CAP_SYS_PTRACE, CAP_DAC_READ_SEARCH}))
+# jattach: enters the namespaces of the JVM & switches to its user, then signals it.
+ATTACH = Privileges(
+    frozenset({CAP_SYS_PTRACE, CAP_DAC_READ_SEARCH, CAP_SYS_ADMIN, CAP_SYS_CHROOT, CAP_SETUID, CAP_SETGID, CAP_KILL})
+)
+# "perf script": reads the recording, the build ID cache, binaries of processes & kernel symbols.
+POST_PROCESSING = Privileges(frozenset({CAP_DAC_READ_SEARCH, CAP_SYS_PTRACE, CAP_SYSLOG}), UNPRIVILEGED_USER)
+# burn & co: read their input, write their output to stdout.
+UNPRIVILEGED = Privileges(frozenset(), UNPRIVILEGED_USER)
+
+
+def disable_privilege_dropping() -> None:
+    """
+    Run all children as root, with all capabilities.
+    """
+    global _privilege_dropping_enabled
+    _privilege_dropping_enabled = False
+
+
+def process_user_privileges(uid: int, gid: int) -> Privileges:
+    """
+    Privileges of a user without capabilities - used to run commands on behalf of processes, as their user.
+    """
+    return Privileges(frozenset(), (uid, gid))
+
+
+def describe_privileges(privileges: Privileges) -> str:
+    if privileges.capabilities is None:
+        return "root"
+    user = "root" if privileges.user is None else privileges.user
+    if isinstance(user, tuple):
+        user = f"uid {user[0]}"
+    if not privileges.capabilities:
+        return f"{user} without capabilities"
+    return f"{user} with " + ",".join(CAPABILITY_NAMES[cap] for cap in sorted(privileges.capabilities))
+
+
+def _get_last_capability() -> int:
+    with open("/proc/sys/kernel/cap_last_cap") as f:
+        return int(f.read())
+
+
+def _ambient_capabilities_supported() -> bool:
+    # added in Linux 4.3; older kernels fail with EINVAL.
+    return _libc.prctl(PR_CAP_AMBIENT, PR_CAP_AMBIENT_IS_SET, 0, 0, 0) >= 0
+
+
+def _resolve_user(user: Union[str, Tuple[int, int]]) -> Optional[Tuple[int, int]]:
+    if isinstance(user, tuple):
+        return user
+    try:
+        entry = pwd.getpwnam(user)
+    except KeyError:
+        return None
+    return entry.pw_uid, entry.pw_gid
+
+
+def _is_executable_by(path: str, uid: int, gid: int) -> bool:
+    """
+    Checks that a user can execute a file, including searching all directories leading to it. Our resources
+    might be extracted to directories accessible by root only.
+    """
+
+    def _can_execute(st: os.stat_result) -> bool:
+        if st.st_uid == uid:
+            return bool(st.st_mode & stat.S_IXUSR)
+        if st.st_gid == gid:
+            return bool(st.st_mode & stat.S_IXGRP)
+        return bool(st.st_mode & stat.S_IXOTH)
+
+    path = os.path.realpath(path)
+    directory = os.path.dirname(path)
+    while True:
+        if not _can_execute(os.stat(directory)):
+            return False
+        if directory == "/":
+            break
+        directory = os.path.dirname(directory)
+    return _can_execute(os.stat(path))
+
+
+class _CapUserHeader(ctypes.Structure):
+    _fields_ = [("version", ctypes.c_uint32), ("pid", ctypes.c_int)]
+
+
+class _CapUserData(ctypes.Structure):
+    _fields_ = [("effective", ctypes.c_uint32), ("permitted", ctypes.c_uint32), ("inheritable", ctypes.c_uint32)]
+
+
+def _check(result: int, what: str) -> None:
+    if result != 0:
+        errno = ctypes.get_errno()
+        raise OSError(errno, f"{what}: {os.strerror(errno)}")
+
+
+def _make_drop_privileges(
+    capabilities: FrozenSet[int], credentials: Optional[Tuple[int, int]], last_capability: int
+) -> Callable[[], None]:
+    # everything is computed beforehand - the returned function runs in the child, between fork() and exec().
+    header = _CapUserHeader(_LINUX_CAPABILITY_VERSION_3, 0)
+    data = (_CapUserData * 2)()
+    for cap in capabilities:
+        mask = 1 << (cap % 32)
+        data[cap // 32].effective |= mask
+        data[cap // 32].permitted |= mask
+        data[cap // 32].inheritable |= mask
+
+    def _drop_privileges() -> None:
+        os.setpgrp()
+        # the bounding set limits the capabilities gained on exec(), also when running as root.
+        for cap in range(last_capability + 1):
+            if cap not in capabilities:
+                _check(_libc.prctl(PR_CAPBSET_DROP, cap, 0, 0, 0), f"drop capability {cap}")
+        if credentials is not None:
+            uid, gid = credentials
+            # keep the permitted capabilities over setuid(), they are trimmed by capset() below
+            _check(_libc.prctl(PR_SET_KEEPCAPS, 1, 0, 0, 0), "PR_SET_KEEPCAPS")
+            os.setgroups([])
+            os.setgid(gid)
+            os.setuid(uid)
+        _check(_libc.capset(ctypes.byref(header), data), "capset")
+        if credentials is not None:
+            # non-root users keep capabilities over exec() only as ambient capabilities.
+            for cap in capabilities:
+                _check(_libc.prctl(PR_CAP_AMBIENT, PR_CAP_AMBIENT_RAISE, cap, 0, 0), f"raise capability {cap}")
+        # and setuid binaries can't get the privileges back
+        _check(_libc.prctl(PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0), "PR_SET_NO_NEW_PRIVS")
+
+    return _drop_privileges
+
+
+def get_privileges_preexec_fn(privileges: Privileges, executable: str) -> Tuple[Callable[[], None], Privileges]:
+    """
+    Gets a preexec_fn for Popen that applies the given privileges (and puts the child in a new process group,
+    like Popen calls of gProfiler do by default).
+    Falls back to running as root with the same capabilities if the user can't be used (it doesn't exist, can't
+    access the executable or can't have ambient capabilities on this kernel), and to running with full privileges
+    if we're not root to begin with, or privilege dropping is disabled.
+    :returns: The preexec_fn, and the privileges it actually applies.
+    """
+    capabilities = privileges.capabilities
+    if capabilities is None or not _privilege_dropping_enabled or os.geteuid() != 0:
+        return os.setpgrp, ROOT
+
+    credentials = None
+    if privileges.user is not None:
+        credentials = _resolve_user(privileges.user)
+        if credentials is not None:
+            uid, gid = credentials
+            try:
+                if os.path.isabs(executable) and not _is_executable_by(executable, uid, gid):
+                    credentials = None
+            except OSError:
+                credentials = None
+        if credentials is not None and capabilities and not _ambient_capabilities_supported():
+            credentials = None
+    actual = Privileges(capabilities, privileges.user if credentials is not None else None)
+    return _make_drop_privileges(capabilities, credentials, _get_last_capability()), actual
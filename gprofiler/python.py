@@ -6,24 +6,95 @@ import concurrent.futures
 import glob
 import logging
 import os
+import re
 import signal
 from pathlib import Path
 from subprocess import Popen
 from threading import Event
-from typing import Callable, List, Mapping, Optional, Union
+from typing import Callable, Dict, List, Mapping, Optional, Set, Tuple, Union
 
+import psutil
 from psutil import Process
 
+from .elf import elf_has_defined_symbols
 from .exceptions import CalledProcessError, ProcessStoppedException, StopEventSetException
-from .merge import parse_many_collapsed, parse_one_collapsed
+from .kernel_headers import describe_missing_kernel_headers, get_kernel_headers_source
+from .merge import annotate_stacks, parse_many_collapsed, parse_one_collapsed
+from .privileges import PTRACE
+from .safety import filter_runtime_attachable
 from .utils import pgrep_maps, poll_process, resource_path, run_process, start_process, wait_event
 
 logger = logging.getLogger(__name__)
 
 _reinitialize_profiler: Optional[Callable[[], None]] = None
 
+PYTHON_PROCESS_MAPS_REGEX = r"(?:^.+/(?:lib)?python[^/]*$)|(?:^.+/site-packages/.+?$)|(?:^.+/dist-packages/.+?$)"
+# symbols defined by executables that contain the CPython runtime (_PyRuntime is 3.7+, Py_Main exists in all versions)
+PYTHON_RUNTIME_SYMBOLS = ["_PyRuntime", "Py_Main"]
+# executables smaller than this can't contain the CPython runtime (libpython alone is a few MBs), so they are not
+# parsed at all - most executables on a host are filtered out by this.
+MIN_PYTHON_EXECUTABLE_SIZE = 1024 * 1024
+
+# (st_dev, st_ino, st_mtime_ns) of executables -> whether they contain the CPython runtime
+_PYTHON_EXECUTABLES_CACHE: Dict[Tuple[int, int, int], bool] = {}
+
+
+def executable_has_python_runtime(pid: int, live_executables: Optional[Set[Tuple[int, int, int]]] = None) -> bool:
+    """
+    Checks whether the executable of a process contains the CPython runtime: statically linked interpreters,
+    embedded Python (e.g uWSGI built with a static libpython), frozen apps and renamed interpreter binaries.
+    These are missed by PYTHON_PROCESS_MAPS_REGEX, because they don't map any file named "python"/"libpython".
+    :param live_executables: If given, the executable of the process is added to it (to evict the cache entries of
+                             executables that no process runs anymore).
+    """
+    exe_path = f"/proc/{pid}/exe"
+    try:
+        stat = os.stat(exe_path)
+    except OSError:
+        return False  # kernel thread, or the process has exited
+    if stat.st_size < MIN_PYTHON_EXECUTABLE_SIZE:
+        return False
+
+    key = (stat.st_dev, stat.st_ino, stat.st_mtime_ns)
+    if live_executables is not None:
+        live_executables.add(key)
+    if key not in _PYTHON_EXECUTABLES_CACHE:
+        try:
+            _PYTHON_EXECUTABLES_CACHE[key] = elf_has_defined_symbols(exe_path, PYTHON_RUNTIME_SYMBOLS)
+        except FileNotFoundError:
+            return False  # process has exited, don't cache
+        except Exception as e:
+            logger.debug(f"Failed to read the symbols of {exe_path}: {e}")
+            _PYTHON_EXECUTABLES_CACHE[key] = False
+    return _PYTHON_EXECUTABLES_CACHE[key]
+
+
+def is_python_process(process: Process) -> bool:
+    """
+    Checks a single process, the same way find_python_processes() checks all of them.
+    """
+    maps = Path(f"/proc/{process.pid}/maps").read_text()
+    return (
+        re.search(PYTHON_PROCESS_MAPS_REGEX, maps, re.MULTILINE) is not None
+        or executable_has_python_runtime(process.pid)
+    )
+
+
+def find_python_processes() -> List[Process]:
+    # the maps check is cheap, and finds most Python processes - only the rest are checked for static interpreters.
+    processes = {process.pid: process for process in pgrep_maps(PYTHON_PROCESS_MAPS_REGEX)}
+    live_executables: Set[Tuple[int, int, int]] = set()
+    for process in psutil.process_iter():
+        if process.pid not in processes and executable_has_python_runtime(process.pid, live_executables):
+            processes[process.pid] = process
+    # forget executables of processes that are gone
+    for key in [key for key in _PYTHON_EXECUTABLES_CACHE if key not in live_executables]:
+        del _PYTHON_EXECUTABLES_CACHE[key]
+    return list(processes.values())
+
 
 class PythonProfilerBase:
+    NAME = "python"
     MAX_FREQUENCY = 100
 
     def __init__(
@@ -32,13 +103,32 @@ class PythonProfilerBase:
         duration: int,
         stop_event: Optional[Event],
         storage_dir: str,
+        annotate_frames: bool = False,
+        line_numbers: bool = False,
     ):
         self._frequency = min(frequency, self.MAX_FREQUENCY)
         self._duration = duration
         self._stop_event = stop_event or Event()
         self._storage_dir = storage_dir
+        self._annotate_frames = annotate_frames
+        self._line_numbers = line_numbers
+        # processes skipped in the last snapshot and the reasons, by pid
+        self.skipped_processes: Dict[int, str] = {}
         logger.info(f"Initializing Python profiler (frequency: {self._frequency}hz, duration: {duration}s)")
 
+    @property
+    def frequency(self) -> int:
+        """
+        The actual sampling frequency, which may be lower than the requested one.
+        """
+        return self._frequency
+
+    def set_frequency(self, frequency: int) -> None:
+        """
+        Sets the frequency of the following snapshots.
+        """
+        self._frequency = min(frequency, self.MAX_FREQUENCY)
+
     def start(self):
         pass
 
@@ -48,6 +138,9 @@ class PythonProfilerBase:
         """
         raise NotImplementedError
 
+    def _annotate(self, stacks: Mapping[str, int]) -> Mapping[str, int]:
+        return annotate_stacks(stacks, "python") if self._annotate_frames else stacks
+
     def stop(self):
         pass
 
@@ -60,6 +153,7 @@ class PythonProfilerBase:
 
 
 class PySpyProfiler(PythonProfilerBase):
+    NAME = "py-spy"
     MAX_FREQUENCY = 10
     BLACKLISTED_PYTHON_PROCS = ["unattended-upgrades", "networkd-dispatcher", "supervisord", "tuned"]
 
@@ -74,7 +168,8 @@ class PySpyProfiler(PythonProfilerBase):
             "--nonblocking",
             "--format",
             "raw",
-            "-F",
+            # aggregate by function, unless line numbers were requested
+            *([] if self._line_numbers else ["-F"]),
             "--gil",
             "--output",
             output_path,
@@ -88,33 +183,35 @@ class PySpyProfiler(PythonProfilerBase):
 
         local_output_path = os.path.join(self._storage_dir, f"{process.pid}.py.col.dat")
         try:
-            run_process(self._make_command(process.pid, local_output_path), stop_event=self._stop_event)
+            run_process(
+                self._make_command(process.pid, local_output_path), stop_event=self._stop_event, privileges=PTRACE
+            )
         except ProcessStoppedException:
             raise StopEventSetException
 
         logger.info(f"Finished profiling process {process.pid} with py-spy")
-        return parse_one_collapsed(Path(local_output_path).read_text())
+        return self._annotate(parse_one_collapsed(Path(local_output_path).read_text()))
 
     def find_python_processes_to_profile(self) -> List[Process]:
         filtered_procs = []
-        for process in pgrep_maps(
-            r"(?:^.+/(?:lib)?python[^/]*$)|(?:^.+/site-packages/.+?$)|(?:^.+/dist-packages/.+?$)"
-        ):
+        for process in find_python_processes():
             try:
                 if process.pid == os.getpid():
                     continue
 
                 cmdline = process.cmdline()
                 if any(item in cmdline for item in self.BLACKLISTED_PYTHON_PROCS):
+                    self.skipped_processes[process.pid] = "blacklisted"
                     continue
 
                 filtered_procs.append(process)
             except Exception:
                 logger.exception(f"Couldn't add pid {process.pid} to list")
 
-        return filtered_procs
+        return filter_runtime_attachable(filtered_procs, self.NAME, self.skipped_processes)
 
     def snapshot(self) -> Mapping[int, Mapping[str, int]]:
+        self.skipped_processes = {}
         processes_to_profile = self.find_python_processes_to_profile()
         if not processes_to_profile:
             return {}
@@ -131,11 +228,13 @@ class PySpyProfiler(PythonProfilerBase):
                     raise
                 except Exception:
                     logger.exception(f"Failed to profile Python process {futures[future]}")
+                    self.skipped_processes[futures[future]] = "profiling failed"
 
         return results
 
 
 class PythonEbpfProfiler(PythonProfilerBase):
+    NAME = "PyPerf"
     PYPERF_RESOURCE = "python/pyperf/PyPerf"
     dump_signal = signal.SIGUSR2
     dump_timeout = 5  # seconds
@@ -147,8 +246,11 @@ class PythonEbpfProfiler(PythonProfilerBase):
         duration: int,
         stop_event: Optional[Event],
         storage_dir: str,
+        annotate_frames: bool = False,
+        line_numbers: bool = False,
     ):
-        super().__init__(frequency, duration, stop_event, storage_dir)
+        # PyPerf always aggregates by function, so 'line_numbers' has no effect on it.
+        super().__init__(frequency, duration, stop_event, storage_dir, annotate_frames, line_numbers)
         self.process = None
         self.output_path = Path(self._storage_dir) / "py.col.dat"
 
@@ -156,7 +258,8 @@ class PythonEbpfProfiler(PythonProfilerBase):
     def _check_missing_headers(cls, stdout) -> bool:
         if "Unable to find kernel headers." in stdout:
             print()
-            print("Unable to find kernel headers. Make sure the package is installed for your distribution.")
+            print("Unable to find kernel headers. Make sure the package is installed for your distribution,")
+            print("or that your kernel has the kheaders module (CONFIG_IKHEADERS) - gProfiler loads it if it's there.")
             print("If you are using Ubuntu, you can install the required package using:")
             print()
             print("    apt install linux-headers-$(uname -r)")
@@ -218,6 +321,15 @@ class PythonEbpfProfiler(PythonProfilerBase):
         else:
             cls._check_output(process, test_path)
 
+    def set_frequency(self, frequency: int) -> None:
+        prev_frequency = self._frequency
+        super().set_frequency(frequency)
+        # PyPerf runs continuously, with a fixed frequency
+        if self.process is not None and self._frequency != prev_frequency:
+            logger.info(f"Restarting PyPerf with frequency {self._frequency}hz")
+            self.stop()
+            self.start()
+
     def start(self):
         logger.info("Starting profiling of Python processes with PyPerf")
         cmd = self.get_pyperf_cmd() + [
@@ -277,7 +389,7 @@ class PythonEbpfProfiler(PythonProfilerBase):
         collapsed_path = self._dump()
         collapsed_text = collapsed_path.read_text()
         collapsed_path.unlink()
-        return parse_many_collapsed(collapsed_text)
+        return {pid: self._annotate(stacks) for pid, stacks in parse_many_collapsed(collapsed_text).items()}
 
     def _terminate(self) -> Optional[int]:
         code = None
@@ -298,13 +410,21 @@ _profiler_class = None
 
 
 def determine_profiler_class(storage_dir: str, stop_event: Event):
+    headers_source = get_kernel_headers_source()
+    missing_headers = None
+    if headers_source is not None:
+        logger.info(f"Python eBPF profiler: using {headers_source}")
+    else:
+        missing_headers = describe_missing_kernel_headers()
+        logger.info(f"Python eBPF profiler: {missing_headers}")
     try:
         PythonEbpfProfiler.test(storage_dir, stop_event)
         return PythonEbpfProfiler
     except Exception as e:
         # Fallback to py-spy
         logger.debug(f"eBPF profiler error: {str(e)}")
-        logger.info("Python eBPF profiler initialization failed. Falling back to py-spy...")
+        reason = f" ({missing_headers})" if missing_headers is not None else ""
+        logger.info(f"Python eBPF profiler initialization failed{reason}. Falling back to py-spy...")
         return PySpyProfiler
 
 
@@ -314,6 +434,8 @@ def get_python_profiler(
     stop_event: Event,
     storage_dir: str,
     reinitialize_profiler: Optional[Callable[[], None]] = None,
+    annotate_frames: bool = False,
+    line_numbers: bool = False,
 ) -> Union[PythonEbpfProfiler, PySpyProfiler]:
     global _reinitialize_profiler
     _reinitialize_profiler = reinitialize_profiler
@@ -321,4 +443,4 @@ def get_python_profiler(
     global _profiler_class
     if _profiler_class is None:
         _profiler_class = determine_profiler_class(storage_dir, stop_event)
-    return _profiler_class(frequency, duration, stop_event, storage_dir)
+    return _profiler_class(frequency, duration, stop_event, storage_dir, annotate_frames, line_numbers)
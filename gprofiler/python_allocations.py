@@ -0,0 +1,337 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+"""
+Sampling of the memory allocations of Python processes, by Python stack.
+
+A uprobe is placed on PyObject_Malloc (through which CPython allocates its objects). Its fetch-args read the
+allocation size and the names of the innermost Python frames, by walking the frames of the current thread state -
+so nothing is injected into the processes, and no native code is built for it. perf samples every Nth hit of the
+uprobes, and each sample is weighted by N times its allocation size, in bytes.
+
+Limitations:
+* The kernel limits the depth of dereferences in fetch-args, so only the innermost MAX_FRAMES frames are read.
+* The offsets of the CPython structs used are of x86_64 builds of CPython 2.7 and 3.5-3.9.
+* A uprobe costs a few microseconds on every hit (not only sampled ones) - allocation-heavy code is slowed down
+  considerably while profiling.
+"""
+import logging
+import os
+import platform
+import re
+from collections import Counter
+from pathlib import Path
+from tempfile import NamedTemporaryFile
+from threading import Event
+from typing import Dict, Iterable, List, Mapping, MutableMapping, NamedTuple, Optional, Set, Tuple
+
+from .elf import PT_LOAD, SHN_UNDEF, ElfFile, ElfSegment
+from .exceptions import ProcessStoppedException, StopEventSetException
+from .merge import annotate_frame
+from .privileges import POST_PROCESSING
+from .python import find_python_processes
+from .safety import filter_runtime_attachable
+from .utils import resolve_proc_root_links, resource_path, run_process
+
+logger = logging.getLogger(__name__)
+
+TRACEFS_PATHS = ["/sys/kernel/tracing", "/sys/kernel/debug/tracing"]
+UPROBE_GROUP = "gprofiler_alloc"
+ALLOCATION_FUNCTION = "PyObject_Malloc"
+# deeper frames would exceed the number of fetch instructions the kernel allows per argument
+MAX_FRAMES = 6
+DEFAULT_SAMPLE_PERIOD = 1000
+# mapped files which may contain the CPython runtime (besides the executable itself)
+LIBPYTHON_REGEX = re.compile(r"/libpython[^/]*\.so[^/]*$")
+
+# "python 1234/1234 gprofiler_alloc:py0: (7f5d03703f10) size=136 n0="leaf" f0="/app/x.py" ... more=0"
+ALLOCATION_SAMPLE_REGEX = re.compile(
+    rf"^\s*(?P<comm>.+?)\s+(?P<pid>\d+)/(?P<tid>\d+)\s+{UPROBE_GROUP}:\w+:\s*\(\w+\)(?P<args>.*)$"
+)
+ARG_REGEX = re.compile(r'(?P<name>\w+)=(?:"(?P<string>[^"]*)"|(?P<value>\S+))')
+
+
+class PythonLayout(NamedTuple):
+    """
+    Offsets of the CPython structs read in order to walk the Python stack of the current thread.
+    """
+
+    version: str
+    # symbol holding the current thread state, and the offset of the pointer in it
+    thread_state_symbol: str
+    thread_state_offset: int
+    frame_offset: int  # PyThreadState.frame
+    back_offset: int  # PyFrameObject.f_back
+    code_offset: int  # PyFrameObject.f_code
+    name_offset: int  # PyCodeObject.co_name
+    filename_offset: int  # PyCodeObject.co_filename
+    string_data_offset: int  # data of (ASCII) str objects
+
+
+# by the symbols that tell the versions apart (checked in this order)
+PYTHON_LAYOUTS: List[Tuple[List[str], PythonLayout]] = [
+    # _PyRuntime.gilstate.tstate_current
+    (["_PyRuntime", "PyFrame_GetCode"], PythonLayout("3.9", "_PyRuntime", 568, 24, 24, 32, 112, 104, 48)),
+    (["_PyRuntime", "PyCode_NewWithPosOnlyArgs"], PythonLayout("3.8", "_PyRuntime", 1368, 24, 24, 32, 112, 104, 48)),
+    (["_PyRuntime"], PythonLayout("3.7", "_PyRuntime", 1480, 24, 24, 32, 104, 96, 48)),
+    (
+        ["_PyThreadState_Current", "PyString_FromString"],
+        PythonLayout("2.7", "_PyThreadState_Current", 0, 16, 24, 32, 88, 80, 36),
+    ),
+    (["_PyThreadState_Current"], PythonLayout("3.5-3.6", "_PyThreadState_Current", 0, 24, 24, 32, 104, 96, 48)),
+]
+# the frames were reworked in 3.10+ (these define _PyRuntime, but with different layouts)
+UNSUPPORTED_PYTHON_SYMBOLS = ["PyIter_Send"]
+
+
+class UprobeTarget(NamedTuple):
+    path: str  # as the kernel should resolve it, e.g via /proc/pid/root
+    function_offset: int  # file offset of ALLOCATION_FUNCTION
+    thread_state_offset: int  # file offset (in uprobe terms, see build_uprobe_args) of the current thread state
+    layout: PythonLayout
+
+
+def detect_python_layout(defined_symbols: Set[str]) -> Optional[PythonLayout]:
+    if any(symbol in defined_symbols for symbol in UNSUPPORTED_PYTHON_SYMBOLS):
+        return None
+    for symbols, layout in PYTHON_LAYOUTS:
+        if all(symbol in defined_symbols for symbol in symbols):
+            return layout
+    return None
+
+
+def _find_text_segment(segments: List[ElfSegment], address: int) -> Optional[ElfSegment]:
+    for segment in segments:
+        if segment.type == PT_LOAD and segment.address <= address < segment.address + segment.memory_size:
+            return segment
+    return None
+
+
+def get_uprobe_target(path: str) -> Optional[UprobeTarget]:
+    """
+    Checks whether an ELF file contains a supported CPython runtime, and finds what the uprobe needs in it.
+    """
+    with open(path, "rb") as f:
+        elf = ElfFile(f)
+        symbols = {symbol.name: symbol.value for symbol in elf.symbols() if symbol.section_index != SHN_UNDEF}
+        segments = elf.segments()
+    if ALLOCATION_FUNCTION not in symbols:
+        return None
+    layout = detect_python_layout(set(symbols))
+    if layout is None:
+        return None
+    text_segment = _find_text_segment(segments, symbols[ALLOCATION_FUNCTION])
+    if text_segment is None:
+        return None
+
+    def _file_offset(address: int) -> int:
+        # uprobes translate "file offsets" via the mapping of the probed code, which works for addresses in other
+        # segments (even .bss) as well, since all segments are loaded with the same bias.
+        return address - text_segment.address + text_segment.offset
+
+    return UprobeTarget(
+        path,
+        _file_offset(symbols[ALLOCATION_FUNCTION]),
+        _file_offset(symbols[layout.thread_state_symbol] + layout.thread_state_offset),
+        layout,
+    )
+
+
+def build_uprobe_args(target: UprobeTarget) -> str:
+    """
+    Builds the fetch-args of the uprobe: "size", the function name & file name of the innermost frames
+    ("n0"/"f0" being the innermost) and "more", which is non-zero if there are deeper frames.
+    """
+    layout = target.layout
+    args = ["size=%di:u64"]  # first argument, by the x86_64 calling convention
+    frame = f"+{layout.frame_offset}(@+{target.thread_state_offset:#x})"
+    for i in range(MAX_FRAMES):
+        code = f"+{layout.code_offset}({frame})"
+        args.append(f"n{i}=+{layout.string_data_offset}(+{layout.name_offset}({code})):string")
+        args.append(f"f{i}=+{layout.string_data_offset}(+{layout.filename_offset}({code})):string")
+        frame = f"+{layout.back_offset}({frame})"
+    args.append(f"more={frame}:u64")
+    return " ".join(args)
+
+
+def parse_allocation_samples(
+    script: str, sample_period: int, annotate_frames: bool = False
+) -> Dict[int, MutableMapping[str, int]]:
+    """
+    Parses the output of "perf script -F comm,pid,tid,event,trace" of the uprobes into collapsed stacks (starting
+    with the process name) weighted by the estimated number of allocated bytes, by pid.
+    """
+    results: Dict[int, MutableMapping[str, int]] = {}
+    for line in script.splitlines():
+        m = ALLOCATION_SAMPLE_REGEX.match(line)
+        if m is None:
+            continue
+        # string args are quoted; failed fetches (past the outermost frame) are "(fault)"
+        strings: Dict[str, Optional[str]] = {}
+        values: Dict[str, Optional[str]] = {}
+        for arg in ARG_REGEX.finditer(m.group("args")):
+            strings[arg.group("name")] = arg.group("string")
+            values[arg.group("name")] = arg.group("value")
+        try:
+            size = int(values["size"] or "", 0)
+        except (KeyError, ValueError):
+            continue
+        frames = []
+        for i in range(MAX_FRAMES):
+            name = strings.get(f"n{i}")
+            if name is None:
+                break
+            frame = f"{name} ({strings.get(f'f{i}') or '?'})"
+            frames.append(annotate_frame(frame, "python") if annotate_frames else frame)
+        if not frames:
+            frames = ["[no Python frames]"]  # e.g during interpreter startup
+        elif len(frames) == MAX_FRAMES and values.get("more") not in (None, "0", "0x0"):
+            # there are deeper frames ("more" is garbage if a fetch before it has failed)
+            frames.append("[truncated]")
+        stack = ";".join([m.group("comm").replace(";", "_")] + list(reversed(frames)))
+        results.setdefault(int(m.group("pid")), Counter())[stack] += size * sample_period
+    return results
+
+
+def find_tracefs() -> Optional[str]:
+    for path in TRACEFS_PATHS:
+        if os.path.exists(os.path.join(path, "uprobe_events")):
+            return path
+    return None
+
+
+def write_uprobe_events(tracefs: str, lines: Iterable[str]) -> None:
+    # not open(..., "a"), which seeks (unsupported by tracefs); and not "w", which would delete all uprobes.
+    fd = os.open(os.path.join(tracefs, "uprobe_events"), os.O_WRONLY | os.O_APPEND)
+    try:
+        # each line is written separately, so errors are reported for the right one.
+        for line in lines:
+            os.write(fd, (line + "\n").encode())
+    finally:
+        os.close(fd)
+
+
+class PythonAllocationsProfiler:
+    def __init__(
+        self,
+        duration: int,
+        stop_event: Event,
+        storage_dir: str,
+        sample_period: int = DEFAULT_SAMPLE_PERIOD,
+        annotate_frames: bool = False,
+    ):
+        logger.info(f"Initializing Python allocations profiler (sampling every {sample_period} allocations)")
+        self._duration = duration
+        self._stop_event = stop_event
+        self._storage_dir = storage_dir
+        self._sample_period = sample_period
+        self._annotate_frames = annotate_frames
+        self._tracefs = find_tracefs()
+
+    def start(self):
+        if platform.machine() != "x86_64":
+            logger.warning("Python allocations profiling is supported on x86_64 only, disabling it")
+            self._tracefs = None
+        elif self._tracefs is None:
+            logger.warning("Python allocations profiling requires tracefs (with uprobes), disabling it")
+        else:
+            # from previous runs that were killed
+            self._remove_uprobes()
+
+    def stop(self):
+        pass
+
+    def __enter__(self):
+        self.start()
+        return self
+
+    def __exit__(self, exc_type, exc_val, exc_tb):
+        self.stop()
+
+    def _write_uprobe_events(self, lines: Iterable[str]) -> None:
+        assert self._tracefs is not None
+        write_uprobe_events(self._tracefs, lines)
+
+    def _remove_uprobes(self) -> None:
+        assert self._tracefs is not None
+        events = Path(os.path.join(self._tracefs, "uprobe_events")).read_text().splitlines()
+        names = [line.split()[0][2:] for line in events if line.startswith(f"p:{UPROBE_GROUP}/")]
+        self._write_uprobe_events(f"-:{name}" for name in names)
+
+    def _find_targets(self) -> List[UprobeTarget]:
+        targets: Dict[Tuple[int, int], Optional[UprobeTarget]] = {}
+        processes = find_python_processes()
+        attachable = {process.pid for process in filter_runtime_attachable(processes, "Python allocations uprobes")}
+        # uprobes trap in all processes running the binary, so binaries of latency-critical processes are skipped.
+        excluded: Set[Tuple[int, int]] = set()
+        for process in processes:
+            try:
+                maps = Path(f"/proc/{process.pid}/maps").read_text()
+                paths = {os.readlink(f"/proc/{process.pid}/exe")}
+            except OSError:
+                continue  # process has exited
+            paths.update(line.split()[-1] for line in maps.splitlines() if LIBPYTHON_REGEX.search(line))
+            for path in paths:
+                try:
+                    host_path = resolve_proc_root_links(f"/proc/{process.pid}/root", path)
+                    stat = os.stat(host_path)
+                    key = (stat.st_dev, stat.st_ino)
+                    if process.pid not in attachable:
+                        excluded.add(key)
+                    elif key not in targets:
+                        targets[key] = get_uprobe_target(host_path)
+                except (OSError, ValueError):
+                    continue  # process has exited, or not an ELF
+                except Exception:
+                    logger.exception(f"Failed to read {path} of process {process.pid}")
+        return [target for key, target in targets.items() if target is not None and key not in excluded]
+
+    def _add_uprobes(self, targets: List[UprobeTarget]) -> List[str]:
+        events = []
+        for i, target in enumerate(targets):
+            event = f"{UPROBE_GROUP}/py{i}"
+            try:
+                self._write_uprobe_events(
+                    [f"p:{event} {target.path}:{target.function_offset:#x} {build_uprobe_args(target)}"]
+                )
+            except OSError as e:
+                logger.warning(f"Failed to add uprobe on {target.path} (Python {target.layout.version}): {e}")
+                continue
+            events.append(event.replace("/", ":"))
+        return events
+
+    def snapshot(self) -> Mapping[int, Mapping[str, int]]:
+        if self._tracefs is None:
+            return {}
+
+        targets = self._find_targets()
+        if not targets:
+            return {}
+        events = self._add_uprobes(targets)
+        try:
+            if not events:
+                return {}
+            with NamedTemporaryFile(dir=self._storage_dir) as record_file:
+                event_args = [arg for event in events for arg in ("-e", event)]
+                try:
+                    run_process(
+                        [resource_path("perf"), "record", "-a", "-c", str(self._sample_period), "-o", record_file.name]
+                        + event_args
+                        + ["--", "sleep", str(self._duration)],
+                        stop_event=self._stop_event,
+                    )
+                except ProcessStoppedException:
+                    raise StopEventSetException
+                script = run_process(
+                    [resource_path("perf"), "script", "-F", "comm,pid,tid,event,trace", "-i", record_file.name],
+                    suppress_log=True,
+                    privileges=POST_PROCESSING,
+                ).stdout.decode(errors="replace")
+        finally:
+            self._remove_uprobes()
+
+        results = parse_allocation_samples(script, self._sample_period, self._annotate_frames)
+        # processes that were found but have exited might have left some samples; keep them anyway.
+        logger.info(f"Collected Python allocation samples of {len(results)} processes")
+        return results
@@ -0,0 +1,145 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+"""
+Safety policy for latency-critical processes. Attaching a runtime profiler to a process stops it for a while
+(e.g async-profiler's attach brings the JVM to a safepoint, py-spy ptraces it, uprobes trap on each hit) - which
+real-time processes can't afford. Processes that are latency-critical are profiled by perf only.
+"""
+import logging
+import os
+from functools import lru_cache
+from pathlib import Path
+from typing import Dict, FrozenSet, Iterable, List, Optional, Tuple
+
+from psutil import NoSuchProcess, Process
+
+logger = logging.getLogger(__name__)
+
+# from linux/sched.h; the os module doesn't define it.
+SCHED_DEADLINE = 6
+REALTIME_POLICIES = {os.SCHED_FIFO: "SCHED_FIFO", os.SCHED_RR: "SCHED_RR", SCHED_DEADLINE: "SCHED_DEADLINE"}
+
+# CPUs isolated with the "isolcpus" boot parameter
+ISOLATED_CPUS_PATH = "/sys/devices/system/cpu/isolated"
+
+_safety_policy_enabled = True
+_critical_cgroups: List[str] = []
+# latency-critical processes each runtime profiler has skipped and their reasons, by profiler - so decisions are
+# logged when they change, not every session.
+_SKIPPED_PROCESSES: Dict[str, Dict[Tuple[int, float], str]] = {}
+
+
+def configure_safety_policy(enabled: bool = True, critical_cgroups: Iterable[str] = ()) -> None:
+    """
+    :param critical_cgroups: cgroup paths whose processes (including those of nested cgroups) are latency-critical,
+                             e.g "/system.slice/trader.service".
+    """
+    global _safety_policy_enabled, _critical_cgroups
+    _safety_policy_enabled = enabled
+    _critical_cgroups = ["/" + cgroup.strip("/") for cgroup in critical_cgroups]
+
+
+def parse_cpu_list(cpu_list: str) -> FrozenSet[int]:
+    """
+    Parses the kernel's format of CPU lists, e.g "2-4,7".
+    """
+    cpus = set()
+    for part in cpu_list.strip().split(","):
+        if not part:
+            continue
+        first, _, last = part.partition("-")
+        cpus.update(range(int(first), int(last or first) + 1))
+    return frozenset(cpus)
+
+
+@lru_cache(maxsize=None)
+def get_isolated_cpus() -> FrozenSet[int]:
+    try:
+        return parse_cpu_list(Path(ISOLATED_CPUS_PATH).read_text())
+    except FileNotFoundError:
+        return frozenset()
+
+
+def _is_in_cgroup(path: str, cgroup: str) -> bool:
+    return cgroup == "/" or path == cgroup or path.startswith(cgroup + "/")
+
+
+def get_critical_cgroup(cgroup: str, critical_cgroups: Iterable[str]) -> Optional[str]:
+    """
+    Finds the critical cgroup containing a process, given the contents of its /proc/pid/cgroup (in any hierarchy).
+    """
+    critical_cgroups = list(critical_cgroups)
+    for line in cgroup.splitlines():
+        try:
+            _, _, path = line.split(":", maxsplit=2)
+        except ValueError:
+            continue
+        for critical_cgroup in critical_cgroups:
+            if _is_in_cgroup(path, critical_cgroup):
+                return critical_cgroup
+    return None
+
+
+def get_latency_critical_reason(pid: int) -> Optional[str]:
+    """
+    :returns: Why the process is latency-critical, or None if it isn't.
+    """
+    if _critical_cgroups:
+        critical_cgroup = get_critical_cgroup(Path(f"/proc/{pid}/cgroup").read_text(), _critical_cgroups)
+        if critical_cgroup is not None:
+            return f"in critical cgroup {critical_cgroup}"
+
+    isolated_cpus = get_isolated_cpus()
+    # a single real-time thread is enough - stopping the process stops it as well.
+    for tid in map(int, os.listdir(f"/proc/{pid}/task")):
+        try:
+            policy = os.sched_getscheduler(tid)
+            affinity = os.sched_getaffinity(tid)
+        except (ProcessLookupError, FileNotFoundError):
+            continue  # thread has exited
+        if policy in REALTIME_POLICIES:
+            return f"thread {tid} is scheduled with {REALTIME_POLICIES[policy]}"
+        if isolated_cpus and affinity <= isolated_cpus:
+            return f"thread {tid} is pinned to isolated CPUs {','.join(map(str, sorted(affinity)))}"
+    return None
+
+
+def filter_runtime_attachable(
+    processes: Iterable[Process], profiler: str, skipped: Optional[Dict[int, str]] = None
+) -> List[Process]:
+    """
+    Filters out the latency-critical processes, which 'profiler' must not attach to.
+    :param skipped: If given, filled with the reasons the filtered processes were skipped, by pid.
+    """
+    processes = list(processes)
+    if not _safety_policy_enabled:
+        return processes
+
+    logged = _SKIPPED_PROCESSES.setdefault(profiler, {})
+    allowed = []
+    live_keys = set()
+    for process in processes:
+        try:
+            key = (process.pid, process.create_time())
+            reason = get_latency_critical_reason(process.pid)
+        except (NoSuchProcess, FileNotFoundError, ProcessLookupError):
+            continue  # process has exited
+        live_keys.add(key)
+        if reason is None:
+            if key in logged:
+                logger.info(f"Process {process.pid} is no longer latency-critical, profiling it with {profiler}")
+                del logged[key]
+            allowed.append(process)
+            continue
+
+        if logged.get(key) != reason:
+            logger.info(f"Process {process.pid} is latency-critical ({reason}), not profiling it with {profiler}")
+            logged[key] = reason
+        if skipped is not None:
+            skipped[process.pid] = f"latency-critical ({reason})"
+
+    for key in [key for key in logged if key not in live_keys]:
+        del logged[key]
+    return allowed
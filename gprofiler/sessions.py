@@ -0,0 +1,171 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+"""
+Multiplexed profiling sessions. The recorders (perf, PyPerf, async-profiler, py-spy) run once per profiling
+interval, at the highest frequency of the active sessions - and their samples are demultiplexed to each session:
+filtered to its processes, downsampled to its frequency, and written to its own outputs.
+
+Besides the session gProfiler is started with, sessions can be submitted on demand ("gprofiler session ..."),
+which places them in SESSIONS_DIR; the running gProfiler picks them up at the start of its next interval.
+"""
+import glob
+import json
+import logging
+import os
+import re
+from typing import Any, Callable, Dict, List, Mapping, NamedTuple, Optional, Sequence, Tuple
+
+from .utils import TEMPORARY_STORAGE_PATH
+
+logger = logging.getLogger(__name__)
+
+SESSIONS_DIR = os.path.join(TEMPORARY_STORAGE_PATH, "sessions")
+DEFAULT_SESSION_NAME = "default"
+SESSION_NAME_REGEX = re.compile(r"^[\w.-]+$")
+
+
+class SessionSpec(NamedTuple):
+    name: str
+    frequency: int
+    # processes to profile, by pid or container ID (or a prefix of it). if neither is given, all processes are.
+    pids: Tuple[int, ...] = ()
+    containers: Tuple[str, ...] = ()
+    output_dir: Optional[str] = None
+    flamegraph: bool = False
+    heatmap: bool = False
+    upload: bool = False
+    # number of profiling intervals to run for; None runs until gProfiler stops.
+    snapshots: Optional[int] = None
+
+    @property
+    def is_scoped(self) -> bool:
+        return bool(self.pids or self.containers)
+
+    def matches(self, pid: int, container_id: Optional[str]) -> bool:
+        if not self.is_scoped:
+            return True
+        return pid in self.pids or (
+            container_id is not None and any(container_id.startswith(container) for container in self.containers)
+        )
+
+    def output_name(self, base: str) -> str:
+        """
+        Names the outputs of sessions apart, e.g "last_profile" -> "last_profile_burst".
+        """
+        return base if self.name == DEFAULT_SESSION_NAME else f"{base}_{self.name}"
+
+
+class RecordedSnapshot(NamedTuple):
+    frequency: int
+    # None if perf has failed
+    perf_samples: Optional[List[Mapping[str, str]]]
+    process_perfs: Mapping[int, Mapping[str, int]]
+    # sampling frequencies of the runtime profilers, by pid
+    process_frequencies: Mapping[int, int]
+    allocations: Mapping[int, Mapping[str, int]]
+    # see inventory.build_inventory
+    inventory: Sequence[Mapping[str, Any]] = ()
+    # advice on the profile quality of JVMs, by pid (see java_advisor)
+    java_advice: Mapping[int, Mapping[str, str]] = {}
+    # samples of JVMs by category, by pid (see java_breakdown)
+    java_breakdowns: Mapping[int, Mapping[str, int]] = {}
+
+
+def spec_to_json(spec: SessionSpec) -> str:
+    return json.dumps(spec._asdict())
+
+
+def spec_from_json(data: str) -> SessionSpec:
+    spec = json.loads(data)
+    return SessionSpec(**{**spec, "pids": tuple(spec.get("pids", ())), "containers": tuple(spec.get("containers", ()))})
+
+
+def submit_session(spec: SessionSpec) -> str:
+    """
+    Submits a session to the running gProfiler.
+    :returns: Path of the submitted session file.
+    """
+    os.makedirs(SESSIONS_DIR, mode=0o700, exist_ok=True)
+    path = os.path.join(SESSIONS_DIR, f"{spec.name}.json")
+    # written under a different name & renamed, so gProfiler never reads partial files.
+    temp_path = path + ".tmp"
+    with open(temp_path, "w") as f:
+        f.write(spec_to_json(spec))
+    os.rename(temp_path, path)
+    return path
+
+
+def collect_submitted_sessions() -> List[SessionSpec]:
+    """
+    Collects (and removes) the sessions submitted since the last call.
+    """
+    try:
+        st = os.stat(SESSIONS_DIR)
+    except FileNotFoundError:
+        return []
+    # sessions decide where we write files, so only root may submit them.
+    if st.st_uid != 0 or st.st_mode & 0o022:
+        logger.warning(f"Ignoring submitted sessions, {SESSIONS_DIR} must be owned & writable only by root")
+        return []
+
+    specs = []
+    for path in sorted(glob.glob(os.path.join(SESSIONS_DIR, "*.json"))):
+        try:
+            with open(path) as f:
+                specs.append(spec_from_json(f.read()))
+        except Exception:
+            logger.exception(f"Failed to read submitted session {path}")
+        finally:
+            os.unlink(path)
+    return specs
+
+
+def downsample_perf_samples(
+    perf_samples: List[Mapping[str, str]], frequency: int, recording_frequency: int
+) -> List[Mapping[str, str]]:
+    """
+    Downsamples perf samples recorded at 'recording_frequency' to 'frequency': perf samples each CPU separately,
+    so the first sample of each CPU in each 1/frequency slot is kept.
+    """
+    if frequency >= recording_frequency:
+        return perf_samples
+    last_slots: Dict[str, int] = {}
+    downsampled = []
+    for sample in perf_samples:
+        # the CPU is printed for system wide recordings; otherwise, threads are sampled separately.
+        key = sample["cpu"] if sample.get("cpu") is not None else sample["tid"]
+        slot = int(float(sample["time"]) * frequency)
+        if last_slots.get(key) != slot:
+            last_slots[key] = slot
+            downsampled.append(sample)
+    return downsampled
+
+
+def demultiplex_snapshot(
+    snapshot: RecordedSnapshot, spec: SessionSpec, get_container_id: Callable[[int], Optional[str]]
+) -> RecordedSnapshot:
+    """
+    Takes the part of a recorded snapshot that belongs to a session.
+    """
+    if spec.is_scoped:
+        pids = {int(sample["pid"]) for sample in snapshot.perf_samples or []}
+        pids.update(snapshot.process_perfs, snapshot.allocations)
+        matching = {pid for pid in pids if spec.matches(pid, get_container_id(pid))}
+        snapshot = snapshot._replace(
+            perf_samples=None
+            if snapshot.perf_samples is None
+            else [sample for sample in snapshot.perf_samples if int(sample["pid"]) in matching],
+            process_perfs={pid: stacks for pid, stacks in snapshot.process_perfs.items() if pid in matching},
+            allocations={pid: stacks for pid, stacks in snapshot.allocations.items() if pid in matching},
+            inventory=[entry for entry in snapshot.inventory if spec.matches(entry["pid"], entry["container"])],
+            java_advice={pid: advice for pid, advice in snapshot.java_advice.items() if pid in matching},
+            java_breakdowns={pid: counts for pid, counts in snapshot.java_breakdowns.items() if pid in matching},
+        )
+
+    if snapshot.perf_samples is not None:
+        snapshot = snapshot._replace(
+            perf_samples=downsample_perf_samples(snapshot.perf_samples, spec.frequency, snapshot.frequency)
+        )
+    return snapshot._replace(frequency=spec.frequency)
@@ -0,0 +1,203 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import html
+import logging
+import os
+import re
+from collections import Counter
+from typing import Iterable, List, Mapping, MutableMapping, Optional, Tuple
+
+import psutil
+
+from .utils import resolve_proc_root_links
+
+logger = logging.getLogger(__name__)
+
+# py-spy (without --function): "fibonacci (/app/fibonacci.py:7)", possibly annotated.
+PYTHON_FRAME_LINE_REGEX = re.compile(r"^(?P<name>.* \((?P<path>/.+?)):(?P<line>\d+)\)(?P<annotation>_\[\w+\])?$")
+# async-profiler (with "lines"): "com/example/Foo$Bar.baz:123_[j]", possibly with a signature after the method name.
+JAVA_FRAME_LINE_REGEX = re.compile(
+    r"^(?P<name>(?P<class>[\w$/.]+)\.[\w$<>]+(?:\(.*\)\S*)?):(?P<line>\d+)(?P<annotation>_\[\w+\])?$"
+)
+
+MAX_FILES_PER_PROCESS = 10
+MAX_SOURCE_FILE_SIZE = 10 * 1024 * 1024
+# lines with less than this percentage of the process' samples (self & total) are not considered hot.
+MIN_HOT_LINE_PERCENTAGE = 1.0
+CONTEXT_LINES = 3
+
+# (source path, line) -> sample count
+LineCounts = MutableMapping[Tuple[str, int], int]
+
+
+def _strip_frame_line_number(frame: str) -> str:
+    m = PYTHON_FRAME_LINE_REGEX.match(frame) or JAVA_FRAME_LINE_REGEX.match(frame)
+    if m is None:
+        return frame
+    suffix = ")" if m.re is PYTHON_FRAME_LINE_REGEX else ""
+    return m.group("name") + suffix + (m.group("annotation") or "")
+
+
+def strip_line_numbers(stacks: Mapping[str, int]) -> Mapping[str, int]:
+    """
+    Removes line numbers from frames, so stacks are aggregated by function again (the way the profilers
+    output them when line numbers are not requested).
+    """
+    stripped: MutableMapping[str, int] = Counter()
+    for stack, count in stacks.items():
+        stripped[";".join(_strip_frame_line_number(frame) for frame in stack.split(";"))] += count
+    return dict(stripped)
+
+
+def _java_class_source_path(class_name: str) -> str:
+    # nested classes reside in the source file of the outermost class.
+    return class_name.replace(".", "/").split("$")[0] + ".java"
+
+
+def _frame_source_line(frame: str) -> Optional[Tuple[str, int]]:
+    m = PYTHON_FRAME_LINE_REGEX.match(frame)
+    if m is not None:
+        return m.group("path"), int(m.group("line"))
+    m = JAVA_FRAME_LINE_REGEX.match(frame)
+    if m is not None:
+        return _java_class_source_path(m.group("class")), int(m.group("line"))
+    return None
+
+
+def get_line_counts(stacks: Mapping[str, int]) -> Tuple[LineCounts, LineCounts]:
+    """
+    :returns: Self counts (the line was executing) and total counts (the line was executing, or was calling
+              a function) of all source lines in 'stacks'.
+    """
+    self_counts: LineCounts = Counter()
+    total_counts: LineCounts = Counter()
+    for stack, count in stacks.items():
+        source_lines = [_frame_source_line(frame) for frame in stack.split(";")]
+        for source_line in set(source_lines):
+            if source_line is not None:
+                total_counts[source_line] += count
+        if source_lines and source_lines[-1] is not None:
+            self_counts[source_lines[-1]] += count
+    return self_counts, total_counts
+
+
+def _find_source_file(pid: int, source_path: str, java_source_paths: Iterable[str]) -> Optional[str]:
+    """
+    Finds a source file in the mount namespace of the process. Python source paths are absolute, Java source
+    paths are relative to one of the Java source directories.
+    """
+    process_root = f"/proc/{pid}/root"
+    if os.path.isabs(source_path):
+        candidates = [source_path]
+    else:
+        candidates = [os.path.join(source_dir, source_path) for source_dir in java_source_paths]
+    for candidate in candidates:
+        path = resolve_proc_root_links(process_root, candidate)
+        if os.path.isfile(path) and os.path.getsize(path) <= MAX_SOURCE_FILE_SIZE:
+            return path
+    return None
+
+
+def _get_hot_ranges(hot_lines: Iterable[int], line_count: int) -> List[Tuple[int, int]]:
+    ranges: List[Tuple[int, int]] = []
+    for line in sorted(hot_lines):
+        start, end = max(line - CONTEXT_LINES, 1), min(line + CONTEXT_LINES, line_count)
+        if ranges and start <= ranges[-1][1] + 1:
+            ranges[-1] = (ranges[-1][0], max(end, ranges[-1][1]))
+        else:
+            ranges.append((start, end))
+    return ranges
+
+
+def _render_file(
+    source_path: str, source: List[str], self_counts: LineCounts, total_counts: LineCounts, samples: int
+) -> List[str]:
+    def percentage(counts: LineCounts, line: int) -> float:
+        return 100 * counts.get((source_path, line), 0) / samples
+
+    hot_lines = [
+        line
+        for (path, line) in total_counts
+        if path == source_path
+        and 0 < line <= len(source)
+        and max(percentage(self_counts, line), percentage(total_counts, line)) >= MIN_HOT_LINE_PERCENTAGE
+    ]
+    if not hot_lines:
+        return []
+
+    parts = [
+        f"<h5><code>{html.escape(source_path)}</code></h5>",
+        '<table class="table table-condensed source-annotation">',
+        "<tr><th>Line</th><th>Self</th><th>Total</th><th>Source</th></tr>",
+    ]
+    for i, (start, end) in enumerate(_get_hot_ranges(hot_lines, len(source))):
+        if i > 0:
+            parts.append('<tr><td colspan="4">...</td></tr>')
+        for line in range(start, end + 1):
+            self_percentage = percentage(self_counts, line)
+            total_percentage = percentage(total_counts, line)
+            # color by the self percentage, which is where time is actually spent
+            alpha = min(self_percentage / 20, 1) if self_percentage > 0 else 0
+            parts.append(
+                f'<tr style="background-color: rgba(255, 0, 0, {alpha:.2f})"><td>{line}</td>'
+                f"<td>{self_percentage:.2f}%</td><td>{total_percentage:.2f}%</td>"
+                f'<td><pre style="margin: 0; padding: 0; border: 0; background: none">'
+                f"{html.escape(source[line - 1])}</pre></td></tr>"
+            )
+    parts.append("</table>")
+    return parts
+
+
+def _render_process(pid: int, stacks: Mapping[str, int], java_source_paths: Iterable[str]) -> List[str]:
+    samples = sum(stacks.values())
+    if samples == 0:
+        return []
+    self_counts, total_counts = get_line_counts(stacks)
+
+    file_totals: MutableMapping[str, int] = Counter()
+    for (path, _), count in self_counts.items():
+        file_totals[path] += count
+
+    parts: List[str] = []
+    for source_path, _ in file_totals.most_common(MAX_FILES_PER_PROCESS):
+        try:
+            host_path = _find_source_file(pid, source_path, java_source_paths)
+            if host_path is None:
+                logger.debug(f"Source file {source_path!r} of process {pid} was not found")
+                continue
+            with open(host_path, errors="replace") as f:
+                source = f.read().splitlines()
+        except OSError:
+            # process might have exited
+            logger.debug(f"Failed to read source file {source_path!r} of process {pid}", exc_info=True)
+            continue
+        parts += _render_file(source_path, source, self_counts, total_counts, samples)
+
+    if not parts:
+        return []
+
+    try:
+        name = psutil.Process(pid).name()
+    except psutil.NoSuchProcess:
+        name = "exited"
+    return [f"<h4>Process {pid} ({html.escape(name)}) - {samples} samples</h4>"] + parts
+
+
+def render_source_annotations(process_perfs: Mapping[int, Mapping[str, int]], java_source_paths: Iterable[str]) -> str:
+    """
+    Renders the hot source lines of profiled processes, with their sample percentages (like "perf annotate", for
+    Python & Java source). Sources are read from the mount namespace of each process - so this must be called
+    while the processes are still alive.
+    """
+    java_source_paths = list(java_source_paths)
+    parts = ["<h3>Hot source lines</h3>"]
+    for pid, stacks in sorted(process_perfs.items()):
+        try:
+            parts += _render_process(pid, stacks, java_source_paths)
+        except Exception:
+            logger.exception(f"Failed to annotate the source of process {pid}")
+    if len(parts) == 1:
+        parts.append("<p>No source lines were found.</p>")
+    return '<div id="source-annotations">\n' + "\n".join(parts) + "\n</div>"
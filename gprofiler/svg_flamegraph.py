@@ -0,0 +1,234 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+"""
+Static SVG flamegraphs in the style of flamegraph.pl - self-contained, so they can be embedded in wikis, tickets and
+emails. Frames have hover titles; the search (highlighting frames matching a regex) requires JavaScript, and can be
+left out.
+"""
+import zlib
+from typing import Dict, Mapping, NamedTuple, Optional, Tuple
+from xml.sax.saxutils import escape, quoteattr
+
+from .merge import parse_one_collapsed
+
+SVG_COLOR_SCHEMES = ["hot", "annotations"]
+
+FRAME_HEIGHT = 16
+FONT_SIZE = 12
+# average width of a character, relative to the font size
+FONT_WIDTH = 0.59
+X_PAD = 10
+# room for the title & subtitle above the frames, and for the details line below them
+TOP_PAD = FONT_SIZE * 4
+BOTTOM_PAD = FONT_SIZE * 2 + 10
+
+# hue of frames by their annotation (see merge.FRAME_ANNOTATIONS), for the "annotations" color scheme
+ANNOTATION_COLORS = {
+    "_[j]": "java",
+    "_[i]": "inlined",
+    "_[0]": "java",
+    "_[1]": "java",
+    "_[k]": "kernel",
+    "_[jit]": "java",
+    "_[p]": "python",
+}
+
+SEARCH_SCRIPT = """
+var details, searchButton, matchedText, svg, searching = false;
+function init(evt) {
+    svg = document.getElementsByTagName("svg")[0];
+    details = document.getElementById("details").firstChild;
+    searchButton = document.getElementById("search");
+    matchedText = document.getElementById("matched");
+}
+window.addEventListener("load", init);
+function s(node) { details.nodeValue = "Function: " + node.getElementsByTagName("title")[0].firstChild.nodeValue; }
+function c() { details.nodeValue = " "; }
+function search_prompt() {
+    if (searching) { reset_search(); return; }
+    var term = prompt("Enter a search term (regexp allowed, eg: ^ext4_)", "");
+    if (term) { search(term); }
+}
+function reset_search() {
+    var rects = svg.getElementsByTagName("rect");
+    for (var i = 0; i < rects.length; i++) {
+        if (rects[i].hasAttribute("data-fill")) { rects[i].setAttribute("fill", rects[i].getAttribute("data-fill")); }
+    }
+    searching = false;
+    searchButton.style.opacity = "0.1";
+    searchButton.firstChild.nodeValue = "Search";
+    matchedText.firstChild.nodeValue = " ";
+}
+function search(term) {
+    var re = new RegExp(term), frames = svg.getElementsByTagName("g"), total = 0, matches = [];
+    for (var i = 0; i < frames.length; i++) {
+        var frame = frames[i], rect = frame.getElementsByTagName("rect")[0];
+        if (rect === undefined || !frame.hasAttribute("data-name")) { continue; }
+        var width = parseFloat(rect.getAttribute("width")), x = parseFloat(rect.getAttribute("x"));
+        // the root frame is the first one
+        if (total === 0) { total = width; }
+        if (re.test(frame.getAttribute("data-name"))) {
+            rect.setAttribute("fill", "rgb(230,0,230)");
+            matches.push([x, width]);
+        }
+    }
+    // count each matched range once, even if nested frames match as well
+    matches.sort(function (a, b) { return a[0] - b[0] || b[1] - a[1]; });
+    var matched = 0, end = -1;
+    for (var j = 0; j < matches.length; j++) {
+        if (matches[j][0] >= end) { matched += matches[j][1]; end = matches[j][0] + matches[j][1]; }
+    }
+    searching = true;
+    searchButton.style.opacity = "1.0";
+    searchButton.firstChild.nodeValue = "Reset Search";
+    matchedText.firstChild.nodeValue = total ? "Matched: " + (100 * matched / total).toFixed(1) + "%" : " ";
+}
+"""
+
+
+class SvgOptions(NamedTuple):
+    # width of the image, in pixels
+    width: int = 1200
+    # frames narrower than this (in pixels) are omitted
+    min_width: float = 0.1
+    colors: str = "hot"
+    title: str = "Flame Graph"
+    search: bool = True
+
+
+class _Node:
+    def __init__(self, name: str):
+        self.name = name
+        self.value = 0
+        self.children: Dict[str, "_Node"] = {}
+
+
+def _build_tree(stacks: Mapping[str, int]) -> _Node:
+    root = _Node("all")
+    for stack, count in stacks.items():
+        if count <= 0:
+            continue
+        node = root
+        node.value += count
+        for frame in stack.split(";"):
+            node = node.children.setdefault(frame, _Node(frame))
+            node.value += count
+    return root
+
+
+def _hash_fractions(name: str) -> Tuple[float, float, float]:
+    """
+    Deterministic "random" fractions for the color of a frame - so frames keep their colors across flamegraphs.
+    """
+    h = zlib.crc32(name.encode())
+    return (h & 0xFF) / 255, ((h >> 8) & 0xFF) / 255, ((h >> 16) & 0xFF) / 255
+
+
+def frame_color(name: str, colors: str = "hot") -> str:
+    v1, v2, v3 = _hash_fractions(name)
+    kind = "native"
+    if colors == "annotations":
+        kind = next((kind for suffix, kind in ANNOTATION_COLORS.items() if name.endswith(suffix)), "native")
+    if kind == "java":
+        r, g, b = 50 + 60 * v3, 200 + 55 * v1, 50 + 60 * v3
+    elif kind == "inlined":
+        r, g, b = 50 + 60 * v3, 200 + 55 * v1, 200 + 55 * v1
+    elif kind == "kernel":
+        r, g, b = 200 + 55 * v3, 150 + 50 * v1, 0 + 20 * v2
+    elif kind == "python":
+        r, g, b = 80 + 60 * v3, 130 + 60 * v1, 200 + 55 * v2
+    else:
+        # flamegraph.pl's "hot" palette
+        r, g, b = 205 + 50 * v3, 0 + 230 * v1, 0 + 55 * v2
+    return f"rgb({int(r)},{int(g)},{int(b)})"
+
+
+def _fit_text(name: str, width: float) -> Optional[str]:
+    chars = int(width / (FONT_SIZE * FONT_WIDTH))
+    if chars < 3:
+        return None
+    return name if len(name) <= chars else name[: chars - 2] + ".."
+
+
+def _max_depth(root: _Node, scale: float, min_width: float) -> int:
+    # iterative - stacks (of Java, especially) may be deeper than the recursion limit.
+    max_depth = 0
+    pending = [(root, 1)]
+    while pending:
+        node, depth = pending.pop()
+        max_depth = max(max_depth, depth)
+        pending.extend((child, depth + 1) for child in node.children.values() if child.value * scale >= min_width)
+    return max_depth
+
+
+def render_svg_flamegraph(collapsed: str, options: SvgOptions = SvgOptions(), subtitle: str = "") -> str:
+    """
+    Renders a flamegraph of collapsed stacks (comment lines, like the metadata line, are ignored) as an SVG.
+    """
+    root = _build_tree(parse_one_collapsed(collapsed))
+    scale = (options.width - 2 * X_PAD) / root.value if root.value else 0.0
+    depth = _max_depth(root, scale, options.min_width) if root.value else 0
+    height = depth * FRAME_HEIGHT + TOP_PAD + BOTTOM_PAD
+
+    lines = [
+        '<?xml version="1.0" standalone="no"?>',
+        f'<svg version="1.1" width="{options.width}" height="{height}" viewBox="0 0 {options.width} {height}"'
+        ' xmlns="http://www.w3.org/2000/svg">',
+        "<style>text { font-family: Verdana, sans-serif; } g:hover rect { stroke: black; stroke-width: 0.5; }"
+        " #search { cursor: pointer; }</style>",
+        '<defs><linearGradient id="background" y1="0" y2="1" x1="0" x2="0">'
+        '<stop stop-color="#eeeeee" offset="5%"/><stop stop-color="#eeeeb0" offset="95%"/></linearGradient></defs>',
+        f'<rect x="0" y="0" width="{options.width}" height="{height}" fill="url(#background)"/>',
+        f'<text x="{options.width / 2}" y="{FONT_SIZE * 2}" font-size="{FONT_SIZE + 5}" text-anchor="middle">'
+        f"{escape(options.title)}</text>",
+        f'<text x="{options.width / 2}" y="{FONT_SIZE * 3 + 2}" font-size="{FONT_SIZE}" fill="#a0a0a0"'
+        f' text-anchor="middle">{escape(subtitle) or " "}</text>',
+        f'<text id="details" x="{X_PAD}" y="{height - FONT_SIZE + 2}" font-size="{FONT_SIZE}"> </text>',
+    ]
+    if options.search:
+        lines.append(f"<script><![CDATA[{SEARCH_SCRIPT}]]></script>")
+        lines.append(
+            f'<text id="search" x="{options.width - X_PAD}" y="{FONT_SIZE * 2}" font-size="{FONT_SIZE}"'
+            ' text-anchor="end" opacity="0.1" onclick="search_prompt()">Search</text>'
+        )
+        lines.append(
+            f'<text id="matched" x="{options.width - X_PAD}" y="{height - FONT_SIZE + 2}" font-size="{FONT_SIZE}"'
+            ' text-anchor="end"> </text>'
+        )
+
+    def _render_frame(node: _Node, x: float, width: float, level: int) -> None:
+        # the root is at the bottom
+        y = height - BOTTOM_PAD - (level + 1) * FRAME_HEIGHT
+        color = frame_color(node.name, options.colors) if level > 0 else "rgb(240,130,60)"
+        title = f"{node.name} ({node.value:,} samples, {100 * node.value / root.value:.2f}%)"
+        events = ' onmouseover="s(this)" onmouseout="c()"' if options.search else ""
+        lines.append(f"<g data-name={quoteattr(node.name)}{events}><title>{escape(title)}</title>")
+        lines.append(
+            f'<rect x="{x:.1f}" y="{y}" width="{width:.1f}" height="{FRAME_HEIGHT - 1}" fill="{color}"'
+            f' data-fill="{color}" rx="2" ry="2"/>'
+        )
+        text = _fit_text(node.name, width)
+        if text is not None:
+            lines.append(
+                f'<text x="{x + 3:.1f}" y="{y + FRAME_HEIGHT - 4}" font-size="{FONT_SIZE}">{escape(text)}</text>'
+            )
+        lines.append("</g>")
+
+    if root.value:
+        # depth-first, children sorted by name - iterative, like _max_depth.
+        pending = [(root, float(X_PAD), 0)]
+        while pending:
+            node, x, level = pending.pop()
+            width = node.value * scale
+            if width < options.min_width:
+                continue
+            _render_frame(node, x, width, level)
+            children = []
+            for child in sorted(node.children.values(), key=lambda child: child.name):
+                children.append((child, x, level + 1))
+                x += child.value * scale
+            pending.extend(reversed(children))
+    lines.append("</svg>")
+    return "\n".join(lines)
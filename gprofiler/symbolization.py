@@ -0,0 +1,285 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+"""
+Deferred symbolization: instead of symbolizing native frames on the profiled host (which costs CPU, and requires
+debug info to be installed there), frames are emitted as build ID + file offset pairs, and are resolved later
+against a symbol store - a set of directories containing the (debug) ELF files, indexed by their build IDs.
+"""
+import bisect
+import logging
+import os
+import re
+from collections import Counter
+from pathlib import Path
+from typing import Dict, Iterable, Iterator, List, Mapping, MutableMapping, NamedTuple, Optional, Tuple
+
+from .elf import SHN_UNDEF, STT_FUNC, ElfFile, ElfSegment, offset_to_address
+from .merge import PERF_JIT_DSO_REGEX
+from .utils import resolve_proc_root_links
+
+logger = logging.getLogger(__name__)
+
+# "libc-2.31.so@<build id>:0x9faff", possibly annotated.
+DEFERRED_FRAME_FORMAT = "{name}@{build_id}:0x{offset:x}"
+DEFERRED_FRAME_REGEX = re.compile(
+    r"^(?P<name>[^;@]*)@(?P<build_id>[0-9a-f]+):0x(?P<offset>[0-9a-f]+)(?P<annotation>_\[\w+\])?$"
+)
+
+# "perf script" frames without the symbol field: "7fe48f00faff (/lib/x86_64-linux-gnu/libc-2.31.so)"
+RAW_FRAME_REGEX = re.compile(r"^\s*(?P<ip>[0-9a-f]+) \((?P<dso>.*)\)$")
+# 7f2b2b1cd000-7f2b2b1f2000 r-xp 00025000 fd:01 1051 /usr/lib/x86_64-linux-gnu/libc-2.31.so
+MAPS_LINE_REGEX = re.compile(
+    r"^(?P<start>[0-9a-f]+)-(?P<end>[0-9a-f]+) \S+ (?P<offset>[0-9a-f]+) \S+ \d+\s*(?P<path>.*)$"
+)
+
+# addresses from here on belong to the kernel (on all 64-bit architectures we run on)
+KERNEL_ADDRESS_START = 0x8000_0000_0000_0000
+
+# (st_dev, st_ino, st_mtime_ns) of mapped files -> their build ID
+_BUILD_IDS_CACHE: Dict[Tuple[int, int, int], Optional[str]] = {}
+
+
+class _Mapping(NamedTuple):
+    start: int
+    end: int
+    offset: int
+    path: str
+
+
+class _SymbolTable:
+    """
+    Sorted (address, name) pairs, looked up by the closest preceding address.
+    """
+
+    def __init__(self, symbols: Iterable[Tuple[int, int, str]]):
+        """
+        :param symbols: (address, size, name) triplets. A size of 0 means "unknown", and such symbols cover
+                        everything up to the next symbol.
+        """
+        self._symbols = sorted(symbols)
+        self._addresses = [address for address, _, _ in self._symbols]
+
+    def lookup(self, address: int) -> Optional[str]:
+        i = bisect.bisect_right(self._addresses, address) - 1
+        if i < 0:
+            return None
+        symbol_address, size, name = self._symbols[i]
+        if size != 0 and address >= symbol_address + size:
+            return None
+        return name
+
+
+def _read_kallsyms() -> _SymbolTable:
+    symbols = []
+    for line in Path("/proc/kallsyms").read_text().splitlines():
+        address, _, name = line.split(maxsplit=3)[:3]
+        symbols.append((int(address, 16), 0, name))
+    return _SymbolTable(symbols)
+
+
+def _read_perf_map(path: str) -> _SymbolTable:
+    # "<start> <size> <name>", all in hex - see tools/perf/Documentation/jit-interface.txt in the kernel.
+    symbols = []
+    for line in Path(path).read_text(errors="replace").splitlines():
+        try:
+            start, size, name = line.split(" ", maxsplit=2)
+            symbols.append((int(start, 16), int(size, 16), name))
+        except ValueError:
+            continue
+    return _SymbolTable(symbols)
+
+
+def get_build_id(path: str) -> Optional[str]:
+    stat = os.stat(path)
+    key = (stat.st_dev, stat.st_ino, stat.st_mtime_ns)
+    if key not in _BUILD_IDS_CACHE:
+        try:
+            with open(path, "rb") as f:
+                _BUILD_IDS_CACHE[key] = ElfFile(f).build_id()
+        except ValueError:
+            _BUILD_IDS_CACHE[key] = None  # not an ELF
+    return _BUILD_IDS_CACHE[key]
+
+
+class DeferredFramesResolver:
+    """
+    Converts the raw stacks of "perf script" (addresses and DSOs only) to regular "perf script" stacks, where
+    frames of ELF files carry their build ID and file offset instead of a symbol name.
+    Kernel and JIT frames are still symbolized here: their symbols are only available on this host, and are
+    cheap to resolve.
+
+    Mappings are read from /proc when a process is first seen, so frames of processes which have exited before
+    that are left unknown.
+    """
+
+    def __init__(self):
+        self._kallsyms: Optional[_SymbolTable] = None
+        self._perf_maps: Dict[Tuple[int, str], Optional[_SymbolTable]] = {}
+        self._mappings: Dict[int, List[_Mapping]] = {}
+        self._build_ids: Dict[Tuple[int, int], Optional[str]] = {}
+
+    def _get_kallsyms(self) -> _SymbolTable:
+        if self._kallsyms is None:
+            self._kallsyms = _read_kallsyms()
+        return self._kallsyms
+
+    def _get_perf_map(self, pid: int, dso: str) -> Optional[_SymbolTable]:
+        key = (pid, dso)
+        if key not in self._perf_maps:
+            try:
+                self._perf_maps[key] = _read_perf_map(resolve_proc_root_links(f"/proc/{pid}/root", dso))
+            except OSError:
+                self._perf_maps[key] = None
+        return self._perf_maps[key]
+
+    def _get_mappings(self, pid: int) -> List[_Mapping]:
+        if pid not in self._mappings:
+            mappings = []
+            try:
+                maps = Path(f"/proc/{pid}/maps").read_text()
+            except OSError:
+                maps = ""  # process has exited
+            for line in maps.splitlines():
+                m = MAPS_LINE_REGEX.match(line)
+                if m is not None and m.group("path").startswith("/"):
+                    start, end, offset = (int(m.group(g), 16) for g in ("start", "end", "offset"))
+                    mappings.append(_Mapping(start, end, offset, m.group("path")))
+            self._mappings[pid] = sorted(mappings, key=lambda mapping: mapping.start)
+        return self._mappings[pid]
+
+    def _find_mapping(self, pid: int, ip: int) -> Optional[_Mapping]:
+        mappings = self._get_mappings(pid)
+        i = bisect.bisect_right([mapping.start for mapping in mappings], ip) - 1
+        if i >= 0 and ip < mappings[i].end:
+            return mappings[i]
+        return None
+
+    def _get_build_id(self, pid: int, mapping: _Mapping) -> Optional[str]:
+        key = (pid, mapping.start)
+        if key not in self._build_ids:
+            # map_files works for deleted files & files in other mount namespaces alike.
+            paths = [f"/proc/{pid}/map_files/{mapping.start:x}-{mapping.end:x}"]
+            if not mapping.path.endswith(" (deleted)"):
+                paths.append(resolve_proc_root_links(f"/proc/{pid}/root", mapping.path))
+            self._build_ids[key] = None
+            for path in paths:
+                try:
+                    self._build_ids[key] = get_build_id(path)
+                    break
+                except OSError:
+                    continue
+        return self._build_ids[key]
+
+    def _resolve_frame(self, pid: int, ip: int, dso: str) -> str:
+        if ip >= KERNEL_ADDRESS_START:
+            return self._get_kallsyms().lookup(ip) or "[unknown]"
+
+        if PERF_JIT_DSO_REGEX.match(dso):
+            perf_map = self._get_perf_map(pid, dso)
+            return (perf_map.lookup(ip) if perf_map is not None else None) or "[unknown]"
+
+        mapping = self._find_mapping(pid, ip)
+        if mapping is None:
+            return "[unknown]"
+        build_id = self._get_build_id(pid, mapping)
+        if build_id is None:
+            return "[unknown]"
+        name = os.path.basename(mapping.path.replace(" (deleted)", ""))
+        return DEFERRED_FRAME_FORMAT.format(name=name, build_id=build_id, offset=ip - mapping.start + mapping.offset)
+
+    def resolve_stack(self, pid: int, stack: str) -> str:
+        lines = []
+        for line in stack.splitlines():
+            m = RAW_FRAME_REGEX.match(line)
+            assert m is not None, f"bad line: {line}"
+            ip, dso = int(m.group("ip"), 16), m.group("dso")
+            lines.append(f"\t{ip:x} {self._resolve_frame(pid, ip, dso)} ({dso})")
+        return "\n".join(lines)
+
+    def resolve_samples(self, samples: Iterable[MutableMapping[str, str]]) -> Iterator[MutableMapping[str, str]]:
+        for sample in samples:
+            if sample["stack"] is not None:
+                try:
+                    sample["stack"] = self.resolve_stack(int(sample["pid"]), sample["stack"])
+                except Exception:
+                    logger.exception(f"Error resolving sample: {sample}")
+                    continue
+            yield sample
+
+
+class Symbolizer:
+    """
+    Resolves deferred frames against a symbol store.
+    """
+
+    def __init__(self, symbols_dirs: Iterable[str]):
+        self._files = self._index(symbols_dirs)
+        self._tables: Dict[str, Optional[Tuple[List[ElfSegment], _SymbolTable]]] = {}
+
+    @staticmethod
+    def _index(symbols_dirs: Iterable[str]) -> Mapping[str, str]:
+        files: Dict[str, str] = {}
+        for symbols_dir in symbols_dirs:
+            for root, _, filenames in os.walk(symbols_dir):
+                for filename in filenames:
+                    path = os.path.join(root, filename)
+                    try:
+                        build_id = get_build_id(path)
+                    except OSError:
+                        continue
+                    if build_id is not None:
+                        # prefer files with full symbol tables (i.e debug files) over stripped ones
+                        files.setdefault(build_id, path)
+                        if filename.endswith(".debug"):
+                            files[build_id] = path
+        logger.info(f"Indexed {len(files)} ELF files with build IDs")
+        return files
+
+    def _get_table(self, build_id: str) -> Optional[Tuple[List[ElfSegment], _SymbolTable]]:
+        if build_id not in self._tables:
+            path = self._files.get(build_id)
+            if path is None:
+                self._tables[build_id] = None
+            else:
+                with open(path, "rb") as f:
+                    elf = ElfFile(f)
+                    table = _SymbolTable(
+                        (symbol.value, symbol.size, symbol.name)
+                        for symbol in elf.symbols()
+                        if symbol.type == STT_FUNC and symbol.section_index != SHN_UNDEF and symbol.value != 0
+                    )
+                    self._tables[build_id] = (elf.segments(), table)
+        return self._tables[build_id]
+
+    def symbolize_frame(self, frame: str) -> str:
+        m = DEFERRED_FRAME_REGEX.match(frame)
+        if m is None:
+            return frame
+        table = self._get_table(m.group("build_id"))
+        if table is None:
+            return frame  # not in the store - keep it, so it can be symbolized later.
+        segments, symbols = table
+        address = offset_to_address(segments, int(m.group("offset"), 16))
+        symbol = symbols.lookup(address) if address is not None else None
+        if symbol is None:
+            return f"[{m.group('name')}]"  # like perf does, for unknown symbols
+        return symbol + (m.group("annotation") or "")
+
+    def symbolize_collapsed(self, collapsed: str) -> str:
+        """
+        Symbolizes a collapsed stacks file. Stacks which are identical after symbolization are merged; comment
+        lines are kept as is.
+        """
+        comments = []
+        stacks: MutableMapping[str, int] = Counter()
+        for line in collapsed.splitlines():
+            if line.startswith("#"):
+                comments.append(line)
+                continue
+            if line.strip() == "":
+                continue
+            stack, _, count = line.rpartition(" ")
+            stacks[";".join(self.symbolize_frame(frame) for frame in stack.split(";"))] += int(count)
+        return "\n".join(comments + [f"{stack} {count}" for stack, count in stacks.items()])
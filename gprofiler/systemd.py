@@ -0,0 +1,52 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import re
+from pathlib import Path
+from typing import Optional
+
+SYSTEMD_UNIT_LABEL = "systemd_unit"
+
+SYSTEMD_SLICES = ["system.slice", "user.slice"]
+# the units processes run in
+SYSTEMD_UNIT_SUFFIXES = (".service", ".scope")
+# scopes created by container runtimes (with the systemd cgroup driver) - these are containers, not services.
+CONTAINER_SCOPE_REGEX = re.compile(r"^(?:docker|cri-containerd|crio|libpod)-[0-9a-f]+\.scope$")
+
+
+def get_systemd_unit_from_cgroup(cgroup: str) -> Optional[str]:
+    """
+    Finds the systemd unit in the contents of /proc/pid/cgroup - that's the innermost service / scope of the
+    systemd hierarchy (the unified hierarchy in cgroup v2, "name=systemd" in cgroup v1), e.g
+    "0::/system.slice/nginx.service" -> "nginx.service". Units may contain slices & units of their own (like the
+    user manager, user@1000.service), and cgroups delegated to the unit (e.g "nginx.service/worker") - the latter
+    are not managed by systemd, and belong to the unit.
+    """
+    for line in cgroup.splitlines():
+        try:
+            _, controllers, path = line.split(":", maxsplit=2)
+        except ValueError:
+            continue
+        if controllers not in ("", "name=systemd"):
+            continue
+        parts = [part for part in path.split("/") if part]
+        if not parts or parts[0] not in SYSTEMD_SLICES:
+            return None
+        unit = None
+        for part in parts:
+            if part.endswith(SYSTEMD_UNIT_SUFFIXES):
+                unit = part
+            elif not part.endswith(".slice"):
+                break  # a delegated cgroup
+        if unit is None or CONTAINER_SCOPE_REGEX.match(unit):
+            return None
+        return unit
+    return None
+
+
+def get_process_systemd_unit(pid: int) -> Optional[str]:
+    try:
+        return get_systemd_unit_from_cgroup(Path(f"/proc/{pid}/cgroup").read_text())
+    except FileNotFoundError:
+        return None  # process has exited
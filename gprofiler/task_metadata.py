@@ -0,0 +1,152 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+"""
+Enrichment of processes running as ECS tasks or Nomad allocations, with the metadata of their task.
+Both orchestrators tell the processes where to find it via their environment:
+* ECS sets ECS_CONTAINER_METADATA_URI_V4 (or ECS_CONTAINER_METADATA_URI, for v3) to the task metadata endpoint,
+  which is reachable from the network namespace of the task.
+* Nomad sets NOMAD_* variables with the job, group & task names (the "allocation environment").
+"""
+import logging
+import time
+from typing import Dict, Iterable, List, Mapping, Optional, Set, Tuple
+
+import psutil
+import requests
+
+from .utils import run_in_ns
+from .versions import get_process_environment
+
+logger = logging.getLogger(__name__)
+
+ECS_METADATA_URI_ENV_VARS = ["ECS_CONTAINER_METADATA_URI_V4", "ECS_CONTAINER_METADATA_URI"]
+ECS_METADATA_TIMEOUT = 2  # seconds
+# after a failed fetch, the endpoint isn't tried again for this long - doubled on each consecutive failure, so an
+# endpoint that's down doesn't stall every snapshot.
+ECS_METADATA_RETRY_BACKOFF = 30  # seconds
+ECS_METADATA_MAX_RETRY_BACKOFF = 600  # seconds
+
+# label -> field of the task metadata response
+ECS_TASK_LABELS = {"ecs_cluster": "Cluster", "ecs_task_family": "Family", "ecs_task_revision": "Revision"}
+# label -> environment variable
+NOMAD_TASK_LABELS = {
+    "nomad_namespace": "NOMAD_NAMESPACE",
+    "nomad_job": "NOMAD_JOB_NAME",
+    "nomad_group": "NOMAD_GROUP_NAME",
+    "nomad_task": "NOMAD_TASK_NAME",
+    "nomad_alloc_id": "NOMAD_ALLOC_ID",
+}
+
+# (pid, process creation time) -> task labels
+_PROCESS_TASK_LABELS_CACHE: Dict[Tuple[int, float], Mapping[str, str]] = {}
+# ECS metadata URI -> task labels. The URI is unique per container.
+_ECS_TASK_LABELS_CACHE: Dict[str, Mapping[str, str]] = {}
+# ECS metadata URI -> (consecutive failed fetches, monotonic time to try again)
+_ECS_FETCH_FAILURES: Dict[str, Tuple[int, float]] = {}
+
+
+def _fetch_ecs_task_metadata(pid: int, metadata_uri: str) -> Dict:
+    result: List[Dict] = []
+    errors: List[Exception] = []
+
+    def _fetch() -> None:
+        # exceptions don't propagate out of run_in_ns' thread, so pass them over.
+        try:
+            response = requests.get(f"{metadata_uri.rstrip('/')}/task", timeout=ECS_METADATA_TIMEOUT)
+            response.raise_for_status()
+            result.append(response.json())
+        except Exception as e:
+            errors.append(e)
+
+    # the endpoint is reachable only from the network namespace of the task (in "awsvpc" mode).
+    run_in_ns(["net"], _fetch, target_pid=pid)
+    if errors:
+        raise errors[0]
+    if not result:
+        raise Exception(f"Failed to fetch the ECS task metadata from {metadata_uri}")
+    return result[0]
+
+
+def get_ecs_task_labels(pid: int, env: Mapping[str, str]) -> Optional[Mapping[str, str]]:
+    """
+    :returns: The labels of the ECS task of the process, or None if its task metadata couldn't be fetched (now, or
+              in the last backoff period).
+    """
+    metadata_uri = next((env[var] for var in ECS_METADATA_URI_ENV_VARS if env.get(var)), None)
+    if metadata_uri is None:
+        return {}
+
+    if metadata_uri not in _ECS_TASK_LABELS_CACHE:
+        failures, retry_time = _ECS_FETCH_FAILURES.get(metadata_uri, (0, 0.0))
+        if time.monotonic() < retry_time:
+            return None
+        try:
+            metadata = _fetch_ecs_task_metadata(pid, metadata_uri)
+        except Exception:
+            logger.debug(f"Failed to fetch the ECS task metadata of process {pid}", exc_info=True)
+            backoff = min(ECS_METADATA_RETRY_BACKOFF * 2 ** failures, ECS_METADATA_MAX_RETRY_BACKOFF)
+            _ECS_FETCH_FAILURES[metadata_uri] = (failures + 1, time.monotonic() + backoff)
+            return None
+        _ECS_FETCH_FAILURES.pop(metadata_uri, None)
+        labels = {label: str(metadata[field]) for label, field in ECS_TASK_LABELS.items() if metadata.get(field)}
+        if "ecs_cluster" in labels:
+            # the cluster may be given as an ARN, "arn:aws:ecs:<region>:<account>:cluster/<name>"
+            labels["ecs_cluster"] = labels["ecs_cluster"].rsplit("/", maxsplit=1)[-1]
+        _ECS_TASK_LABELS_CACHE[metadata_uri] = labels
+    return _ECS_TASK_LABELS_CACHE[metadata_uri]
+
+
+def get_nomad_task_labels(env: Mapping[str, str]) -> Mapping[str, str]:
+    return {label: env[var] for label, var in NOMAD_TASK_LABELS.items() if env.get(var)}
+
+
+def get_process_task_labels(pid: int) -> Mapping[str, str]:
+    try:
+        key = (pid, psutil.Process(pid).create_time())
+        if key not in _PROCESS_TASK_LABELS_CACHE:
+            env = get_process_environment(pid)
+            ecs_labels = get_ecs_task_labels(pid, env)
+            labels = {**(ecs_labels or {}), **get_nomad_task_labels(env)}
+            if ecs_labels is None:
+                return labels  # not cached, so the ECS task metadata is tried again after the backoff
+            _PROCESS_TASK_LABELS_CACHE[key] = labels
+        return _PROCESS_TASK_LABELS_CACHE[key]
+    except (psutil.NoSuchProcess, FileNotFoundError, ProcessLookupError):
+        return {}  # process has exited
+    except (psutil.AccessDenied, PermissionError):
+        return {}  # kernel threads
+
+
+def get_processes_task_labels(pids: Iterable[int]) -> Dict[int, Mapping[str, str]]:
+    """
+    Gets the task labels of all given processes, omitting processes which are not part of ECS tasks or Nomad
+    allocations.
+    """
+    labels = {}
+    for pid in set(pids):
+        process_labels = get_process_task_labels(pid)
+        if process_labels:
+            labels[pid] = process_labels
+    return labels
+
+
+def evict_task_labels_cache(live_pids: Set[int]) -> None:
+    """
+    Forgets processes that are gone.
+    """
+    for key in [key for key in _PROCESS_TASK_LABELS_CACHE if key[0] not in live_pids]:
+        del _PROCESS_TASK_LABELS_CACHE[key]
+
+
+def task_frame(labels: Mapping[str, str]) -> Optional[str]:
+    """
+    Formats the task of a process as a root frame: "[<family>:<revision>]" for ECS tasks,
+    "[<job>/<group>/<task>]" for Nomad allocations.
+    """
+    if "ecs_task_family" in labels:
+        return f"[{labels['ecs_task_family']}:{labels.get('ecs_task_revision', '?')}]"
+    if "nomad_job" in labels:
+        return f"[{labels['nomad_job']}/{labels.get('nomad_group', '?')}/{labels.get('nomad_task', '?')}]"
+    return None
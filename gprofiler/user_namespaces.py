@@ -0,0 +1,89 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+"""
+Ownership of files we create for processes in other user namespaces (e.g the async-profiler DSO & output files of
+JVMs in containers with remapped users). Files owned by our (host) root are owned by an unmapped ID in such
+namespaces - they appear as owned by "nobody", and some runtimes refuse them. So we give them to the IDs that the
+namespace does map, found in /proc/<pid>/uid_map & gid_map.
+"""
+from pathlib import Path
+from typing import List, NamedTuple, Optional, Tuple
+
+from .utils import is_same_ns
+
+
+class IdMapping(NamedTuple):
+    # first ID inside the namespace
+    inside: int
+    # first ID in the namespace of the reader of the map (ours)
+    outside: int
+    count: int
+
+
+def parse_id_map(id_map: str) -> List[IdMapping]:
+    """
+    Parses the contents of /proc/<pid>/uid_map or gid_map - lines of "<inside> <outside> <count>".
+    """
+    mappings = []
+    for line in id_map.splitlines():
+        if line.strip():
+            inside, outside, count = (int(field) for field in line.split())
+            mappings.append(IdMapping(inside, outside, count))
+    return mappings
+
+
+def id_to_outside(mappings: List[IdMapping], inside_id: int) -> Optional[int]:
+    for mapping in mappings:
+        if mapping.inside <= inside_id < mapping.inside + mapping.count:
+            return mapping.outside + (inside_id - mapping.inside)
+    return None
+
+
+def id_to_inside(mappings: List[IdMapping], outside_id: int) -> Optional[int]:
+    for mapping in mappings:
+        if mapping.outside <= outside_id < mapping.outside + mapping.count:
+            return mapping.inside + (outside_id - mapping.outside)
+    return None
+
+
+def _get_process_ids(pid: int) -> Tuple[int, int]:
+    # effective IDs, as seen from our namespace
+    uid = gid = None
+    for line in Path(f"/proc/{pid}/status").read_text().splitlines():
+        if line.startswith("Uid:"):
+            uid = int(line.split()[2])
+        elif line.startswith("Gid:"):
+            gid = int(line.split()[2])
+    assert uid is not None and gid is not None, f"no Uid/Gid in /proc/{pid}/status"
+    return uid, gid
+
+
+def choose_files_owner(
+    uid_map: List[IdMapping], gid_map: List[IdMapping], process_ids: Tuple[int, int]
+) -> Optional[Tuple[int, int]]:
+    """
+    Chooses the (outside) IDs to own files created for a process in a user namespace with the given mappings.
+    :returns: None if our root is mapped in the namespace (and no chown is needed). Otherwise the IDs of root of the
+              namespace, if it's mapped, and if not - the IDs of the process itself (which are surely mapped).
+    """
+    if id_to_inside(uid_map, 0) is not None and id_to_inside(gid_map, 0) is not None:
+        return None
+    uid, gid = id_to_outside(uid_map, 0), id_to_outside(gid_map, 0)
+    if uid is None or gid is None:
+        return process_ids
+    return uid, gid
+
+
+def get_files_owner(pid: int) -> Optional[Tuple[int, int]]:
+    """
+    Gets the (uid, gid) to own files we create for a process, so that they have a mapped owner in its user
+    namespace; or None if files owned by root are fine (i.e the process shares our user namespace, or root is mapped
+    in it as well).
+    """
+    if is_same_ns(pid, "user"):
+        return None
+    uid_map = parse_id_map(Path(f"/proc/{pid}/uid_map").read_text())
+    gid_map = parse_id_map(Path(f"/proc/{pid}/gid_map").read_text())
+    return choose_files_owner(uid_map, gid_map, _get_process_ids(pid))
@@ -20,7 +20,7 @@ from pathlib import Path
 from subprocess import CompletedProcess, Popen, TimeoutExpired
 from tempfile import TemporaryDirectory
 from threading import Event, Thread
-from typing import Callable, Iterator, List, Optional, Tuple, Union
+from typing import Callable, Iterator, List, Optional, Set, Tuple, Union
 
 import distro  # type: ignore
 import importlib_resources
@@ -33,6 +33,7 @@ from gprofiler.exceptions import (
     ProgramMissingException,
     StopEventSetException,
 )
+from gprofiler.privileges import ROOT, Privileges, describe_privileges, get_privileges_preexec_fn
 
 logger = logging.getLogger(__name__)
 
@@ -40,6 +41,9 @@ TEMPORARY_STORAGE_PATH = "/tmp/gprofiler_tmp"
 
 gprofiler_mutex: Optional[socket.socket]
 
+# (helper, privileges) pairs whose privileges were logged
+_logged_helper_privileges: Set[Tuple[str, Privileges]] = set()
+
 
 def resource_path(relative_path: str = "") -> str:
     *relative_directory, basename = relative_path.split("/")
@@ -80,16 +84,50 @@ def get_process_nspid(pid: int) -> int:
     raise Exception(f"Couldn't find NSpid for pid {pid}")
 
 
-def start_process(cmd: Union[str, List[str]], **kwargs) -> Popen:
+def get_process_name(pid: int) -> str:
+    """
+    The name of the process as perf reports it (its "comm").
+    """
+    try:
+        return Path(f"/proc/{pid}/comm").read_text().rstrip("\n")
+    except FileNotFoundError:
+        # process has exited
+        return "[unknown]"
+
+
+def _chain_preexec_fns(first: Callable[[], None], second: Callable[[], None]) -> Callable[[], None]:
+    def _preexec_fn() -> None:
+        first()
+        second()
+
+    return _preexec_fn
+
+
+def start_process(cmd: Union[str, List[str]], privileges: Privileges = ROOT, **kwargs) -> Popen:
+    """
+    Starts a child process, with the given privileges (see gprofiler.privileges). Children run as root by default;
+    pass lower privileges for those which don't need it all.
+    A preexec_fn given by the caller runs after the privileges are applied (so, for example, PR_SET_PDEATHSIG isn't
+    reset by the change of credentials).
+    """
     cmd_text = " ".join(cmd) if isinstance(cmd, list) else cmd
-    logger.debug(f"Running command: ({cmd_text})")
     if isinstance(cmd, str):
         cmd = [cmd]
+    preexec_fn, privileges = get_privileges_preexec_fn(privileges, cmd[0])
+    caller_preexec_fn = kwargs.pop("preexec_fn", None)
+    if caller_preexec_fn is not None:
+        preexec_fn = _chain_preexec_fns(preexec_fn, caller_preexec_fn)
+    helper = os.path.basename(cmd[0].split()[0])
+    if (helper, privileges) not in _logged_helper_privileges:
+        # once per helper, so the privileges of all helpers are visible without flooding the log
+        _logged_helper_privileges.add((helper, privileges))
+        logger.info(f"Running {helper} as {describe_privileges(privileges)}")
+    logger.debug(f"Running command as {describe_privileges(privileges)}: ({cmd_text})")
     popen = Popen(
         cmd,
         stdout=kwargs.pop("stdout", subprocess.PIPE),
         stderr=kwargs.pop("stderr", subprocess.PIPE),
-        preexec_fn=kwargs.pop("preexec_fn", os.setpgrp),
+        preexec_fn=preexec_fn,
         **kwargs,
     )
     return popen
@@ -211,10 +249,12 @@ def remove_prefix(s: str, prefix: str) -> str:
     return s[len(prefix) :]
 
 
-def touch_path(path: str, mode: int) -> None:
+def touch_path(path: str, mode: int, owner: Optional[Tuple[int, int]] = None) -> None:
     Path(path).touch()
     # chmod() afterwards (can't use 'mode' in touch(), because it's affected by umask)
     os.chmod(path, mode)
+    if owner is not None:
+        os.chown(path, *owner)
 
 
 def is_same_ns(pid: int, nstype: str) -> bool:
@@ -0,0 +1,209 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import json
+import logging
+import os
+import re
+import zipfile
+from pathlib import Path
+from typing import Dict, Iterable, List, Mapping, NamedTuple, Optional, Set, Tuple
+
+import psutil
+
+from .utils import get_process_container_id, resolve_proc_root_links
+
+logger = logging.getLogger(__name__)
+
+DEFAULT_VERSION_ENV_VARS = ["APP_VERSION", "VERSION", "GIT_SHA", "GIT_COMMIT"]
+
+CONTAINER_IMAGE_LABEL = "container_image"
+JAR_VERSION_LABEL = "jar_version"
+
+# where container runtimes keep the configuration of running containers, on the host.
+DOCKER_CONTAINER_CONFIG = "/var/lib/docker/containers/{container_id}/config.v2.json"
+CONTAINERD_CONTAINER_CONFIG = "/run/containerd/io.containerd.runtime.v2.task/k8s.io/{container_id}/config.json"
+CONTAINERD_IMAGE_ANNOTATION = "io.kubernetes.cri.image-name"
+# the pod of Kubernetes containers - annotations set by containerd, and labels set by the kubelet on Docker containers
+CONTAINERD_POD_ANNOTATIONS = ("io.kubernetes.cri.sandbox-namespace", "io.kubernetes.cri.sandbox-name")
+DOCKER_POD_LABELS = ("io.kubernetes.pod.namespace", "io.kubernetes.pod.name")
+# cgroup names of containers may be decorated, e.g "docker-<id>.scope" / "cri-containerd-<id>.scope"
+CONTAINER_ID_REGEX = re.compile(r"[0-9a-f]{64}")
+
+MANIFEST_VERSION_ATTRIBUTES = ["Implementation-Version", "Bundle-Version", "Specification-Version"]
+JAR_MANIFEST = "META-INF/MANIFEST.MF"
+# the JAR is the process's - larger manifests aren't decompressed.
+MAX_MANIFEST_SIZE = 64 * 1024
+
+
+class ContainerInfo(NamedTuple):
+    image: Optional[str]
+    # "<namespace>/<name>", for Kubernetes containers
+    pod: Optional[str]
+
+
+# (pid, process creation time) -> version labels
+_PROCESS_VERSIONS_CACHE: Dict[Tuple[int, float], Mapping[str, str]] = {}
+# container ID -> image & pod
+_CONTAINER_INFO_CACHE: Dict[str, ContainerInfo] = {}
+
+
+def get_process_environment(pid: int) -> Mapping[str, str]:
+    environ = Path(f"/proc/{pid}/environ").read_bytes()
+    env = {}
+    for entry in environ.split(b"\0"):
+        key, sep, value = entry.partition(b"=")
+        if sep:
+            env[key.decode(errors="replace")] = value.decode(errors="replace")
+    return env
+
+
+def _read_host_file(path: str) -> str:
+    # gProfiler might run in a container (with the host PID namespace), so access the host's files through PID 1.
+    return Path(resolve_proc_root_links("/proc/1/root", path)).read_text()
+
+
+def _get_pod(fields: Mapping[str, str], keys: Tuple[str, str]) -> Optional[str]:
+    namespace, name = (fields.get(key) for key in keys)
+    return f"{namespace}/{name}" if namespace and name else None
+
+
+def get_container_info(container_id: str) -> ContainerInfo:
+    """
+    Gets the image & pod of a container from the configuration kept by its runtime (Docker or containerd).
+    """
+    if container_id not in _CONTAINER_INFO_CACHE:
+        info = ContainerInfo(None, None)
+        m = CONTAINER_ID_REGEX.search(container_id)
+        if m is not None:
+            full_id = m.group(0)
+            try:
+                config = json.loads(_read_host_file(DOCKER_CONTAINER_CONFIG.format(container_id=full_id)))
+                info = ContainerInfo(
+                    config["Config"]["Image"], _get_pod(config["Config"].get("Labels") or {}, DOCKER_POD_LABELS)
+                )
+            except (OSError, ValueError, KeyError):
+                try:
+                    config = json.loads(_read_host_file(CONTAINERD_CONTAINER_CONFIG.format(container_id=full_id)))
+                    annotations = config["annotations"]
+                    info = ContainerInfo(
+                        annotations[CONTAINERD_IMAGE_ANNOTATION], _get_pod(annotations, CONTAINERD_POD_ANNOTATIONS)
+                    )
+                except (OSError, ValueError, KeyError):
+                    logger.debug(f"Couldn't find the configuration of container {container_id}")
+        _CONTAINER_INFO_CACHE[container_id] = info
+    return _CONTAINER_INFO_CACHE[container_id]
+
+
+def get_container_image(container_id: str) -> Optional[str]:
+    return get_container_info(container_id).image
+
+
+def _find_jar_path(pid: int, cmdline: List[str]) -> Optional[str]:
+    try:
+        jar = cmdline[cmdline.index("-jar") + 1]
+    except (ValueError, IndexError):
+        return None
+    if not os.path.isabs(jar):
+        jar = os.path.join(os.readlink(f"/proc/{pid}/cwd"), jar)
+    return resolve_proc_root_links(f"/proc/{pid}/root", jar)
+
+
+def get_jar_version(pid: int, cmdline: List[str]) -> Optional[str]:
+    """
+    Gets the version of the JAR a Java process runs ("java -jar app.jar") from its manifest.
+    """
+    jar_path = _find_jar_path(pid, cmdline)
+    if jar_path is None:
+        return None
+    with zipfile.ZipFile(jar_path) as jar:
+        # the size is of the decompressed manifest - reading stops there, whatever it's compressed to.
+        manifest_size = jar.getinfo(JAR_MANIFEST).file_size
+        if manifest_size > MAX_MANIFEST_SIZE:
+            logger.debug(f"The manifest of {jar_path} is too large ({manifest_size} bytes), skipping it")
+            return None
+        manifest = jar.read(JAR_MANIFEST).decode(errors="replace")
+    attributes = {}
+    for line in manifest.splitlines():
+        key, sep, value = line.partition(":")
+        if sep:
+            attributes[key.strip()] = value.strip()
+    for attribute in MANIFEST_VERSION_ATTRIBUTES:
+        if attributes.get(attribute):
+            return attributes[attribute]
+    return None
+
+
+def _get_process_versions(process: psutil.Process, env_vars: Iterable[str]) -> Mapping[str, str]:
+    versions = {}
+
+    env = get_process_environment(process.pid)
+    for env_var in env_vars:
+        if env.get(env_var):
+            versions[env_var] = env[env_var]
+
+    container_id = get_process_container_id(process.pid)
+    if container_id is not None:
+        image = get_container_image(container_id)
+        if image is not None:
+            versions[CONTAINER_IMAGE_LABEL] = image
+
+    cmdline = process.cmdline()
+    try:
+        jar_version = get_jar_version(process.pid, cmdline)
+    except Exception as e:
+        # encrypted JARs, unsupported compression methods, missing manifests... - the JAR just has no version.
+        logger.debug(f"Couldn't read the JAR manifest of process {process.pid}: {e}")
+        jar_version = None
+    if jar_version is not None:
+        versions[JAR_VERSION_LABEL] = jar_version
+
+    return versions
+
+
+def get_process_versions(pid: int, env_vars: Iterable[str]) -> Mapping[str, str]:
+    """
+    Gets the version identifiers of a process: from its environment variables (by the given names), the image of
+    its container and the manifest of its JAR.
+    """
+    try:
+        process = psutil.Process(pid)
+        key = (pid, process.create_time())
+        if key not in _PROCESS_VERSIONS_CACHE:
+            _PROCESS_VERSIONS_CACHE[key] = _get_process_versions(process, env_vars)
+        return _PROCESS_VERSIONS_CACHE[key]
+    except (psutil.NoSuchProcess, FileNotFoundError, ProcessLookupError):
+        return {}  # process has exited
+    except (psutil.AccessDenied, PermissionError):
+        return {}  # kernel threads
+
+
+def get_processes_versions(pids: Iterable[int], env_vars: Iterable[str]) -> Dict[int, Mapping[str, str]]:
+    """
+    Gets the versions of all given processes (see get_process_versions), omitting processes without versions.
+    """
+    env_vars = list(env_vars)
+    versions = {}
+    for pid in set(pids):
+        process_versions = get_process_versions(pid, env_vars)
+        if process_versions:
+            versions[pid] = process_versions
+    return versions
+
+
+def evict_versions_cache(live_pids: Set[int]) -> None:
+    """
+    Forgets processes that are gone.
+    """
+    for key in [key for key in _PROCESS_VERSIONS_CACHE if key[0] not in live_pids]:
+        del _PROCESS_VERSIONS_CACHE[key]
+
+
+def label_frame(labels: Mapping[str, str]) -> str:
+    """
+    Formats labels as a root frame of collapsed stacks, e.g "[APP_VERSION=1.2.3, container_image=app:1.2.3]".
+    """
+    text = ", ".join(f"{key}={value}" for key, value in labels.items())
+    # ";" separates frames, and collapsed stacks are one per line
+    return "[" + re.sub(r"[;\n]", "_", text) + "]"
@@ -0,0 +1,107 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import datetime
+import email.utils
+from threading import Event
+from typing import List
+
+import pytest
+import requests
+
+from gprofiler import client
+from gprofiler.client import APIClient, ThrottledReader, parse_retry_after
+
+
+class FakeResponse:
+    def __init__(self, status_code: int, headers: dict = None):
+        self.status_code = status_code
+        self.headers = headers or {}
+
+    def json(self) -> dict:
+        return {"message": "rate limited"} if self.status_code == 429 else {}
+
+    def raise_for_status(self) -> None:
+        pass
+
+
+class FakeSession:
+    def __init__(self, responses: List[FakeResponse]):
+        self.headers: dict = {}
+        self.responses = responses
+        self.bodies: List[bytes] = []
+
+    def request(self, method: str, url: str, **kwargs) -> FakeResponse:
+        data = kwargs.get("data")
+        if data is not None:
+            self.bodies.append(data if isinstance(data, bytes) else data.read())
+        return self.responses.pop(0)
+
+
+def test_parse_retry_after() -> None:
+    assert parse_retry_after(None) is None
+    assert parse_retry_after("120") == 120
+    assert parse_retry_after("soon") is None
+    in_a_minute = datetime.datetime.now(datetime.timezone.utc) + datetime.timedelta(seconds=60)
+    assert 55 < parse_retry_after(email.utils.format_datetime(in_a_minute)) <= 60
+
+
+def test_throttled_reader(monkeypatch) -> None:
+    now = [100.0]
+    sleeps: List[float] = []
+
+    def sleep(seconds: float) -> None:
+        sleeps.append(seconds)
+        now[0] += seconds
+
+    monkeypatch.setattr(client.time, "monotonic", lambda: now[0])
+    monkeypatch.setattr(client.time, "sleep", sleep)
+
+    reader = ThrottledReader(b"x" * 2500, 1000)
+    assert len(reader) == 2500
+    chunks = [reader.read(1000), reader.read(1000), reader.read(1000), reader.read(1000)]
+    assert [len(chunk) for chunk in chunks] == [1000, 1000, 500, 0]
+    assert sleeps == [1.0, 1.0, 0.5]
+
+
+def test_retry_after_is_respected(monkeypatch) -> None:
+    sleeps: List[float] = []
+    monkeypatch.setattr(client.time, "sleep", sleeps.append)
+    session = FakeSession(
+        [FakeResponse(200), FakeResponse(429, {"Retry-After": "7"}), FakeResponse(503), FakeResponse(200)]
+    )
+    monkeypatch.setattr(requests, "Session", lambda: session)
+
+    api_client = APIClient("https://server", "key", "service", upload_timeout=10)
+    api_client.post("profiles", {"profile": "a;b 1"})
+    # the server's Retry-After, then the default backoff (doubled, as it's the second retry)
+    assert sleeps == [7, client.DEFAULT_RETRY_AFTER * 2]
+    # the same body is sent on each attempt
+    assert len(session.bodies) == 3 and len(set(session.bodies)) == 1
+
+
+def test_retries_are_aborted_when_stopping(monkeypatch) -> None:
+    session = FakeSession([FakeResponse(200), FakeResponse(429, {"Retry-After": "7"}), FakeResponse(200)])
+    monkeypatch.setattr(requests, "Session", lambda: session)
+    stop_event = Event()
+    stop_event.set()
+
+    api_client = APIClient("https://server", "key", "service", upload_timeout=10)
+    with pytest.raises(client.APIError):
+        api_client.post("profiles", {"profile": "a;b 1"}, stop_event=stop_event)
+    assert len(session.bodies) == 1
+
+
+def test_total_retry_after_is_capped(monkeypatch) -> None:
+    sleeps: List[float] = []
+    monkeypatch.setattr(client.time, "sleep", sleeps.append)
+    session = FakeSession(
+        [FakeResponse(200), FakeResponse(429, {"Retry-After": "20"}), FakeResponse(429, {"Retry-After": "20"})]
+    )
+    monkeypatch.setattr(requests, "Session", lambda: session)
+
+    api_client = APIClient("https://server", "key", "service", upload_timeout=10, max_total_retry_after=30)
+    with pytest.raises(client.APIError):
+        api_client.post("profiles", {"profile": "a;b 1"})
+    assert sleeps == [20]
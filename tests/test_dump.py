@@ -0,0 +1,108 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import os
+import subprocess
+import sys
+import threading
+import time
+from pathlib import Path
+
+import pytest
+from psutil import Process
+
+from gprofiler import dump, main
+from gprofiler.dump import dump_threads, get_kernel_stacks
+from gprofiler.python import is_python_process
+
+
+@pytest.fixture
+def sleeping_process():
+    process = subprocess.Popen(["sleep", "60"])
+    try:
+        yield process
+    finally:
+        process.kill()
+        process.wait()
+
+
+def test_get_kernel_stacks() -> None:
+    stacks = get_kernel_stacks(os.getpid())
+    assert stacks[0][0] == os.getpid()
+    assert {tid for tid, comm, stack in stacks} == {int(task) for task in os.listdir(f"/proc/{os.getpid()}/task")}
+
+
+def test_is_python_process(sleeping_process) -> None:
+    assert is_python_process(Process(os.getpid()))
+    assert not is_python_process(Process(sleeping_process.pid))
+
+
+def test_dump_threads(sleeping_process) -> None:
+    report = dump_threads([Process(sleeping_process.pid), Process(os.getpid())])
+    assert report.startswith("gProfiler thread dump\n")
+    # gProfiler doesn't dump itself
+    assert f"=== Process {os.getpid()} " not in report
+    assert f"=== Process {sleeping_process.pid} (sleep) ===" in report
+    assert "Command line: sleep 60" in report
+    # not a runtime process - kernel stacks only
+    assert "--- Kernel stacks ---" in report and "threads (" not in report
+    assert f"Thread {sleeping_process.pid} (sleep):" in report
+
+
+def test_dump_threads_no_processes() -> None:
+    assert dump_threads([Process(os.getpid())]).endswith("No processes to dump.\n")
+
+
+def test_dump_threads_concurrency(monkeypatch) -> None:
+    lock = threading.Lock()
+    running = []
+    max_running = 0
+
+    def _dump_process(process: Process) -> str:
+        nonlocal max_running
+        with lock:
+            running.append(process.pid)
+            max_running = max(max_running, len(running))
+        time.sleep(0.05)
+        with lock:
+            running.remove(process.pid)
+        return f"=== Process {process.pid} ===\n"
+
+    monkeypatch.setattr(dump, "MAX_CONCURRENT_DUMPS", 2)
+    monkeypatch.setattr(dump, "_dump_process", _dump_process)
+    children = [subprocess.Popen(["sleep", "60"]) for _ in range(5)]
+    try:
+        report = dump.dump_threads([Process(child.pid) for child in children])
+    finally:
+        for child in children:
+            child.kill()
+            child.wait()
+    assert max_running == 2
+    assert all(f"=== Process {child.pid} ===" in report for child in children)
+
+
+def test_parse_dump_args() -> None:
+    with pytest.raises(SystemExit):
+        main.parse_dump_args([])
+    args = main.parse_dump_args(["--pid", "1", "--pid", "2", "--container", "abc", "-o", "/tmp"])
+    assert args.pids == [1, 2] and args.containers == ["abc"] and args.output_dir == "/tmp"
+
+
+def test_dump_main(monkeypatch, tmp_path: Path, sleeping_process) -> None:
+    monkeypatch.setattr(main, "verify_root", lambda: None)
+    monkeypatch.setattr(main, "DEFAULT_LOG_FILE", str(tmp_path / "gprofiler.log"))
+    time.sleep(0.1)
+    main.dump_main(["--pid", str(sleeping_process.pid), "-o", str(tmp_path)])
+    dumps = list(tmp_path.glob("dump_*.txt"))
+    assert len(dumps) == 1
+    assert f"=== Process {sleeping_process.pid} (sleep) ===" in dumps[0].read_text()
+
+
+def test_dump_main_missing_process(monkeypatch, tmp_path: Path) -> None:
+    monkeypatch.setattr(main, "verify_root", lambda: None)
+    monkeypatch.setattr(main, "DEFAULT_LOG_FILE", str(tmp_path / "gprofiler.log"))
+    process = subprocess.Popen([sys.executable, "-c", ""])
+    process.wait()
+    with pytest.raises(SystemExit):
+        main.dump_main(["--pid", str(process.pid)])
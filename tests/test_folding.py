@@ -0,0 +1,63 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import pytest  # type: ignore
+
+from gprofiler.folding import get_stack_folder
+from gprofiler.merge import collapse_stack, merge_perfs, parse_one_collapsed
+
+DJANGO_STACK = (
+    "<module> (/app/manage.py:22)_[p];"
+    "execute (/usr/lib/python3.8/site-packages/django/core/management/__init__.py:413)_[p];"
+    "run (/usr/lib/python3.8/site-packages/django/core/management/base.py:354)_[p];"
+    "get (/app/views.py:12)_[p];"
+    "render (/usr/lib/python3.8/site-packages/django/shortcuts.py:19)_[p]"
+)
+
+SPRING_STACK = (
+    "java/lang/Thread.run_[j];"
+    "org/springframework/web/servlet/FrameworkServlet.service_[j];"
+    "com/example/Controller.handle_[j];"
+    "java/util/HashMap.get_[j]"
+)
+
+
+@pytest.mark.parametrize(
+    "mode,expected",
+    [
+        ("placeholder", "<module> (/app/manage.py:22)_[p];[library];get (/app/views.py:12)_[p];[library]"),
+        ("elide", "<module> (/app/manage.py:22)_[p];get (/app/views.py:12)_[p]"),
+    ],
+)
+def test_fold_python_stack(mode: str, expected: str) -> None:
+    folder = get_stack_folder(["python"], [], mode)
+    assert folder is not None
+    assert folder.fold_stack(DJANGO_STACK) == expected
+
+
+def test_fold_java_stack() -> None:
+    folder = get_stack_folder(["java", "java-frameworks"], [], "placeholder")
+    assert folder is not None
+    assert folder.fold_stack(SPRING_STACK) == "[library];com/example/Controller.handle_[j];[library]"
+
+
+def test_fold_native_frames_by_dso() -> None:
+    stack = (
+        "\t7fe48f00faff __poll+0x4f (/lib/x86_64-linux-gnu/libc-2.31.so)\n"
+        "\t55d48f00f000 main_loop+0x10 (/usr/bin/myapp)\n"
+        "\t7fe48f00f000 __libc_start_main+0x10 (/lib/x86_64-linux-gnu/libc-2.31.so)"
+    )
+    assert collapse_stack(stack, "myapp", folder=get_stack_folder(["libc"], [], "elide")) == "myapp;main_loop"
+
+
+def test_fold_custom_pattern_in_merge() -> None:
+    folder = get_stack_folder([], [r"^com[./]vendor[./]"], "placeholder")
+    process_perfs = {1: {"com/example/Main.main_[j];com/vendor/Lib.a_[j];com/vendor/Lib.b_[j]": 1}}
+    perf_all = [{"pid": "1", "comm": "java", "stack": None}]
+    merged = parse_one_collapsed(merge_perfs(perf_all, process_perfs, folder=folder))
+    assert merged == {"java;com/example/Main.main_[j];[library]": 1}
+
+
+def test_no_rules_means_no_folder() -> None:
+    assert get_stack_folder([], [], "placeholder") is None
@@ -0,0 +1,74 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import json
+import re
+from typing import Tuple
+
+from gprofiler.heatmap import HEATMAP_ROWS, get_heatmap_data, render_heatmap
+from gprofiler.merge import parse_perf_script
+
+# out of order, as perf may emit samples of different CPUs
+PERF_SCRIPT = """
+python3 1234/1234 [001] 100.010000: 10101010 cpu-clock:pppH:
+\t7fe48f00faff __poll+0x4f (/lib/x86_64-linux-gnu/libc-2.31.so)
+\tffffffff81082227 mmput+0x57 ([kernel.kallsyms])
+
+java 99/100 [002] 101.035000: 10101010 cpu-clock:pppH:
+\t7fe48f00f000 Interpreter+0x10 (/tmp/perf-99.map)
+
+python3 1234/1234 [001] 100.000000: 10101010 cpu-clock:pppH:
+\t7fe48f00faff __poll+0x4f (/lib/x86_64-linux-gnu/libc-2.31.so)
+\tffffffff81082227 mmput+0x57 ([kernel.kallsyms])
+
+java 99/100 [002] 102.999000: 10101010 cpu-clock:pppH:
+\t7fe48f00f000 Interpreter+0x10 (/tmp/perf-99.map)
+"""
+
+
+def _bucket(offset_ms: int, rows: int) -> Tuple[int, int]:
+    """
+    (column, row) of a sample - as heatmap_template.html buckets them: a column per second, "rows" buckets per second.
+    """
+    return offset_ms // 1000, (offset_ms % 1000) // (1000 // rows)
+
+
+def test_get_heatmap_data() -> None:
+    data = get_heatmap_data(parse_perf_script(PERF_SCRIPT))
+    assert data["rows"] == HEATMAP_ROWS
+    # stacks are deduplicated, in order of appearance
+    assert data["stacks"] == ["python3;mmput_[k];__poll", "java;Interpreter"]
+    # sorted by time, offsets in milliseconds from the first sample
+    assert data["samples"] == [[0, 0], [10, 0], [1035, 1], [2999, 1]]
+
+
+def test_heatmap_buckets() -> None:
+    data = get_heatmap_data(parse_perf_script(PERF_SCRIPT))
+    buckets = [_bucket(offset, data["rows"]) for offset, _ in data["samples"]]
+    # 20ms buckets
+    assert buckets == [(0, 0), (0, 0), (1, 1), (2, 49)]
+
+
+def test_get_heatmap_data_annotations() -> None:
+    data = get_heatmap_data(parse_perf_script(PERF_SCRIPT), annotate_frames=True)
+    assert data["stacks"] == ["python3;mmput_[k];__poll_[n]", "java;Interpreter_[jit]"]
+
+
+def test_get_heatmap_data_empty() -> None:
+    assert get_heatmap_data([]) == {"rows": HEATMAP_ROWS, "stacks": [], "samples": []}
+
+
+def test_render_heatmap() -> None:
+    html = render_heatmap(parse_perf_script(PERF_SCRIPT), "2021-01-01T00:00:00", "2021-01-01T00:01:00")
+    assert "{{{" not in html
+    assert "<h4>2021-01-01T00:00:00 - 2021-01-01T00:01:00</h4>" in html
+    m = re.search(r"var data = (.*);\n", html)
+    assert m is not None
+    assert json.loads(m.group(1)) == get_heatmap_data(parse_perf_script(PERF_SCRIPT))
+
+
+def test_render_heatmap_escapes_script_end() -> None:
+    script = "app 1/1 [000] 1.000000: 1 cpu-clock:\n\t1 foo</script>+0x1 (/app)\n"
+    html = render_heatmap(parse_perf_script(script), "start", "end")
+    assert "foo</script>" not in html and "foo<\\/script>" in html
@@ -0,0 +1,164 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import datetime
+import gzip
+import os
+from pathlib import Path
+from subprocess import CompletedProcess
+from typing import List
+
+import pytest
+
+from gprofiler import importer
+from gprofiler.importer import PERF_DATA_MAGIC, detect_format, import_profile, merge_profiles, parse_pprof
+from gprofiler.merge import format_metadata_line
+
+
+def _varint(value: int) -> bytes:
+    encoded = b""
+    while True:
+        byte = value & 0x7F
+        value >>= 7
+        if value:
+            encoded += bytes([byte | 0x80])
+        else:
+            return encoded + bytes([byte])
+
+
+def _int(number: int, value: int) -> bytes:
+    return _varint(number << 3) + _varint(value)
+
+
+def _message(number: int, *fields: bytes) -> bytes:
+    data = b"".join(fields)
+    return _varint(number << 3 | 2) + _varint(len(data)) + data
+
+
+def _packed(number: int, values: List[int]) -> bytes:
+    return _message(number, *(_varint(value) for value in values))
+
+
+def _pprof_profile() -> bytes:
+    strings = ["", "samples", "count", "cpu", "nanoseconds", "main.main", "main.work", "main.inlined"]
+    return gzip.compress(
+        b"".join(
+            [
+                _message(1, _int(1, 1), _int(2, 2)),
+                _message(1, _int(1, 3), _int(2, 4)),
+                # leaf first
+                _message(2, _packed(1, [1, 2]), _packed(2, [5, 50_000_000])),
+                # main.inlined is inlined into main.work - lines are ordered from the innermost
+                _message(4, _int(1, 1), _message(4, _int(1, 3)), _message(4, _int(1, 2))),
+                _message(4, _int(1, 2), _message(4, _int(1, 1))),
+                _message(5, _int(1, 1), _int(2, 5)),
+                _message(5, _int(1, 2), _int(2, 6)),
+                _message(5, _int(1, 3), _int(2, 7)),
+                *(_message(6, s.encode()) for s in strings),
+                _int(9, 1_600_000_000_000_000_000),
+                _int(10, 10_000_000_000),
+            ]
+        )
+    )
+
+
+def test_parse_pprof() -> None:
+    profile = parse_pprof(_pprof_profile(), "server")
+    assert profile.stacks == {"server;main.main;main.work;main.inlined": 5}
+    assert profile.start_time == datetime.datetime(2020, 9, 13, 12, 26, 40)
+    assert profile.end_time == datetime.datetime(2020, 9, 13, 12, 26, 50)
+    cpu_profile = parse_pprof(_pprof_profile(), "server", "cpu")
+    assert cpu_profile.stacks == {"server;main.main;main.work;main.inlined": 50_000_000}
+
+
+def test_import_and_merge(tmp_path: Path) -> None:
+    pprof_path = tmp_path / "server.pb.gz"
+    pprof_path.write_bytes(_pprof_profile())
+    session_path = tmp_path / "last_profile_burst.col"
+    session_path.write_text(format_metadata_line({"session": "burst"}) + "\njava;Thread.run_[j] 3\n")
+    assert detect_format(str(pprof_path)) == "pprof"
+    assert detect_format(str(session_path)) == "collapsed"
+
+    imported = import_profile(str(pprof_path))
+    merged = merge_profiles([imported, import_profile(str(session_path), "collapsed")])
+    assert merged.stacks == {"server;main.main;main.work;main.inlined": 5, "java;Thread.run_[j]": 3}
+    assert merged.metadata["session"] == "burst"
+    assert merged.metadata["imported"] == {"format": "pprof", "source": "server.pb.gz"}
+    assert merged.start_time == imported.start_time
+
+
+def test_detect_uncompressed_pprof(tmp_path: Path) -> None:
+    strings = ["", "samples", "count", "main"]
+    profile = b"".join(
+        [
+            _message(1, _int(1, 1), _int(2, 2)),
+            _message(2, _packed(1, [1]), _packed(2, [7])),
+            _message(4, _int(1, 1), _message(4, _int(1, 1))),
+            _message(5, _int(1, 1), _int(2, 3)),
+            *(_message(6, s.encode()) for s in strings),
+        ]
+    )
+    # it's valid UTF-8 as well
+    profile.decode()
+    pprof_path = tmp_path / "server.pb"
+    pprof_path.write_bytes(profile)
+    assert detect_format(str(pprof_path)) == "pprof"
+    assert import_profile(str(pprof_path)).stacks == {"server;main": 7}
+
+    # binary, but neither pprof nor perf.data
+    unknown_path = tmp_path / "unknown.bin"
+    unknown_path.write_bytes(b"\x0a\xff\xff" + bytes(10))
+    with pytest.raises(ValueError):
+        detect_format(str(unknown_path))
+    collapsed_path = tmp_path / "app.col"
+    collapsed_path.write_text("main;work 10\n")
+    assert detect_format(str(collapsed_path)) == "collapsed"
+
+
+@pytest.mark.parametrize(
+    "data",
+    [
+        # a function whose name is out of the string table
+        _message(5, _int(1, 1), _int(2, 7)) + _message(6, b""),
+        # a sample type with no string table
+        _message(1, _int(1, 1), _int(2, 2)),
+        # the gzip magic, and a corrupt body
+        gzip.compress(_message(6, b""))[:12] + b"\xff" * 20,
+        # truncated
+        _message(6, b"", b"samples")[:-3],
+        # a sample that's not a message
+        _int(2, 1) + _message(6, b""),
+    ],
+)
+def test_parse_malformed_pprof(data: bytes) -> None:
+    # import_main reports ValueErrors as failed imports
+    with pytest.raises(ValueError):
+        parse_pprof(data, "server")
+
+
+PERF_SCRIPT = """
+python3 1234/1234 [001] 100.000000: 10101010 cpu-clock:pppH:
+\t7fe48f00faff __poll+0x4f (/lib/x86_64-linux-gnu/libc-2.31.so)
+\t7fe48f00f000 main+0x10 (/usr/bin/python3.8)
+"""
+
+
+def test_import_perf_data_not_owned(monkeypatch, tmp_path: Path) -> None:
+    # recorded by a user - perf script runs as nobody, and must not refuse it. perf isn't run here: this only checks
+    # that it's passed -f, which skips its ownership check - not that perf accepts the file.
+    perf_data = tmp_path / "perf.data"
+    perf_data.write_bytes(PERF_DATA_MAGIC + bytes(100))
+    os.chown(perf_data, 1000, 1000)
+    commands: List[List[str]] = []
+
+    def run_process(cmd: List[str], **kwargs) -> CompletedProcess:
+        commands.append(cmd)
+        return CompletedProcess(cmd, 0, PERF_SCRIPT.encode(), b"")
+
+    monkeypatch.setattr(importer, "run_process", run_process)
+    monkeypatch.setattr(importer, "resource_path", lambda path: path)
+    profile = import_profile(str(perf_data))
+    assert profile.metadata["imported"] == {"format": "perf", "source": "perf.data"}
+    assert profile.stacks == {"python3;main;__poll": 1}
+    assert commands == [["perf", "script", "-f", "-F", "+pid", "-i", str(perf_data)]]
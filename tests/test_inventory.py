@@ -0,0 +1,49 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import os
+from typing import Optional
+
+from gprofiler.inventory import PERF_ONLY, ProcessInfo, build_inventory, take_process_census
+
+
+def _get_container_id(pid: int) -> Optional[str]:
+    return None
+
+
+def test_take_process_census() -> None:
+    census = take_process_census()
+    ours = [info for info in census.values() if info.pid == os.getpid()]
+    assert len(ours) == 1 and ours[0].cpu_seconds > 0
+
+
+def test_build_inventory() -> None:
+    java = ProcessInfo(10, 1000.0, "java", ["java", "-jar", "app.jar"], "app", 5.0)
+    python = ProcessInfo(20, 1000.0, "python3", ["python3", "x.py"], "app", 1.0)
+    exited = ProcessInfo(30, 1000.0, "sleep", ["sleep", "1"], "root", 0.0)
+    started = ProcessInfo(40, 1050.0, "bash", ["bash"], "root", 0.5)
+    start_census = {(p.pid, p.create_time): p for p in (java, python, exited)}
+    end_census = {(p.pid, p.create_time): p for p in (java._replace(cpu_seconds=7.5), python, started)}
+
+    inventory = build_inventory(
+        start_census,
+        end_census,
+        {10: "async-profiler"},
+        {20: {"py-spy": "latency-critical (thread 20 is scheduled with SCHED_FIFO)"}},
+        True,
+        _get_container_id,
+    )
+    by_pid = {entry["pid"]: entry for entry in inventory}
+    assert [entry["pid"] for entry in inventory] == [10, 20, 30, 40]
+    assert by_pid[10]["profiler"] == "async-profiler" and by_pid[10]["cpu_seconds"] == 2.5
+    assert by_pid[10]["cmdline"] == ["java", "-jar", "app.jar"] and by_pid[10]["container"] is None
+    assert by_pid[20]["profiler"] == PERF_ONLY
+    assert by_pid[20]["skipped"] == {"py-spy": "latency-critical (thread 20 is scheduled with SCHED_FIFO)"}
+    assert by_pid[30]["exited"] and by_pid[30]["cpu_seconds"] is None
+    # started during the interval - all of its CPU time was spent in it
+    assert by_pid[40]["cpu_seconds"] == 0.5 and not by_pid[40]["exited"]
+
+    # without perf, processes no runtime profiler covered aren't profiled at all
+    inventory = build_inventory(start_census, end_census, {}, {}, False, _get_container_id)
+    assert all(entry["profiler"] is None for entry in inventory)
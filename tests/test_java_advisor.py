@@ -0,0 +1,115 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import os
+from subprocess import CompletedProcess
+from typing import List
+
+from psutil import Process
+
+from gprofiler import java_advisor
+from gprofiler.java_advisor import (
+    advise_jvm_flags,
+    advise_unknown_java,
+    evict_advisor_caches,
+    get_jvm_arguments,
+    get_jvm_flags,
+    get_unknown_java_ratio,
+    log_advice,
+    parse_jvm_flags,
+)
+
+
+def test_parse_jvm_flags() -> None:
+    # the output of jattach <pid> jcmd VM.flags
+    vm_flags = (
+        "Connected to remote JVM\nJVM response code = 0\n"
+        "-XX:CICompilerCount=4 -XX:+UseG1GC -XX:-UsePerfData -XX:+DebugNonSafepoints\n"
+    )
+    assert parse_jvm_flags(vm_flags) == {
+        "CICompilerCount": "4",
+        "UseG1GC": "true",
+        "UsePerfData": "false",
+        "DebugNonSafepoints": "true",
+    }
+    # later flags override earlier ones
+    assert parse_jvm_flags("-XX:+PreserveFramePointer -XX:-PreserveFramePointer") == {"PreserveFramePointer": "false"}
+
+
+def test_get_jvm_arguments() -> None:
+    cmdline = ["/usr/bin/java", "-cp", "lib/*", "-XX:+UseG1GC", "-jar", "app.jar", "-XX:+DebugNonSafepoints"]
+    assert get_jvm_arguments(cmdline) == ["-cp", "-XX:+UseG1GC"]
+    assert get_jvm_arguments(["java", "-Xmx1g", "com.example.Main", "-XX:+Foo"]) == ["-Xmx1g"]
+
+
+def test_advise_jvm_flags() -> None:
+    assert advise_jvm_flags({"DebugNonSafepoints": "true"}, profiled_by_async_profiler=True) == {}
+    assert set(advise_jvm_flags({}, profiled_by_async_profiler=True)) == {"DebugNonSafepoints"}
+    # frame pointers matter when perf walks the Java stacks
+    assert set(advise_jvm_flags({"DisableAttachMechanism": "true"}, profiled_by_async_profiler=False)) == {
+        "DisableAttachMechanism",
+        "PreserveFramePointer",
+    }
+    assert set(advise_jvm_flags({"PreserveFramePointer": "true", "UsePerfData": "false"}, False)) == {"UsePerfData"}
+
+
+def test_advise_unknown_java() -> None:
+    stacks = {"java;Thread.run_[j];Foo.bar_[j]": 90, "java;[unknown_Java]": 10}
+    assert get_unknown_java_ratio(stacks) == 0.1
+    advice = advise_unknown_java(stacks)
+    assert advice["unknown_Java"].startswith("10% of the samples have no Java stack")
+    assert advise_unknown_java({"java;Thread.run_[j]": 100}) == {}
+    assert get_unknown_java_ratio({}) == 0.0
+
+
+def test_get_jvm_flags_cache(monkeypatch) -> None:
+    attached: List[int] = []
+
+    def run_process(cmd: List[str], **kwargs) -> CompletedProcess:
+        attached.append(int(cmd[1]))
+        return CompletedProcess(cmd, 0, b"-XX:+DebugNonSafepoints -XX:+UseG1GC\n", b"")
+
+    monkeypatch.setattr(java_advisor, "get_command_line_jvm_flags", lambda process: {"UseG1GC": "false"})
+    monkeypatch.setattr(java_advisor, "run_process", run_process)
+    monkeypatch.setattr(java_advisor, "resource_path", lambda path: path)
+    process = Process(os.getpid())
+    # the command line flags of a skipped JVM aren't cached - they are partial
+    assert get_jvm_flags(process, attach=False) == {"UseG1GC": "false"}
+    assert get_jvm_flags(process, attach=True) == {"UseG1GC": "true", "DebugNonSafepoints": "true"}
+    assert get_jvm_flags(process, attach=True) == {"UseG1GC": "true", "DebugNonSafepoints": "true"}
+    assert attached == [os.getpid()]
+
+    evict_advisor_caches(set())
+    get_jvm_flags(process, attach=True)
+    assert attached == [os.getpid(), os.getpid()]
+    evict_advisor_caches(set())
+
+
+def test_get_jvm_flags_attach_failure(monkeypatch) -> None:
+    def run_process(cmd: List[str], **kwargs) -> CompletedProcess:
+        raise Exception("attach failed")
+
+    monkeypatch.setattr(java_advisor, "get_command_line_jvm_flags", lambda process: {"UseG1GC": "false"})
+    monkeypatch.setattr(java_advisor, "run_process", run_process)
+    monkeypatch.setattr(java_advisor, "resource_path", lambda path: path)
+    process = Process(os.getpid())
+    assert get_jvm_flags(process, attach=True) == {"UseG1GC": "false"}
+    # retried in the next snapshot
+    assert (process.pid, process.create_time()) not in java_advisor._JVM_FLAGS_CACHE
+
+
+def test_log_advice_eviction(monkeypatch) -> None:
+    logged: List[str] = []
+    monkeypatch.setattr(java_advisor.logger, "warning", logged.append)
+    process = Process(os.getpid())
+    log_advice(process, {"UsePerfData": "advice"})
+    log_advice(process, {"UsePerfData": "advice"})
+    evict_advisor_caches({os.getpid()})
+    log_advice(process, {"UsePerfData": "advice"})
+    assert len(logged) == 1
+    evict_advisor_caches(set())
+    assert not java_advisor._LOGGED_ADVICE
+    log_advice(process, {"UsePerfData": "advice"})
+    assert len(logged) == 2
+    evict_advisor_caches(set())
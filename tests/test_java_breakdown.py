@@ -0,0 +1,56 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+from typing import Optional
+
+import pytest
+
+from gprofiler.java_breakdown import breakdown_java_stacks, classify_thread_name, format_breakdown
+
+
+@pytest.mark.parametrize(
+    "name,category",
+    [
+        ("GC Thread#3", "gc"),
+        ("G1 Conc#0", "gc"),
+        ("ZWorker#1", "gc"),
+        ("C2 CompilerThread0", "jit"),
+        ("VM Thread", "vm"),
+        ("Signal Dispatcher", "other"),
+        ("http-nio-8080-exec-1", None),
+        ("main", None),
+    ],
+)
+def test_classify_thread_name(name: str, category: Optional[str]) -> None:
+    assert classify_thread_name(name) == category
+
+
+def test_breakdown_java_stacks() -> None:
+    stacks = {
+        "[main tid=100];java/lang/Thread.run_[j];Foo.bar_[j]": 50,
+        "[main tid=100];java/lang/Thread.run_[j];SafepointSynchronize::block": 5,
+        "[GC Thread#0 tid=101];thread_native_entry;GangWorker::loop": 20,
+        "[C2 CompilerThread0 tid=102];CompileBroker::compiler_thread_loop;C2Compiler::compile_method": 15,
+        "[VM Thread tid=103];VMThread::run;VMThread::loop": 10,
+    }
+    new_stacks, breakdown = breakdown_java_stacks(stacks)
+    assert breakdown == {"application": 50, "gc": 20, "jit": 15, "vm": 15, "other": 0}
+    # thread frames are removed
+    assert new_stacks["java/lang/Thread.run_[j];Foo.bar_[j]"] == 50
+    assert format_breakdown(breakdown) == "application 50%, gc 20%, jit 15%, vm 15%"
+
+    grouped, _ = breakdown_java_stacks(stacks, grouping_frames=True)
+    assert grouped["[jvm: gc];thread_native_entry;GangWorker::loop"] == 20
+
+
+def test_breakdown_without_thread_names() -> None:
+    stacks = {
+        "java/lang/Thread.run_[j];Foo.bar_[j]": 10,
+        "thread_native_entry;GangWorker::loop;G1ParTask::work": 4,
+        "thread_native_entry;CompileBroker::compiler_thread_loop": 3,
+        "thread_native_entry;VMThread::loop": 2,
+        "thread_native_entry;os::sleep": 1,
+    }
+    _, breakdown = breakdown_java_stacks(stacks)
+    assert breakdown == {"application": 10, "gc": 4, "jit": 3, "vm": 2, "other": 1}
@@ -0,0 +1,117 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+from pathlib import Path
+from threading import Event
+from typing import List, Optional
+
+import pytest
+
+from gprofiler import kernel_headers, python
+from gprofiler.kernel_headers import INSTALLED_HEADERS, KHEADERS, get_kernel_headers_source
+
+
+@pytest.mark.parametrize(
+    "installed,kheaders_loaded,kheaders_loadable,source",
+    [
+        (True, True, True, INSTALLED_HEADERS),
+        (False, True, False, KHEADERS),
+        (False, False, True, KHEADERS),
+        (False, False, False, None),
+    ],
+)
+def test_get_kernel_headers_source(
+    monkeypatch,
+    tmp_path: Path,
+    installed: bool,
+    kheaders_loaded: bool,
+    kheaders_loadable: bool,
+    source: Optional[str],
+) -> None:
+    headers_path = tmp_path / "build"
+    if installed:
+        headers_path.mkdir()
+    kheaders_path = tmp_path / "kheaders.tar.xz"
+    if kheaders_loaded:
+        kheaders_path.touch()
+    modprobes: List[None] = []
+
+    def _load_kheaders() -> bool:
+        modprobes.append(None)
+        return kheaders_loadable
+
+    monkeypatch.setattr(kernel_headers, "_installed_headers_path", lambda: str(headers_path))
+    monkeypatch.setattr(kernel_headers, "KHEADERS_PATH", str(kheaders_path))
+    monkeypatch.setattr(kernel_headers, "_load_kheaders", _load_kheaders)
+
+    assert get_kernel_headers_source() == source
+    # modprobe is attempted only if there are no headers at all
+    assert len(modprobes) == (0 if installed or kheaders_loaded else 1)
+
+
+def test_load_kheaders(monkeypatch, tmp_path: Path) -> None:
+    kheaders_path = tmp_path / "kheaders.tar.xz"
+    commands: List[List[str]] = []
+
+    def run_process(cmd: List[str]) -> None:
+        commands.append(cmd)
+        kheaders_path.touch()
+
+    monkeypatch.setattr(kernel_headers, "KHEADERS_PATH", str(kheaders_path))
+    monkeypatch.setattr(kernel_headers, "run_process", run_process)
+    assert kernel_headers._load_kheaders()
+    # the bundled modprobe, with the module tree of the host
+    assert commands == [["modprobe", "--dirname", "/proc/1/root", "kheaders"]]
+
+
+def test_load_kheaders_failure(monkeypatch, tmp_path: Path) -> None:
+    def run_process(cmd: List[str]) -> None:
+        raise Exception("modprobe: FATAL: Module kheaders not found")
+
+    monkeypatch.setattr(kernel_headers, "KHEADERS_PATH", str(tmp_path / "kheaders.tar.xz"))
+    monkeypatch.setattr(kernel_headers, "run_process", run_process)
+    assert not kernel_headers._load_kheaders()
+
+
+@pytest.mark.parametrize("available", [True, False])
+def test_get_kernel_headers_source_without_loading(monkeypatch, tmp_path: Path, available: bool) -> None:
+    def _load_kheaders() -> bool:
+        raise AssertionError("the module must not be loaded")
+
+    monkeypatch.setattr(kernel_headers, "_installed_headers_path", lambda: str(tmp_path / "build"))
+    monkeypatch.setattr(kernel_headers, "KHEADERS_PATH", str(tmp_path / "kheaders.tar.xz"))
+    monkeypatch.setattr(kernel_headers, "_load_kheaders", _load_kheaders)
+    monkeypatch.setattr(kernel_headers, "is_kheaders_module_available", lambda: available)
+    assert get_kernel_headers_source(load_kheaders=False) == (KHEADERS if available else None)
+
+
+def test_is_kheaders_module_available(monkeypatch, tmp_path: Path) -> None:
+    modules_dir = tmp_path / "lib" / "modules" / "5.15.0"
+    modules_dir.mkdir(parents=True)
+    monkeypatch.setattr(kernel_headers, "HOST_ROOT", str(tmp_path))
+    monkeypatch.setattr(kernel_headers.platform, "release", lambda: "5.15.0")
+    (modules_dir / "modules.dep").write_text("kernel/fs/ext4/ext4.ko: kernel/lib/crc16.ko\n")
+    assert not kernel_headers.is_kheaders_module_available()
+    (modules_dir / "modules.dep").write_text("kernel/fs/ext4/ext4.ko:\nkernel/kernel/kheaders.ko.zst:\n")
+    assert kernel_headers.is_kheaders_module_available()
+
+
+@pytest.mark.parametrize("btf", [True, False])
+def test_fallback_reason(monkeypatch, tmp_path: Path, btf: bool) -> None:
+    btf_path = tmp_path / "vmlinux"
+    if btf:
+        btf_path.write_bytes(b"")
+    monkeypatch.setattr(kernel_headers, "BTF_VMLINUX_PATH", str(btf_path))
+    monkeypatch.setattr(python, "get_kernel_headers_source", lambda: None)
+
+    def test(storage_dir: str, stop_event: Event) -> None:
+        raise Exception("failed to compile the eBPF programs")
+
+    logged: List[str] = []
+    monkeypatch.setattr(python.PythonEbpfProfiler, "test", test)
+    monkeypatch.setattr(python.logger, "info", logged.append)
+    assert python.determine_profiler_class(str(tmp_path), Event()) is python.PySpyProfiler
+    # the fallback says why
+    assert logged[-1].startswith("Python eBPF profiler initialization failed (no kernel headers found")
+    assert (f"can't use the kernel BTF ({btf_path})" in logged[-1]) == btf
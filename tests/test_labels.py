@@ -0,0 +1,44 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import os
+
+import pytest
+
+from gprofiler import labels
+from gprofiler.labels import evict_cmdlines_cache, get_processes_labels, parse_label, parse_process_label_rule
+
+
+def test_parse_label() -> None:
+    assert parse_label("env=prod") == ("env", "prod")
+    assert parse_label("query=a=b") == ("query", "a=b")
+    for bad_label in ["env", "=prod", "my env=prod"]:
+        with pytest.raises(ValueError):
+            parse_label(bad_label)
+
+
+def test_process_label_rules() -> None:
+    rules = [
+        parse_process_label_rule("tier=backend:python"),
+        parse_process_label_rule("tier=workers:python.*:celery"),
+        parse_process_label_rule("team=perf:."),
+    ]
+    assert rules[1].cmdline_regex.pattern == "python.*:celery"
+    with pytest.raises(ValueError):
+        parse_process_label_rule("tier=backend")
+
+    # this process' command line contains "python", but not ":celery"
+    assert get_processes_labels([os.getpid()], rules) == {os.getpid(): {"tier": "backend", "team": "perf"}}
+
+
+def test_cmdlines_cache_eviction(monkeypatch) -> None:
+    monkeypatch.setattr(labels, "_CMDLINES_CACHE", {(1, 0.0): "init", (2, 0.0): "gone"})
+    rules = [parse_process_label_rule("team=perf:.")]
+    # evaluating the rules on some processes (e.g for a scoped session) doesn't evict the others
+    get_processes_labels([os.getpid()], rules)
+    assert (1, 0.0) in labels._CMDLINES_CACHE and (2, 0.0) in labels._CMDLINES_CACHE
+
+    evict_cmdlines_cache({1, os.getpid()})
+    assert (1, 0.0) in labels._CMDLINES_CACHE and (2, 0.0) not in labels._CMDLINES_CACHE
+    assert any(pid == os.getpid() for pid, _ in labels._CMDLINES_CACHE)
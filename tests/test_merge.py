@@ -0,0 +1,89 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+from gprofiler.merge import (
+    RUNTIME_ONLY_FRAME,
+    annotate_stacks,
+    collapse_stack,
+    merge_perfs,
+    merge_runtime_perfs,
+    parse_one_collapsed,
+    parse_perf_script,
+)
+
+PERF_SCRIPT = """
+python3 1234/1234 [001] 100.010000: 10101010 cpu-clock:pppH:
+\t7fe48f00faff __poll+0x4f (/lib/x86_64-linux-gnu/libc-2.31.so)
+\tffffffff81082227 mmput+0x57 ([kernel.kallsyms])
+
+java 99/100 [002] 100.020000: 10101010 cpu-clock:pppH:
+\t7fe48f00f000 Interpreter+0x10 (/tmp/perf-99.map)
+\t7fe48f00faff [unknown] (/tmp/perf-99.map)
+
+java 99/100 [002] 100.030000: 10101010 cpu-clock:pppH:
+\t7fe48f00f000 Interpreter+0x10 (/tmp/perf-99.map)
+"""
+
+PERF_STACK = (
+    "\t7fe48f00faff __poll+0x4f (/lib/x86_64-linux-gnu/libc-2.31.so)\n"
+    "\tffffffff81082227 mmput+0x57 ([kernel.kallsyms])\n"
+    "\t7fe48f00f000 Interpreter+0x10 (/tmp/perf-99.map)\n"
+    "\t0 [unknown] ([unknown])"
+)
+
+
+def test_collapse_stack_annotates_kernel_frames_only_by_default() -> None:
+    assert collapse_stack(PERF_STACK, "comm") == "comm;[unknown];Interpreter;mmput_[k];__poll"
+
+
+def test_collapse_stack_annotates_all_frames() -> None:
+    assert (
+        collapse_stack(PERF_STACK, "comm", annotate_frames=True)
+        == "comm;[unknown];Interpreter_[jit];mmput_[k];__poll_[n]"
+    )
+
+
+def test_annotate_stacks_keeps_existing_annotations() -> None:
+    java_stacks = {"java/lang/Thread.run_[j];Foo.bar_[i];JVM_Sleep;os::sleep;[unknown_Java]": 3}
+    assert annotate_stacks(java_stacks, "native") == {
+        "java/lang/Thread.run_[j];Foo.bar_[i];JVM_Sleep_[n];os::sleep_[n];[unknown_Java]": 3
+    }
+
+    python_stacks = {"<module> (/app/fibonacci.py:12);fibonacci (/app/fibonacci.py:7)": 5}
+    assert annotate_stacks(python_stacks, "python") == {
+        "<module> (/app/fibonacci.py:12)_[p];fibonacci (/app/fibonacci.py:7)_[p]": 5
+    }
+
+
+def test_merge_perfs_preserves_annotations() -> None:
+    process_perfs = {99: annotate_stacks({"Thread.run_[j];JVM_Sleep": 10}, "native")}
+    merged = parse_one_collapsed(merge_perfs(parse_perf_script(PERF_SCRIPT), process_perfs, annotate_frames=True))
+    assert merged == {
+        "python3;mmput_[k];__poll_[n]": 1,
+        # 2 perf samples for pid 99, replaced by its runtime stacks.
+        "java;Thread.run_[j];JVM_Sleep_[n]": 2,
+    }
+
+
+def test_merge_perfs_root_frames() -> None:
+    process_perfs = {99: {"Thread.run_[j]": 10}}
+    root_frames = {1234: ["[APP_VERSION=1]"], 99: ["[jar_version=2]"]}
+    merged = parse_one_collapsed(merge_perfs(parse_perf_script(PERF_SCRIPT), process_perfs, root_frames=root_frames))
+    assert merged == {
+        "[APP_VERSION=1];python3;mmput_[k];__poll": 1,
+        "[jar_version=2];java;Thread.run_[j]": 2,
+    }
+
+
+def test_merge_runtime_perfs() -> None:
+    # py-spy samples at 10hz, async-profiler at the requested 11hz; perf would've sampled at 11hz.
+    process_perfs = {99: {"Thread.run_[j]": 10}, 1234: {"<module> (x.py);f (x.py)": 5}}
+    process_names = {99: "java", 1234: "python3"}
+    merged = parse_one_collapsed(
+        merge_runtime_perfs(process_perfs, {99: 11, 1234: 10}, 11, process_names, root_frames={99: ["[c]"]})
+    )
+    assert merged == {
+        f"[c];java;{RUNTIME_ONLY_FRAME};Thread.run_[j]": 10,
+        f"python3;{RUNTIME_ONLY_FRAME};<module> (x.py);f (x.py)": 6,
+    }
@@ -0,0 +1,68 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import subprocess
+import sys
+import time
+from pathlib import Path
+from threading import Event
+from typing import List
+
+from gprofiler import plan
+from gprofiler.kernel_headers import KHEADERS
+
+
+def test_plan_python_process(monkeypatch, tmp_path: Path) -> None:
+    # no kernel headers - py-spy
+    monkeypatch.setattr(plan, "get_kernel_headers_source", lambda load_kheaders: None)
+    process = subprocess.Popen([sys.executable, "-c", "import time; time.sleep(60)"])
+    try:
+        time.sleep(0.5)  # let it map libpython
+        result = plan.make_plan(str(tmp_path), Event())
+    finally:
+        process.kill()
+        process.wait()
+
+    assert result.python_profiler == "py-spy"
+    planned = [process_plan for process_plan in result.processes if process_plan.pid == process.pid]
+    assert len(planned) == 1
+    assert planned[0].profiler == "py-spy" and planned[0].paths == [] and planned[0].skipped == {}
+    assert planned[0].cmdline == f"{sys.executable} -c 'import time; time.sleep(60)'"
+
+
+def test_plan_pyperf_has_no_side_effects(monkeypatch, tmp_path: Path) -> None:
+    calls: List[bool] = []
+
+    def get_kernel_headers_source(load_kheaders: bool) -> str:
+        calls.append(load_kheaders)
+        return KHEADERS
+
+    monkeypatch.setattr(plan, "get_kernel_headers_source", get_kernel_headers_source)
+    result = plan.make_plan(str(tmp_path), Event())
+    assert result.python_profiler == "PyPerf" and result.kernel_headers == KHEADERS
+    # the kheaders module isn't loaded, and PyPerf doesn't run
+    assert calls == [False]
+    assert list(tmp_path.iterdir()) == []
+    assert "Python: PyPerf (eBPF, using kheaders)" in plan.format_plan(result)
+
+
+def test_format_plan() -> None:
+    java = plan.ProcessPlan(
+        10,
+        "java",
+        "java -jar app.jar",
+        "async-profiler",
+        ["/tmp/gprofiler_tmp/10", "/tmp/gprofiler_tmp/10/libasyncProfiler.so"],
+        {},
+    )
+    critical = plan.ProcessPlan(20, "python3", "python3 x.py", "perf-only", [], {"py-spy": "latency-critical (x)"})
+    lines = plan.format_plan(plan.Plan("py-spy", [java, critical])).splitlines()
+    assert lines[2] == "Python: py-spy (no kernel headers for eBPF), attaches to the Python processes below"
+    assert lines[5:10] == [
+        "     10  async-profiler  java -jar app.jar",
+        "         writes /tmp/gprofiler_tmp/10",
+        "         writes /tmp/gprofiler_tmp/10/libasyncProfiler.so",
+        "     20  perf-only       python3 x.py",
+        "         skipped by py-spy: latency-critical (x)",
+    ]
@@ -0,0 +1,83 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import os
+import pwd
+from typing import Dict, List
+
+from gprofiler.privileges import (
+    CAP_DAC_READ_SEARCH,
+    CAP_SYS_PTRACE,
+    PTRACE,
+    ROOT,
+    UNPRIVILEGED,
+    UNPRIVILEGED_USER,
+    Privileges,
+    describe_privileges,
+)
+from gprofiler import utils
+from gprofiler.utils import run_process
+
+
+def _get_child_status(privileges: Privileges) -> Dict[str, str]:
+    status = run_process(["/bin/cat", "/proc/self/status"], privileges=privileges).stdout.decode()
+    return dict(line.split(":\t", maxsplit=1) for line in status.splitlines())
+
+
+def _capabilities(mask: str) -> int:
+    return int(mask, 16)
+
+
+def test_ptrace_privileges_keep_root_with_capabilities() -> None:
+    status = _get_child_status(PTRACE)
+    assert status["Uid"].split()[0] == "0"
+    expected = (1 << CAP_SYS_PTRACE) | (1 << CAP_DAC_READ_SEARCH)
+    assert _capabilities(status["CapEff"]) == expected
+    assert _capabilities(status["CapBnd"]) == expected
+    assert status["NoNewPrivs"].strip() == "1"
+
+
+def test_unprivileged_privileges_switch_user() -> None:
+    status = _get_child_status(UNPRIVILEGED)
+    nobody = pwd.getpwnam(UNPRIVILEGED_USER)
+    assert status["Uid"].split()[0] == str(nobody.pw_uid)
+    assert status["Gid"].split()[0] == str(nobody.pw_gid)
+    assert status["Groups"].strip() == ""
+    assert _capabilities(status["CapEff"]) == 0
+    assert _capabilities(status["CapPrm"]) == 0
+
+
+def test_root_privileges_are_kept() -> None:
+    status = _get_child_status(ROOT)
+    assert status["Uid"].split()[0] == "0"
+    assert status["NoNewPrivs"].strip() == "0"
+
+
+def test_describe_privileges() -> None:
+    assert describe_privileges(ROOT) == "root"
+    assert describe_privileges(PTRACE) == "root with CAP_DAC_READ_SEARCH,CAP_SYS_PTRACE"
+    assert describe_privileges(UNPRIVILEGED) == "nobody without capabilities"
+    assert describe_privileges(Privileges(frozenset(), (1000, 1000))) == "uid 1000 without capabilities"
+
+
+def test_preexec_fn_runs_after_dropping_privileges() -> None:
+    def preexec_fn() -> None:
+        if os.getuid() == 0:
+            raise Exception("runs before the privileges are dropped")
+
+    status = run_process(["/bin/cat", "/proc/self/status"], privileges=UNPRIVILEGED, preexec_fn=preexec_fn)
+    assert status.returncode == 0
+
+
+def test_helper_privileges_are_logged_once(monkeypatch) -> None:
+    messages: List[str] = []
+    monkeypatch.setattr(utils.logger, "info", messages.append)
+    monkeypatch.setattr(utils, "_logged_helper_privileges", set())
+    for _ in range(2):
+        run_process(["/bin/true"], privileges=UNPRIVILEGED)
+        run_process(["/bin/true"], privileges=PTRACE)
+    assert messages == [
+        "Running true as nobody without capabilities",
+        "Running true as root with CAP_DAC_READ_SEARCH,CAP_SYS_PTRACE",
+    ]
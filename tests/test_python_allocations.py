@@ -0,0 +1,68 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+from typing import List, Optional
+
+import pytest
+
+from gprofiler.python_allocations import (
+    MAX_FRAMES,
+    UprobeTarget,
+    build_uprobe_args,
+    detect_python_layout,
+    parse_allocation_samples,
+)
+
+
+@pytest.mark.parametrize(
+    "symbols,version",
+    [
+        (["PyObject_Malloc", "_PyThreadState_Current", "PyString_FromString"], "2.7"),
+        (["PyObject_Malloc", "_PyThreadState_Current"], "3.5-3.6"),
+        (["PyObject_Malloc", "_PyRuntime"], "3.7"),
+        (["PyObject_Malloc", "_PyRuntime", "PyCode_NewWithPosOnlyArgs"], "3.8"),
+        (["PyObject_Malloc", "_PyRuntime", "PyCode_NewWithPosOnlyArgs", "PyFrame_GetCode"], "3.9"),
+        (["PyObject_Malloc", "_PyRuntime", "PyCode_NewWithPosOnlyArgs", "PyFrame_GetCode", "PyIter_Send"], None),
+        (["malloc"], None),
+    ],
+)
+def test_detect_python_layout(symbols: List[str], version: Optional[str]) -> None:
+    layout = detect_python_layout(set(symbols))
+    assert (layout.version if layout is not None else None) == version
+
+
+def test_build_uprobe_args() -> None:
+    layout = detect_python_layout({"_PyRuntime", "PyCode_NewWithPosOnlyArgs", "PyFrame_GetCode"})
+    assert layout is not None
+    args = build_uprobe_args(UprobeTarget("/usr/lib/libpython3.9.so.1.0", 0x103F10, 0x3AD198, layout)).split()
+    assert args[0] == "size=%di:u64"
+    # code->co_name of thread_state->frame, and of frame->f_back
+    assert args[1] == "n0=+48(+112(+32(+24(@+0x3ad198)))):string"
+    assert args[3] == "n1=+48(+112(+32(+24(+24(@+0x3ad198))))):string"
+    assert args[-1].startswith("more=+24(")
+    assert len(args) == 2 + 2 * MAX_FRAMES
+
+
+def test_parse_allocation_samples() -> None:
+    deep = " ".join(f'n{i}="f{i}" f{i}="/app/deep.py"' for i in range(MAX_FRAMES))
+    script = "\n".join(
+        [
+            '   python 100/101 gprofiler_alloc:py0: (7f5d03703f10) size=32 n0="leaf" f0="/app/x.py"'
+            ' n1="<module>" f1="/app/x.py" n2=(fault) f2=(fault) n3=(fault) f3=(fault) n4=(fault) f4=(fault)'
+            " n5=(fault) f5=(fault) more=140571226624080",
+            '   python 100/100 gprofiler_alloc:py0: (7f5d03703f10) size=16 n0="leaf" f0="/app/x.py"'
+            ' n1="<module>" f1="/app/x.py" n2=(fault) f2=(fault) n3=(fault) f3=(fault) n4=(fault) f4=(fault)'
+            " n5=(fault) f5=(fault) more=0",
+            f"   my app 200/200 gprofiler_alloc:py1: (5581d3f10) size=0x40 {deep} more=0x7f5d03703f10",
+            "   python 300/300 gprofiler_alloc:py0: (7f5d03703f10) size=8 n0=(fault) f0=(fault) n1=(fault)"
+            " f1=(fault) n2=(fault) f2=(fault) n3=(fault) f3=(fault) n4=(fault) f4=(fault) n5=(fault) f5=(fault)"
+            " more=0",
+        ]
+    )
+    deep_stack = ";".join(f"f{i} (/app/deep.py)" for i in reversed(range(MAX_FRAMES)))
+    assert parse_allocation_samples(script, 100) == {
+        100: {"python;<module> (/app/x.py);leaf (/app/x.py)": (32 + 16) * 100},
+        200: {f"my app;[truncated];{deep_stack}": 64 * 100},
+        300: {"python;[no Python frames]": 8 * 100},
+    }
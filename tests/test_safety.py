@@ -0,0 +1,61 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import os
+import subprocess
+from typing import Iterator, Optional
+
+import pytest
+from psutil import Process
+
+from gprofiler.safety import (
+    configure_safety_policy,
+    filter_runtime_attachable,
+    get_critical_cgroup,
+    get_latency_critical_reason,
+    parse_cpu_list,
+)
+
+
+@pytest.fixture
+def realtime_process() -> Iterator[subprocess.Popen]:
+    process = subprocess.Popen(["sleep", "60"])
+    try:
+        os.sched_setscheduler(process.pid, os.SCHED_FIFO, os.sched_param(1))
+        yield process
+    finally:
+        process.kill()
+        process.wait()
+
+
+def test_parse_cpu_list() -> None:
+    assert parse_cpu_list("2-4,7\n") == {2, 3, 4, 7}
+    assert parse_cpu_list("\n") == set()
+
+
+@pytest.mark.parametrize(
+    "cgroup,critical_cgroup",
+    [
+        ("0::/system.slice/trader.service\n", "/system.slice/trader.service"),
+        ("0::/system.slice/trader.service/worker\n", "/system.slice/trader.service"),
+        ("0::/system.slice/trader.service-2\n", None),
+        # cgroup v1
+        ("12:cpu,cpuacct:/kubepods/pod1234/abcd\n1:name=systemd:/kubepods/pod1234/abcd\n", "/kubepods/pod1234"),
+    ],
+)
+def test_get_critical_cgroup(cgroup: str, critical_cgroup: Optional[str]) -> None:
+    assert get_critical_cgroup(cgroup, ["/system.slice/trader.service", "/kubepods/pod1234"]) == critical_cgroup
+
+
+def test_realtime_process_is_not_attachable(realtime_process: subprocess.Popen) -> None:
+    reason = get_latency_critical_reason(realtime_process.pid)
+    assert reason == f"thread {realtime_process.pid} is scheduled with SCHED_FIFO"
+
+    processes = [Process(realtime_process.pid), Process(os.getpid())]
+    assert [process.pid for process in filter_runtime_attachable(processes, "test")] == [os.getpid()]
+    configure_safety_policy(enabled=False)
+    try:
+        assert len(filter_runtime_attachable(processes, "test")) == 2
+    finally:
+        configure_safety_policy()
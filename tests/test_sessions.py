@@ -0,0 +1,67 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+from typing import Dict, List, Optional
+
+from gprofiler.sessions import (
+    RecordedSnapshot,
+    SessionSpec,
+    demultiplex_snapshot,
+    downsample_perf_samples,
+    spec_from_json,
+    spec_to_json,
+)
+
+
+def _perf_samples(frequency: int, seconds: int, cpus: int, pid: int = 1, first_cpu: int = 0) -> List[Dict[str, str]]:
+    return [
+        {"pid": str(pid), "tid": str(pid), "cpu": f"{cpu:03}", "time": f"{100 + i / frequency:.6f}"}
+        for i in range(frequency * seconds)
+        for cpu in range(first_cpu, first_cpu + cpus)
+    ]
+
+
+def test_downsample_perf_samples() -> None:
+    samples = _perf_samples(99, 2, 4)
+    assert len(downsample_perf_samples(samples, 10, 99)) == 10 * 2 * 4
+    # nothing to downsample
+    assert downsample_perf_samples(samples, 99, 99) is samples
+
+
+def test_demultiplex_snapshot() -> None:
+    containers = {1: "abcdef", 2: "012345", 3: None}
+    # each process runs on its own CPU
+    perf_samples = [sample for pid in (1, 2, 3) for sample in _perf_samples(99, 1, 1, pid=pid, first_cpu=pid)]
+    snapshot = RecordedSnapshot(
+        99,
+        perf_samples,
+        {1: {"Thread.run_[j]": 10}, 3: {"<module> (x.py)": 5}},
+        {1: 99, 3: 100},
+        {},
+        [{"pid": pid, "container": container} for pid, container in containers.items()],
+    )
+
+    def _get_container_id(pid: int) -> Optional[str]:
+        return containers[pid]
+
+    burst = demultiplex_snapshot(snapshot, SessionSpec("burst", 99, containers=("abc",)), _get_container_id)
+    assert burst.perf_samples is not None and {sample["pid"] for sample in burst.perf_samples} == {"1"}
+    assert len(burst.perf_samples) == 99
+    assert burst.process_perfs == {1: {"Thread.run_[j]": 10}}
+    assert burst.inventory == [{"pid": 1, "container": "abcdef"}]
+
+    baseline = demultiplex_snapshot(snapshot, SessionSpec("default", 10), _get_container_id)
+    assert baseline.frequency == 10
+    assert baseline.perf_samples is not None and len(baseline.perf_samples) == 10 * 3
+    assert baseline.process_perfs == snapshot.process_perfs
+
+    runtime_only = snapshot._replace(perf_samples=None)
+    pid_session = demultiplex_snapshot(runtime_only, SessionSpec("p", 10, pids=(3,)), _get_container_id)
+    assert pid_session.perf_samples is None
+    assert pid_session.process_perfs == {3: {"<module> (x.py)": 5}}
+
+
+def test_spec_json() -> None:
+    spec = SessionSpec("burst", 99, pids=(1, 2), containers=("abc",), output_dir="/tmp/out", snapshots=3)
+    assert spec_from_json(spec_to_json(spec)) == spec
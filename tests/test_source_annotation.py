@@ -0,0 +1,34 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+from gprofiler.source_annotation import get_line_counts, strip_line_numbers
+
+STACKS = {
+    "<module> (/app/fib.py:9)_[p];fibonacci (/app/fib.py:5)_[p];fibonacci (/app/fib.py:5)_[p]": 90,
+    "<module> (/app/fib.py:10)_[p]": 10,
+    "java/lang/Thread.run:834_[j];com/example/Foo$Bar.baz:12_[j];os::sleep": 5,
+}
+
+
+def test_strip_line_numbers() -> None:
+    assert strip_line_numbers(STACKS) == {
+        "<module> (/app/fib.py)_[p];fibonacci (/app/fib.py)_[p];fibonacci (/app/fib.py)_[p]": 90,
+        "<module> (/app/fib.py)_[p]": 10,
+        "java/lang/Thread.run_[j];com/example/Foo$Bar.baz_[j];os::sleep": 5,
+    }
+
+
+def test_get_line_counts() -> None:
+    self_counts, total_counts = get_line_counts(STACKS)
+    # the Java stack ends in a native frame, so no Java line is executing.
+    assert self_counts == {("/app/fib.py", 5): 90, ("/app/fib.py", 10): 10}
+    assert total_counts == {
+        ("/app/fib.py", 9): 90,
+        # recursive calls are counted once per stack.
+        ("/app/fib.py", 5): 90,
+        ("/app/fib.py", 10): 10,
+        ("java/lang/Thread.java", 834): 5,
+        # nested classes reside in the source file of the outermost class.
+        ("com/example/Foo.java", 12): 5,
+    }
@@ -0,0 +1,63 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import subprocess
+from threading import Event
+
+import pytest  # type: ignore
+from docker import DockerClient
+from docker.models.images import Image
+
+from gprofiler import python
+from gprofiler.python import PySpyProfiler
+from tests import CONTAINERS_DIRECTORY
+
+
+@pytest.fixture
+def runtime() -> str:
+    return "python"
+
+
+@pytest.fixture(scope="session")
+def application_docker_image(docker_client: DockerClient) -> Image:
+    dockerfile = CONTAINERS_DIRECTORY / "python" / "Dockerfile.static"
+    image: Image = docker_client.images.build(path=str(dockerfile.parent), dockerfile=str(dockerfile))[0]
+    yield image
+    docker_client.images.remove(image.id, force=True)
+
+
+@pytest.mark.parametrize("in_container", [True])
+def test_python_select_by_runtime_symbols(
+    tmp_path,
+    application_docker_container,
+    assert_collapsed,
+) -> None:
+    """
+    Tests that profiling of processes running a statically linked, renamed Python interpreter, which has neither
+    "python" nor "libpython" in its "/proc/pid/maps". We expect to select these because their executable defines
+    the CPython runtime symbols.
+    """
+    with PySpyProfiler(1000, 1, Event(), str(tmp_path)) as profiler:
+        process_collapsed = profiler.snapshot()
+    assert_collapsed(process_collapsed.get(application_docker_container.attrs["State"]["Pid"]))
+
+
+def test_small_executables_are_not_parsed(monkeypatch) -> None:
+    parsed = []
+    monkeypatch.setattr(python, "elf_has_defined_symbols", lambda path, names: parsed.append(path) or False)
+    process = subprocess.Popen(["sleep", "60"])
+    try:
+        assert not python.executable_has_python_runtime(process.pid)
+    finally:
+        process.kill()
+        process.wait()
+    assert parsed == []
+
+
+def test_executables_cache_eviction(monkeypatch) -> None:
+    monkeypatch.setattr(python, "pgrep_maps", lambda match: [])
+    # an executable that no process runs
+    python._PYTHON_EXECUTABLES_CACHE[(0, 0, 0)] = True
+    python.find_python_processes()
+    assert (0, 0, 0) not in python._PYTHON_EXECUTABLES_CACHE
@@ -0,0 +1,89 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import re
+import sys
+from xml.etree import ElementTree
+
+from gprofiler.svg_flamegraph import SvgOptions, frame_color, render_svg_flamegraph
+
+SVG_NS = "{http://www.w3.org/2000/svg}"
+
+COLLAPSED = """#{"hostname": "host"}
+python;main;<module>_[p];work 60
+python;main;<module>_[p];idle 30
+java;Foo.bar_[j];do_syscall_64_[k] 10
+"""
+
+
+def _frames(svg: str) -> dict:
+    """
+    :returns: The frames of the SVG by their name: (x, y, width, title).
+    """
+    frames = {}
+    for g in ElementTree.fromstring(svg).iter(f"{SVG_NS}g"):
+        rect = g.find(f"{SVG_NS}rect")
+        title = g.find(f"{SVG_NS}title")
+        assert rect is not None and title is not None
+        frames[g.get("data-name")] = (
+            float(rect.get("x")),
+            float(rect.get("y")),
+            float(rect.get("width")),
+            title.text,
+        )
+    return frames
+
+
+def test_layout() -> None:
+    frames = _frames(render_svg_flamegraph(COLLAPSED, SvgOptions(width=1020)))
+    # 1000 pixels for 100 samples
+    assert frames["all"][0] == 10 and frames["all"][2] == 1000
+    assert frames["java"][:3] == (10, frames["python"][1], 100)
+    assert frames["python"][0] == 110 and frames["python"][2] == 900
+    # children are stacked above their parents, sorted by name
+    assert frames["main"][1] < frames["python"][1] < frames["all"][1]
+    assert frames["idle"][0] == 110 and frames["work"][0] == 410
+    assert frames["work"][3] == "work (60 samples, 60.00%)"
+
+
+def test_min_width() -> None:
+    frames = _frames(render_svg_flamegraph(COLLAPSED, SvgOptions(width=120, min_width=12)))
+    # 10 samples are 10 pixels wide
+    assert "java" not in frames and "do_syscall_64_[k]" not in frames
+    assert "work" in frames
+
+
+def test_escaping() -> None:
+    svg = render_svg_flamegraph("app;std::vector<int>::push_back 5", SvgOptions(title="a & b"))
+    frames = _frames(svg)
+    assert "std::vector<int>::push_back" in frames
+    assert ElementTree.fromstring(svg).find(f"{SVG_NS}text").text == "a & b"
+
+
+def test_search() -> None:
+    assert "<script>" in render_svg_flamegraph(COLLAPSED)
+    svg = render_svg_flamegraph(COLLAPSED, SvgOptions(search=False))
+    assert "<script>" not in svg and "onmouseover" not in svg
+
+
+def test_empty() -> None:
+    svg = render_svg_flamegraph("")
+    assert not _frames(svg)
+
+
+def test_colors() -> None:
+    # deterministic, so frames keep their colors across flamegraphs
+    assert frame_color("work") == frame_color("work")
+    r, g, b = map(int, re.findall(r"\d+", frame_color("Foo.bar_[j]", "annotations")))
+    # Java frames are green
+    assert g > r and g > b
+
+
+def test_deep_stack() -> None:
+    # deeper than the recursion limit - Java stacks may be
+    depth = sys.getrecursionlimit() + 500
+    svg = render_svg_flamegraph("java;" + ";".join(f"frame{i}" for i in range(depth)) + " 1")
+    frames = _frames(svg)
+    assert len(frames) == depth + 2
+    assert frames[f"frame{depth - 1}"][1] < frames["frame0"][1] < frames["java"][1]
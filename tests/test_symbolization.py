@@ -0,0 +1,45 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import ctypes
+import os
+from pathlib import Path
+
+from gprofiler.symbolization import DEFERRED_FRAME_REGEX, DeferredFramesResolver, Symbolizer
+
+
+def _mapped_path(address: int) -> str:
+    for line in Path("/proc/self/maps").read_text().splitlines():
+        addresses, _, _, _, _, *path = line.split()
+        start, end = (int(a, 16) for a in addresses.split("-"))
+        if start <= address < end:
+            return path[0]
+    raise AssertionError(f"address {address:x} is not mapped")
+
+
+def test_deferred_symbolization_round_trip(tmp_path: Path) -> None:
+    # Py_Main resides either in the Python executable, or in libpython.
+    address = ctypes.cast(ctypes.pythonapi.Py_Main, ctypes.c_void_p).value
+    assert address is not None
+    path = _mapped_path(address)
+
+    raw_stack = f"\t{address:x} ({path})\n\t1000 ([unknown])"
+    stack = DeferredFramesResolver().resolve_stack(os.getpid(), raw_stack)
+    frame_line, unknown_line = stack.splitlines()
+    sym = frame_line.split(" ")[1]
+    m = DEFERRED_FRAME_REGEX.match(sym)
+    assert m is not None, sym
+    assert m.group("name") == os.path.basename(path)
+    assert unknown_line == "\t1000 [unknown] ([unknown])"
+
+    # not in the store - left as is
+    assert Symbolizer([str(tmp_path)]).symbolize_frame(sym + "_[n]") == sym + "_[n]"
+
+    (tmp_path / os.path.basename(path)).symlink_to(path)
+    symbolizer = Symbolizer([str(tmp_path)])
+    assert symbolizer.symbolize_frame(sym + "_[n]") == "Py_Main_[n]"
+    assert (
+        symbolizer.symbolize_collapsed(f"# header\npython;{sym};{sym} 2\npython;{sym};Py_Main 3\n")
+        == "# header\npython;Py_Main;Py_Main 5"
+    )
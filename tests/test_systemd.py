@@ -0,0 +1,35 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+from typing import Optional
+
+import pytest
+
+from gprofiler.systemd import get_systemd_unit_from_cgroup
+
+
+@pytest.mark.parametrize(
+    "cgroup,unit",
+    [
+        # cgroup v2
+        ("0::/system.slice/nginx.service\n", "nginx.service"),
+        ("0::/user.slice/user-1000.slice/session-2.scope\n", "session-2.scope"),
+        ("0::/user.slice/user-1000.slice/user@1000.service/app.slice/app-foo.scope\n", "app-foo.scope"),
+        # delegated sub-cgroups belong to the unit
+        ("0::/system.slice/nginx.service/worker\n", "nginx.service"),
+        ("0::/system.slice/containerd.service/a.slice/b\n", "containerd.service"),
+        ("0::/system.slice/docker-0123456789abcdef.scope/init\n", None),
+        ("0::/init.scope\n", None),
+        ("0::/kubepods.slice/kubepods-pod1.slice/cri-containerd-abc.scope\n", None),
+        ("0::/system.slice/docker-0123456789abcdef.scope\n", None),
+        # cgroup v1
+        (
+            "12:cpu,cpuacct:/system.slice/cron.service\n1:name=systemd:/system.slice/cron.service\n",
+            "cron.service",
+        ),
+        ("12:cpu,cpuacct:/docker/abc\n1:name=systemd:/docker/abc\n", None),
+    ],
+)
+def test_get_systemd_unit_from_cgroup(cgroup: str, unit: Optional[str]) -> None:
+    assert get_systemd_unit_from_cgroup(cgroup) == unit
@@ -0,0 +1,134 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import json
+import os
+import subprocess
+import sys
+import time
+from http.server import BaseHTTPRequestHandler, HTTPServer
+from threading import Thread
+from typing import Dict, Iterator
+
+import pytest
+
+from gprofiler import task_metadata
+from gprofiler.task_metadata import (
+    evict_task_labels_cache,
+    get_process_task_labels,
+    get_processes_task_labels,
+    task_frame,
+)
+
+ECS_TASK_METADATA = {
+    "Cluster": "arn:aws:ecs:us-east-1:123456789012:cluster/prod",
+    "TaskARN": "arn:aws:ecs:us-east-1:123456789012:task/prod/0123456789abcdef",
+    "Family": "checkout",
+    "Revision": "42",
+}
+
+
+class EcsMetadataHandler(BaseHTTPRequestHandler):
+    """
+    A local stand-in of the ECS task metadata endpoint.
+    """
+
+    def do_GET(self) -> None:
+        if self.path == "/v4/container-id/task":
+            body = json.dumps(ECS_TASK_METADATA).encode()
+            self.send_response(200)
+            self.send_header("Content-Type", "application/json")
+            self.send_header("Content-Length", str(len(body)))
+            self.end_headers()
+            self.wfile.write(body)
+        else:
+            self.send_error(404)
+
+    def log_message(self, *args) -> None:
+        pass
+
+
+@pytest.fixture
+def ecs_metadata_uri() -> Iterator[str]:
+    server = HTTPServer(("127.0.0.1", 0), EcsMetadataHandler)
+    thread = Thread(target=server.serve_forever, daemon=True)
+    thread.start()
+    try:
+        yield f"http://127.0.0.1:{server.server_port}/v4/container-id"
+    finally:
+        server.shutdown()
+
+
+def _get_task_labels(env: Dict[str, str]) -> Dict:
+    process = subprocess.Popen([sys.executable, "-c", "import time; time.sleep(60)"], env={**os.environ, **env})
+    try:
+        time.sleep(0.5)
+        return get_processes_task_labels([process.pid]).get(process.pid, {})
+    finally:
+        process.kill()
+        process.wait()
+
+
+def test_ecs_task_labels(ecs_metadata_uri: str) -> None:
+    labels = _get_task_labels({"ECS_CONTAINER_METADATA_URI_V4": ecs_metadata_uri})
+    assert labels == {"ecs_cluster": "prod", "ecs_task_family": "checkout", "ecs_task_revision": "42"}
+    assert task_frame(labels) == "[checkout:42]"
+
+
+def test_nomad_task_labels() -> None:
+    labels = _get_task_labels(
+        {
+            "NOMAD_NAMESPACE": "default",
+            "NOMAD_JOB_NAME": "web",
+            "NOMAD_GROUP_NAME": "frontend",
+            "NOMAD_TASK_NAME": "nginx",
+            "NOMAD_ALLOC_ID": "5a1b2c3d-0000-0000-0000-000000000000",
+        }
+    )
+    assert labels == {
+        "nomad_namespace": "default",
+        "nomad_job": "web",
+        "nomad_group": "frontend",
+        "nomad_task": "nginx",
+        "nomad_alloc_id": "5a1b2c3d-0000-0000-0000-000000000000",
+    }
+    assert task_frame(labels) == "[web/frontend/nginx]"
+
+
+def test_unreachable_ecs_endpoint() -> None:
+    assert _get_task_labels({"ECS_CONTAINER_METADATA_URI_V4": "http://127.0.0.1:1/v4/container-id"}) == {}
+
+
+def test_ecs_fetch_failure_backoff(monkeypatch) -> None:
+    now = 1000.0
+    fetches = []
+    endpoint_up = False
+
+    def _fetch_ecs_task_metadata(pid: int, metadata_uri: str) -> Dict:
+        fetches.append(now)
+        if not endpoint_up:
+            raise Exception("connection refused")
+        return ECS_TASK_METADATA
+
+    monkeypatch.setattr(time, "monotonic", lambda: now)
+    monkeypatch.setattr(task_metadata, "_fetch_ecs_task_metadata", _fetch_ecs_task_metadata)
+    env = {"ECS_CONTAINER_METADATA_URI_V4": "http://169.254.170.2/v4/backoff", "NOMAD_JOB_NAME": "web"}
+    monkeypatch.setattr(task_metadata, "get_process_environment", lambda pid: env)
+
+    # the failure isn't cached for the process, and the endpoint isn't tried again during the backoff
+    assert get_process_task_labels(os.getpid()) == {"nomad_job": "web"}
+    assert get_process_task_labels(os.getpid()) == {"nomad_job": "web"}
+    assert fetches == [1000.0]
+    now += task_metadata.ECS_METADATA_RETRY_BACKOFF
+    get_process_task_labels(os.getpid())
+    # the backoff doubles
+    now += task_metadata.ECS_METADATA_RETRY_BACKOFF
+    get_process_task_labels(os.getpid())
+    assert fetches == [1000.0, 1030.0]
+
+    endpoint_up = True
+    now += task_metadata.ECS_METADATA_RETRY_BACKOFF
+    assert get_process_task_labels(os.getpid())["ecs_task_family"] == "checkout"
+    assert fetches == [1000.0, 1030.0, 1090.0]
+    evict_task_labels_cache(set())
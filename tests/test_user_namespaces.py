@@ -0,0 +1,81 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import os
+import subprocess
+import sys
+from pathlib import Path
+from typing import Iterator, Optional, Tuple
+
+import pytest
+
+from gprofiler.user_namespaces import IdMapping, choose_files_owner, get_files_owner, parse_id_map
+from gprofiler.utils import touch_path
+
+CLONE_NEWUSER = 0x10000000
+
+
+@pytest.fixture
+def remapped_process() -> Iterator[subprocess.Popen]:
+    """
+    A process in a new user namespace, where root is mapped to 100000 (like Docker's userns-remap does).
+    """
+    process = subprocess.Popen(
+        [
+            sys.executable,
+            "-c",
+            f"import ctypes, sys, time; assert ctypes.CDLL(None).unshare({CLONE_NEWUSER}) == 0; print(flush=True);"
+            " sys.stdin.readline(); time.sleep(60)",
+        ],
+        stdin=subprocess.PIPE,
+        stdout=subprocess.PIPE,
+    )
+    assert process.stdin is not None and process.stdout is not None
+    try:
+        process.stdout.readline()  # unshared
+        Path(f"/proc/{process.pid}/uid_map").write_text("0 100000 65536\n")
+        Path(f"/proc/{process.pid}/gid_map").write_text("0 100000 65536\n")
+        process.stdin.write(b"\n")
+        process.stdin.flush()
+        yield process
+    finally:
+        process.kill()
+        process.wait()
+
+
+@pytest.mark.parametrize(
+    "uid_map,gid_map,owner",
+    [
+        # root is mapped to itself (the initial namespace, or a namespace of a rootful container)
+        ("0 0 4294967295\n", "0 0 4294967295\n", None),
+        # remapped root
+        ("0 100000 65536\n", "0 100000 65536\n", (100000, 100000)),
+        # rootless containers: only the user (and subordinate IDs) are mapped, root of the namespace isn't
+        ("1000 1000 1\n1 200000 999\n", "1000 1000 1\n", (1000, 1000)),
+    ],
+)
+def test_choose_files_owner(uid_map: str, gid_map: str, owner: Optional[Tuple[int, int]]) -> None:
+    assert choose_files_owner(parse_id_map(uid_map), parse_id_map(gid_map), (1000, 1000)) == owner
+
+
+def test_parse_id_map() -> None:
+    assert parse_id_map("         0     100000      65536\n     65536       1000          1\n") == [
+        IdMapping(0, 100000, 65536),
+        IdMapping(65536, 1000, 1),
+    ]
+
+
+def test_files_owner_of_process_in_our_namespace() -> None:
+    assert get_files_owner(os.getpid()) is None
+
+
+def test_files_of_remapped_process(remapped_process: subprocess.Popen, tmp_path: Path) -> None:
+    owner = get_files_owner(remapped_process.pid)
+    assert owner == (100000, 100000)
+
+    path = tmp_path / "output"
+    touch_path(str(path), 0o666, owner)
+    st = path.stat()
+    assert (st.st_uid, st.st_gid) == (100000, 100000)
+    assert st.st_mode & 0o777 == 0o666
@@ -0,0 +1,82 @@
+#
+# Copyright (c) Granulate. All rights reserved.
+# Licensed under the AGPL3 License. See LICENSE.md in the project root for license information.
+#
+import os
+import subprocess
+import sys
+import time
+import zipfile
+from pathlib import Path
+
+import pytest
+
+from gprofiler import versions
+from gprofiler.versions import JAR_VERSION_LABEL, get_jar_version, get_processes_versions, label_frame
+
+
+def test_process_versions_from_environment_and_jar_manifest(tmp_path: Path) -> None:
+    with zipfile.ZipFile(tmp_path / "app.jar", "w") as jar:
+        jar.writestr("META-INF/MANIFEST.MF", "Manifest-Version: 1.0\nImplementation-Version: 2.4.1\n")
+
+    # a stand-in for "java -jar app.jar" - only the command line matters.
+    process = subprocess.Popen(
+        [sys.executable, "-c", "import time; time.sleep(60)", "-jar", "app.jar"],
+        cwd=str(tmp_path),
+        env={**os.environ, "APP_VERSION": "1.2.3", "GIT_SHA": ""},
+    )
+    try:
+        time.sleep(0.5)
+        versions = get_processes_versions([process.pid, os.getpid()], ["APP_VERSION", "GIT_SHA"])
+    finally:
+        process.kill()
+        process.wait()
+
+    # empty variables are ignored
+    assert versions[process.pid] == {"APP_VERSION": "1.2.3", JAR_VERSION_LABEL: "2.4.1"}
+
+
+def test_jar_manifest_too_large(monkeypatch, tmp_path: Path) -> None:
+    jar_path = tmp_path / "app.jar"
+    with zipfile.ZipFile(jar_path, "w", zipfile.ZIP_DEFLATED) as jar:
+        jar.writestr("META-INF/MANIFEST.MF", "Implementation-Version: 2.4.1\n" + "X-Padding: \n" * 1000)
+    cmdline = ["java", "-jar", str(jar_path)]
+    assert get_jar_version(os.getpid(), cmdline) == "2.4.1"
+    monkeypatch.setattr(versions, "MAX_MANIFEST_SIZE", 1024)
+    assert get_jar_version(os.getpid(), cmdline) is None
+
+
+@pytest.mark.parametrize(
+    "error",
+    [
+        RuntimeError("File 'META-INF/MANIFEST.MF' is encrypted, password required for extraction"),
+        NotImplementedError("That compression method is not supported"),
+    ],
+)
+def test_unreadable_jar_manifest(monkeypatch, tmp_path: Path, error: Exception) -> None:
+    def read(self: zipfile.ZipFile, name: str) -> bytes:
+        raise error
+
+    with zipfile.ZipFile(tmp_path / "app.jar", "w") as jar:
+        jar.writestr("META-INF/MANIFEST.MF", "Implementation-Version: 2.4.1\n")
+    monkeypatch.setattr(zipfile.ZipFile, "read", read)
+    process = subprocess.Popen(
+        [sys.executable, "-c", "import time; time.sleep(60)", "-jar", "app.jar"],
+        cwd=str(tmp_path),
+        env={**os.environ, "APP_VERSION": "1.2.3"},
+    )
+    try:
+        time.sleep(0.5)
+        process_versions = get_processes_versions([process.pid], ["APP_VERSION"])
+    finally:
+        process.kill()
+        process.wait()
+
+    # the other versions are still taken
+    assert process_versions[process.pid] == {"APP_VERSION": "1.2.3"}
+
+
+def test_label_frame() -> None:
+    assert label_frame({"APP_VERSION": "1.2.3", "container_image": "app;1\n"}) == (
+        "[APP_VERSION=1.2.3, container_image=app_1_]"
+    )